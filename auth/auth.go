@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role is a set of endpoints a credential may call
+type Role string
+
+const (
+	// RoleRead reads keys
+	RoleRead Role = "read"
+	// RoleWrite writes keys, it implies RoleRead
+	RoleWrite Role = "write"
+	// RoleAdmin manages the cluster, the namespaces and purges keys, it implies RoleWrite
+	RoleAdmin Role = "admin"
+	// RoleReplication is held by the nodes for the calls they make to each other
+	RoleReplication Role = "replication"
+)
+
+// HMACScheme is the scheme of the Authorization header of signed requests:
+// KV-HMAC-SHA256 Credential=<id>, Timestamp=<unix seconds>, Nonce=<hex>, Signature=<hex>
+const HMACScheme = "KV-HMAC-SHA256"
+
+// BodyHashHeader carries the hex SHA-256 of the body of a signed request. It is signed instead of the
+// body, so that the signature is checked before the body is read.
+const BodyHashHeader = "X-Kv-Content-Sha256"
+
+// MaxClockSkew is how far the timestamp of a signed request may be from the clock of the node
+const MaxClockSkew = 5 * time.Minute
+
+// MaxSignedBody is the largest body of a signed request, the body is hashed before the request is served
+const MaxSignedBody = 64 << 20
+
+// maxNonce is the length of the longest nonce of a signed request
+const maxNonce = 64
+
+// signedHeaders change the meaning of a request and are signed along with every X-Kv- header
+var signedHeaders = []string{"Content-Type", "If-Match", "If-None-Match", "Last-Event-ID"}
+
+var (
+	// ErrUnauthenticated is returned when a request carries no valid credential
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrForbidden is returned when the credential of a request does not grant the endpoint
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Credential is an identity and what it may do. It authenticates with Token as a bearer token, or by
+// signing its requests with Secret, or both.
+type Credential struct {
+	ID     string `toml:"id"`
+	Token  string `toml:"token"`
+	Secret string `toml:"secret"`
+	Roles  []Role `toml:"roles"`
+	// Namespaces restricts reads and writes to these namespaces, "" is the default namespace. No
+	// namespaces allows all of them.
+	Namespaces []string `toml:"namespaces"`
+}
+
+// Allowed reports whether the credential grants the role, on the given namespace for reads and writes
+func (c *Credential) Allowed(role Role, namespace string) bool {
+	if !c.hasRole(role) {
+		return false
+	}
+	if role != RoleRead && role != RoleWrite || len(c.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range c.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Credential) hasRole(role Role) bool {
+	for _, r := range c.Roles {
+		switch {
+		case r == role:
+			return true
+		case r == RoleWrite && role == RoleRead:
+			return true
+		case r == RoleAdmin && (role == RoleRead || role == RoleWrite):
+			return true
+		}
+	}
+	return false
+}
+
+// Sign authenticates the request with the credential: a signature when it has a secret, the token
+// otherwise. The body is read to be hashed and replaced by a copy, the headers must be set beforehand.
+func (c *Credential) Sign(r *http.Request) error {
+	if c.Secret == "" {
+		r.Header.Set("Authorization", "Bearer "+c.Token)
+		return nil
+	}
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return err
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	}
+	sum := sha256.Sum256(body)
+	r.Header.Set(BodyHashHeader, hex.EncodeToString(sum[:]))
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	ts, n := strconv.FormatInt(time.Now().Unix(), 10), hex.EncodeToString(nonce)
+	sig := signature(c.Secret, r.Method, r.URL.RequestURI(), ts, n, r.Header)
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, Timestamp=%s, Nonce=%s, Signature=%s", HMACScheme, c.ID, ts, n, sig))
+	return nil
+}
+
+// signature is the hex HMAC-SHA256 of method \n uri \n timestamp \n nonce \n headers, where headers are
+// the signedHeaders and the X-Kv- headers present, BodyHashHeader included, as name:value lines in the
+// order of their names
+func signature(secret, method, uri, ts, nonce string, header http.Header) string {
+	names := append([]string(nil), signedHeaders...)
+	for name := range header {
+		if strings.HasPrefix(name, "X-Kv-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + ts + "\n" + nonce))
+	for _, name := range names {
+		mac.Write([]byte("\n" + strings.ToLower(name) + ":" + strings.Join(header.Values(name), ",")))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Config is the auth file of a node
+type Config struct {
+	// Node is the id of the credential this node uses for its calls to the other nodes
+	Node string `toml:"node"`
+	// Replication is the id of the credential used to pull the change log of the shard leader, the
+	// node credential when it is empty
+	Replication string       `toml:"replication"`
+	Credentials []Credential `toml:"credential"`
+}
+
+// LoadConfig parses the auth file
+func LoadConfig(file string) (*Config, error) {
+	var c Config
+	if _, err := toml.DecodeFile(file, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Credential returns the credential with the given id
+func (c *Config) Credential(id string) (*Credential, error) {
+	for i := range c.Credentials {
+		if c.Credentials[i].ID == id {
+			return &c.Credentials[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no credential %q", id)
+}
+
+// Authenticator identifies the credential of a request
+type Authenticator struct {
+	byToken map[[sha256.Size]byte]*Credential
+	byID    map[string]*Credential
+	nonces  nonceCache
+}
+
+// nonceCache remembers the nonces of the signed requests accepted by the node, so that each one is only
+// accepted once. A nonce is forgotten once its timestamp is too old for the request to be accepted anyway.
+type nonceCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// add records the nonce of a request of the credential sent at ts, and reports false if it was seen already
+func (n *nonceCache) add(id, nonce string, ts, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.seen == nil {
+		n.seen = make(map[string]time.Time)
+	}
+	if now.Sub(n.pruned) > time.Minute {
+		for k, t := range n.seen {
+			if now.Sub(t) > MaxClockSkew {
+				delete(n.seen, k)
+			}
+		}
+		n.pruned = now
+	}
+	key := id + "\n" + nonce
+	if _, ok := n.seen[key]; ok {
+		return false
+	}
+	n.seen[key] = ts
+	return true
+}
+
+// NewAuthenticator checks the credentials and indexes them
+func NewAuthenticator(creds []Credential) (*Authenticator, error) {
+	a := &Authenticator{byToken: make(map[[sha256.Size]byte]*Credential), byID: make(map[string]*Credential)}
+	for i := range creds {
+		c := &creds[i]
+		if c.ID == "" {
+			return nil, fmt.Errorf("credential %d has no id", i)
+		}
+		if c.Token == "" && c.Secret == "" {
+			return nil, fmt.Errorf("credential %s has neither a token nor a secret", c.ID)
+		}
+		for _, role := range c.Roles {
+			if role != RoleRead && role != RoleWrite && role != RoleAdmin && role != RoleReplication {
+				return nil, fmt.Errorf("unknown role %q of credential %s", role, c.ID)
+			}
+		}
+		if a.byID[c.ID] != nil {
+			return nil, fmt.Errorf("duplicate credential %s", c.ID)
+		}
+		a.byID[c.ID] = c
+		if c.Token != "" {
+			// tokens are looked up by hash, so that the lookup time does not depend on their content
+			sum := sha256.Sum256([]byte(c.Token))
+			if a.byToken[sum] != nil {
+				return nil, fmt.Errorf("credential %s shares its token with another one", c.ID)
+			}
+			a.byToken[sum] = c
+		}
+	}
+	return a, nil
+}
+
+// Authenticate returns the credential of the request, carried as a bearer token or a signature. The
+// body of a signed request is only read once the signature of its headers is checked, to be compared
+// with its signed hash, and it is replaced by a copy. A signed request is accepted once by a node.
+func (a *Authenticator) Authenticate(r *http.Request) (*Credential, error) {
+	header := r.Header.Get("Authorization")
+	scheme, params, _ := strings.Cut(header, " ")
+	switch scheme {
+	case "":
+		return nil, fmt.Errorf("%w: no Authorization header", ErrUnauthenticated)
+	case "Bearer":
+		if c := a.byToken[sha256.Sum256([]byte(strings.TrimSpace(params)))]; c != nil {
+			return c, nil
+		}
+		return nil, fmt.Errorf("%w: unknown token", ErrUnauthenticated)
+	case HMACScheme:
+		return a.verify(r, params)
+	}
+	return nil, fmt.Errorf("%w: unsupported scheme %q", ErrUnauthenticated, scheme)
+}
+
+func (a *Authenticator) verify(r *http.Request, params string) (*Credential, error) {
+	fields := make(map[string]string)
+	for _, p := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		fields[k] = v
+	}
+	c := a.byID[fields["Credential"]]
+	if c == nil || c.Secret == "" {
+		return nil, fmt.Errorf("%w: unknown credential %q", ErrUnauthenticated, fields["Credential"])
+	}
+	ts, err := strconv.ParseInt(fields["Timestamp"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid timestamp %q", ErrUnauthenticated, fields["Timestamp"])
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(ts, 0)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return nil, fmt.Errorf("%w: timestamp %d is too far from the time of the node", ErrUnauthenticated, ts)
+	}
+	nonce := fields["Nonce"]
+	if nonce == "" || len(nonce) > maxNonce {
+		return nil, fmt.Errorf("%w: invalid nonce %q", ErrUnauthenticated, nonce)
+	}
+	bodyHash, err := hex.DecodeString(r.Header.Get(BodyHashHeader))
+	if err != nil || len(bodyHash) != sha256.Size {
+		return nil, fmt.Errorf("%w: invalid %s", ErrUnauthenticated, BodyHashHeader)
+	}
+	expected := signature(c.Secret, r.Method, r.RequestURI, fields["Timestamp"], nonce, r.Header)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(fields["Signature"])) != 1 {
+		return nil, fmt.Errorf("%w: invalid signature", ErrUnauthenticated)
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(r.Body, MaxSignedBody+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > MaxSignedBody {
+			return nil, fmt.Errorf("%w: signed body larger than %d bytes", ErrUnauthenticated, MaxSignedBody)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if sum := sha256.Sum256(body); subtle.ConstantTimeCompare(sum[:], bodyHash) != 1 {
+		return nil, fmt.Errorf("%w: the body does not match %s", ErrUnauthenticated, BodyHashHeader)
+	}
+	if !a.nonces.add(c.ID, nonce, time.Unix(ts, 0), now) {
+		return nil, fmt.Errorf("%w: replayed request", ErrUnauthenticated)
+	}
+	return c, nil
+}
+
+// Transport authenticates the requests sent through it with a credential, replacing the Authorization
+// header they carry
+type Transport struct {
+	// Base sends the requests, http.DefaultTransport when nil
+	Base       http.RoundTripper
+	Credential *Credential
+}
+
+// NewTransport returns a transport signing the requests sent through base with the credential
+func NewTransport(base http.RoundTripper, cred *Credential) *Transport {
+	return &Transport{Base: base, Credential: cred}
+}
+
+// RoundTrip signs a copy of the request and sends it
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	req := r.Clone(r.Context())
+	if err := t.Credential.Sign(req); err != nil {
+		return nil, err
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,218 @@
+package auth_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/auth"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	creds := []auth.Credential{
+		{ID: "app", Token: "app-token", Roles: []auth.Role{auth.RoleWrite}, Namespaces: []string{"", "web"}},
+		{ID: "node", Secret: "node-secret", Roles: []auth.Role{auth.RoleAdmin, auth.RoleReplication}},
+	}
+	a, err := auth.NewAuthenticator(creds)
+	assert.NoError(t, err)
+
+	authenticate := func(r *http.Request) (*auth.Credential, error) {
+		// the server sees the request URI, not the URL of the client
+		r.RequestURI = r.URL.RequestURI()
+		return a.Authenticate(r)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/keys/a", nil)
+	_, err = authenticate(r)
+	assert.True(t, errors.Is(err, auth.ErrUnauthenticated))
+
+	r.Header.Set("Authorization", "Bearer app-token")
+	cred, err := authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "app", cred.ID)
+	r.Header.Set("Authorization", "Bearer wrong")
+	_, err = authenticate(r)
+	assert.True(t, errors.Is(err, auth.ErrUnauthenticated))
+	r.Header.Set("Authorization", "Basic YTpi")
+	_, err = authenticate(r)
+	assert.True(t, errors.Is(err, auth.ErrUnauthenticated))
+
+	// a signed request keeps its body for the handler
+	r = httptest.NewRequest(http.MethodPut, "http://127.0.0.1:8080/v1/keys/a?ttl=1h", strings.NewReader("value"))
+	assert.NoError(t, creds[1].Sign(r))
+	assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), auth.HMACScheme+" Credential=node,"))
+	cred, err = authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "node", cred.ID)
+	body, err := io.ReadAll(r.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "value", string(body))
+
+	// a signed request is accepted once
+	r.Body = io.NopCloser(strings.NewReader("value"))
+	_, err = authenticate(r)
+	assert.ErrorContains(t, err, "replayed")
+
+	// the signature covers the method, the URI, the body and the headers changing the meaning of the request
+	r = httptest.NewRequest(http.MethodPut, "/v1/keys/a?ttl=1h", strings.NewReader("value"))
+	r.Header.Set("X-Kv-Namespace", "web")
+	r.Header.Set("If-Match", `"3"`)
+	assert.NoError(t, creds[1].Sign(r))
+	tamper := map[string]func(r *http.Request){
+		"body":      func(r *http.Request) { r.Body = io.NopCloser(strings.NewReader("other")) },
+		"uri":       func(r *http.Request) { r.RequestURI = "/v1/keys/b?ttl=1h" },
+		"method":    func(r *http.Request) { r.Method = http.MethodDelete },
+		"namespace": func(r *http.Request) { r.Header.Set("X-Kv-Namespace", "billing") },
+		"condition": func(r *http.Request) { r.Header.Del("If-Match") },
+		"type":      func(r *http.Request) { r.Header.Set("Content-Type", "text/html") },
+		"added":     func(r *http.Request) { r.Header.Set("X-Kv-Forwarded", "true") },
+	}
+	for name, change := range tamper {
+		tampered := httptest.NewRequest(http.MethodPut, "/v1/keys/a?ttl=1h", strings.NewReader("value"))
+		tampered.Header = r.Header.Clone()
+		change(tampered)
+		_, err = a.Authenticate(tampered)
+		assert.True(t, errors.Is(err, auth.ErrUnauthenticated), name)
+	}
+	cred, err = authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "node", cred.ID)
+
+	// the body is not read before the signature of the headers is checked
+	unsigned := httptest.NewRequest(http.MethodPut, "/v1/keys/a", nil)
+	body = make([]byte, 0)
+	unsigned.Body = readerFunc(func(p []byte) (int, error) {
+		body = append(body, 'x')
+		return 0, io.EOF
+	})
+	unsigned.Header.Set(auth.BodyHashHeader, strings.Repeat("00", 32))
+	unsigned.Header.Set("Authorization", fmt.Sprintf("%s Credential=node, Timestamp=%d, Nonce=01, Signature=00", auth.HMACScheme, time.Now().Unix()))
+	_, err = authenticate(unsigned)
+	assert.ErrorContains(t, err, "invalid signature")
+	assert.Empty(t, body)
+
+	// old signatures can not be replayed
+	stale := httptest.NewRequest(http.MethodGet, "/purge", nil)
+	stale.Header.Set("Authorization", fmt.Sprintf("%s Credential=node, Timestamp=%d, Signature=00", auth.HMACScheme, time.Now().Add(-time.Hour).Unix()))
+	_, err = authenticate(stale)
+	assert.ErrorContains(t, err, "too far")
+
+	// the token of a credential can not be used as a secret
+	r = httptest.NewRequest(http.MethodGet, "/v1/keys/a", nil)
+	assert.NoError(t, (&auth.Credential{ID: "app", Secret: "app-token"}).Sign(r))
+	_, err = authenticate(r)
+	assert.True(t, errors.Is(err, auth.ErrUnauthenticated))
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+func (f readerFunc) Close() error { return nil }
+
+func TestAllowed(t *testing.T) {
+	app := &auth.Credential{ID: "app", Roles: []auth.Role{auth.RoleWrite}, Namespaces: []string{"", "web"}}
+	assert.True(t, app.Allowed(auth.RoleRead, ""))
+	assert.True(t, app.Allowed(auth.RoleWrite, "web"))
+	assert.False(t, app.Allowed(auth.RoleWrite, "billing"))
+	assert.False(t, app.Allowed(auth.RoleAdmin, ""))
+	assert.False(t, app.Allowed(auth.RoleReplication, ""))
+
+	admin := &auth.Credential{ID: "admin", Roles: []auth.Role{auth.RoleAdmin}}
+	assert.True(t, admin.Allowed(auth.RoleWrite, "billing"))
+	assert.True(t, admin.Allowed(auth.RoleAdmin, ""))
+	assert.False(t, admin.Allowed(auth.RoleReplication, ""))
+
+	replicator := &auth.Credential{ID: "replicator", Roles: []auth.Role{auth.RoleReplication}}
+	assert.True(t, replicator.Allowed(auth.RoleReplication, ""))
+	assert.False(t, replicator.Allowed(auth.RoleRead, ""))
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	for _, creds := range [][]auth.Credential{
+		{{Token: "t"}},
+		{{ID: "a"}},
+		{{ID: "a", Token: "t", Roles: []auth.Role{"root"}}},
+		{{ID: "a", Token: "t"}, {ID: "a", Token: "u"}},
+		{{ID: "a", Token: "t"}, {ID: "b", Token: "t"}},
+	} {
+		_, err := auth.NewAuthenticator(creds)
+		assert.Error(t, err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "auth-*.toml")
+	assert.NoError(t, err)
+	_, err = f.WriteString(`node = "node"
+replication = "replicator"
+
+[[credential]]
+id = "node"
+secret = "s1"
+roles = ["admin", "replication"]
+
+[[credential]]
+id = "replicator"
+secret = "s2"
+roles = ["replication"]
+
+[[credential]]
+id = "web"
+token = "t1"
+roles = ["read"]
+namespaces = ["web"]
+`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	c, err := auth.LoadConfig(f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "node", c.Node)
+	assert.Len(t, c.Credentials, 3)
+	cred, err := c.Credential(c.Replication)
+	assert.NoError(t, err)
+	assert.Equal(t, "s2", cred.Secret)
+	cred, err = c.Credential("web")
+	assert.NoError(t, err)
+	assert.Equal(t, []auth.Role{auth.RoleRead}, cred.Roles)
+	assert.Equal(t, []string{"web"}, cred.Namespaces)
+	_, err = c.Credential("missing")
+	assert.Error(t, err)
+}
+
+func TestTransport(t *testing.T) {
+	node := auth.Credential{ID: "node", Secret: "secret", Roles: []auth.Role{auth.RoleReplication}}
+	a, err := auth.NewAuthenticator([]auth.Credential{node})
+	assert.NoError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, err := a.Authenticate(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(cred.ID + ":" + string(body)))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: auth.NewTransport(nil, &node)}
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/deleteReplica", strings.NewReader("ack"))
+	assert.NoError(t, err)
+	// the credential of the node replaces the one of the request
+	req.Header.Set("Authorization", "Bearer client")
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "node:ack", string(body))
+	assert.Equal(t, "Bearer client", req.Header.Get("Authorization"))
+}
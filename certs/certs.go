@@ -0,0 +1,184 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/config"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultReloadInterval is how often the certificate files are checked for changes
+const DefaultReloadInterval = 30 * time.Second
+
+// Reloader holds the certificate of the node and the CA it trusts, and reloads them when their files
+// change so that certificates can be renewed without restarting the node. New connections use the
+// reloaded certificates, established ones keep theirs.
+type Reloader struct {
+	conf       config.TLSConfig
+	clientAuth tls.ClientAuthType
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// pool is nil when the system roots are trusted
+	pool *x509.CertPool
+	// modTimes are the modification times of the files when they were loaded
+	modTimes map[string]time.Time
+}
+
+// NewReloader loads the certificates of the config
+func NewReloader(conf config.TLSConfig) (*Reloader, error) {
+	if conf.Cert == "" || conf.Key == "" {
+		return nil, fmt.Errorf("tls needs both a cert and a key")
+	}
+	r := &Reloader{conf: conf}
+	switch conf.ClientAuth {
+	case "", config.ClientAuthNone:
+		r.clientAuth = tls.NoClientCert
+	case config.ClientAuthVerifyIfGiven:
+		r.clientAuth = tls.VerifyClientCertIfGiven
+	case config.ClientAuthRequire:
+		r.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown clientAuth %q", conf.ClientAuth)
+	}
+	if r.clientAuth != tls.NoClientCert && conf.CA == "" {
+		return nil, fmt.Errorf("clientAuth %q needs a ca to verify the client certificates", conf.ClientAuth)
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// VerifiesClients reports whether the certificates presented by clients are verified
+func (r *Reloader) VerifiesClients() bool {
+	return r.clientAuth != tls.NoClientCert
+}
+
+// Reload reads the certificate files again, the current certificates are kept if they are invalid
+func (r *Reloader) Reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.conf.Cert, r.conf.Key)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.conf.CA != "" {
+		pem, err := os.ReadFile(r.conf.CA)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in ca %s", r.conf.CA)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.pool, r.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.conf.Cert, r.conf.Key}
+	if r.conf.CA != "" {
+		files = append(files, r.conf.CA)
+	}
+	return files
+}
+
+// changed reports whether a file was modified since it was loaded
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err == nil && !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run reloads the certificates whenever their files change until done is closed
+func (r *Reloader) Run(done chan bool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				log.Println("error reloading certificates: ", err)
+				continue
+			}
+			log.Println("reloaded certificates")
+		}
+	}
+}
+
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, r.pool
+}
+
+// ServerConfig returns the TLS config serving the current certificate and verifying the clients with
+// the current CA
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   r.clientAuth,
+			}, nil
+		},
+	}
+}
+
+// DialTLSContext opens a TLS connection to another node, presenting the current certificate and
+// verifying the node with the current CA
+func (r *Reloader) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	cert, pool := r.current()
+	dialer := &tls.Dialer{Config: &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		ServerName:   host,
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{*cert},
+	}}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// Transport returns a transport connecting to the other nodes with mutual TLS
+func (r *Reloader) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialTLSContext = r.DialTLSContext
+	return t
+}
@@ -0,0 +1,175 @@
+package certs_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/certs"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/config"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCA writes a new CA to dir and returns it with its key
+func writeCA(t *testing.T, dir string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kv test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", der)
+	return ca, key
+}
+
+// writeCert writes a certificate of the node signed by the CA to dir
+func writeCert(t *testing.T, dir, name string, serial int64, ca *x509.Certificate, caKey *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	writePEM(t, filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyDer)
+}
+
+func writePEM(t *testing.T, file, kind string, der []byte) {
+	assert.NoError(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600))
+}
+
+func startServer(t *testing.T, r *certs.Reloader) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(req.TLS.VerifiedChains) > 0 {
+			w.Write([]byte(req.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	}))
+	server.TLS = r.ServerConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(client *http.Client, url string) (string, *tls.ConnectionState, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), resp.TLS, err
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCA(t, dir)
+	writeCert(t, dir, "server", 2, ca, caKey)
+	writeCert(t, dir, "client", 3, ca, caKey)
+	conf := func(name string) config.TLSConfig {
+		return config.TLSConfig{
+			Cert:       filepath.Join(dir, name+".pem"),
+			Key:        filepath.Join(dir, name+"-key.pem"),
+			CA:         filepath.Join(dir, "ca.pem"),
+			ClientAuth: config.ClientAuthRequire,
+		}
+	}
+	serverCerts, err := certs.NewReloader(conf("server"))
+	assert.NoError(t, err)
+	assert.True(t, serverCerts.VerifiesClients())
+	server := startServer(t, serverCerts)
+
+	clientCerts, err := certs.NewReloader(conf("client"))
+	assert.NoError(t, err)
+	body, _, err := get(&http.Client{Transport: clientCerts.Transport()}, server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "client", body)
+
+	// a client without a certificate is rejected
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	_, _, err = get(&http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}, server.URL)
+	assert.Error(t, err)
+
+	// a server with a certificate of another CA is rejected
+	other := t.TempDir()
+	otherCA, otherKey := writeCA(t, other)
+	writeCert(t, other, "server", 2, otherCA, otherKey)
+	otherCerts, err := certs.NewReloader(config.TLSConfig{Cert: filepath.Join(other, "server.pem"), Key: filepath.Join(other, "server-key.pem")})
+	assert.NoError(t, err)
+	assert.False(t, otherCerts.VerifiesClients())
+	_, _, err = get(&http.Client{Transport: clientCerts.Transport()}, startServer(t, otherCerts).URL)
+	assert.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCA(t, dir)
+	writeCert(t, dir, "server", 2, ca, caKey)
+	serverCerts, err := certs.NewReloader(config.TLSConfig{
+		Cert: filepath.Join(dir, "server.pem"),
+		Key:  filepath.Join(dir, "server-key.pem"),
+		CA:   filepath.Join(dir, "ca.pem"),
+	})
+	assert.NoError(t, err)
+	server := startServer(t, serverCerts)
+	done := make(chan bool)
+	defer close(done)
+	go serverCerts.Run(done, 10*time.Millisecond)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	serial := func() int64 {
+		// a new connection for every request, established ones keep their certificate
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, DisableKeepAlives: true}}
+		_, state, err := get(client, server.URL)
+		if err != nil {
+			return 0
+		}
+		return state.PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(2), serial())
+
+	// a renewed certificate is served without a restart
+	writeCert(t, dir, "server", 4, ca, caKey)
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "server.pem"), future, future))
+	assert.Eventually(t, func() bool { return serial() == 4 }, 5*time.Second, 10*time.Millisecond)
+
+	// an invalid certificate is not loaded, the current one is kept
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "server.pem"), []byte("garbage"), 0600))
+	assert.Error(t, serverCerts.Reload())
+	assert.Equal(t, int64(4), serial())
+
+	_, err = certs.NewReloader(config.TLSConfig{Cert: filepath.Join(dir, "server.pem"), Key: filepath.Join(dir, "server-key.pem"), ClientAuth: config.ClientAuthRequire})
+	assert.Error(t, err, "client auth without a ca")
+}
@@ -3,19 +3,56 @@ package config
 import (
 	"fmt"
 	"github.com/BurntSushi/toml"
-	"hash/fnv"
+	"sort"
+	"sync"
 )
 
 // Shard contains the config of the shard
 type Shard struct {
-	ShardId int    `toml:"shardId"`
-	Name    string `toml:"name"`
-	Address string `toml:"address"`
+	ShardId  int      `toml:"shardId" json:"shardId"`
+	Name     string   `toml:"name" json:"name"`
+	Address  string   `toml:"address" json:"address"`
+	Replicas []string `toml:"replicas" json:"replicas,omitempty"`
+	// Weight scales the share of the keys owned by the shard, 1 when not set
+	Weight int `toml:"weight" json:"weight,omitempty"`
 }
 
-// ShardConfig contains the config of the shards
+// ShardConfig contains the config of the shards, it is also the shard map exchanged between nodes
 type ShardConfig struct {
-	AvailableShard []Shard `toml:"shard"`
+	// Version orders the successive shard maps of the cluster, a node only applies a newer one
+	Version uint64 `toml:"version" json:"version"`
+	// VirtualNodes is the number of points a shard of weight 1 owns on the hash ring
+	VirtualNodes   int     `toml:"virtualNodes" json:"virtualNodes"`
+	AvailableShard []Shard `toml:"shard" json:"shards"`
+	// TLS is the certificate of the node, it is not part of the shard map sent to the other nodes
+	TLS TLSConfig `toml:"tls" json:"-"`
+}
+
+// TLS client authentication modes of TLSConfig.ClientAuth
+const (
+	// ClientAuthNone does not ask clients for a certificate
+	ClientAuthNone = "none"
+	// ClientAuthVerifyIfGiven verifies the certificates clients present, the nodes always present theirs
+	ClientAuthVerifyIfGiven = "verify-if-given"
+	// ClientAuthRequire only accepts clients presenting a certificate signed by the CA
+	ClientAuthRequire = "require"
+)
+
+// TLSConfig configures TLS for the clients and the other nodes. The node presents its certificate
+// both as a server and as a client of the other nodes, so it must be valid for both uses and name the
+// addresses of the node.
+type TLSConfig struct {
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+	// CA verifies the certificates of the other nodes and of the clients, the system roots when empty
+	CA string `toml:"ca"`
+	// ClientAuth is one of ClientAuthNone (the default), ClientAuthVerifyIfGiven or ClientAuthRequire
+	ClientAuth string `toml:"clientAuth"`
+}
+
+// Enabled reports whether the node serves TLS
+func (c TLSConfig) Enabled() bool {
+	return c.Cert != ""
 }
 
 // ParseShardConfig parses the shard config file
@@ -27,38 +64,126 @@ func ParseShardConfig(file string) (ShardConfig, error) {
 	return c, nil
 }
 
-// ShardMetadata contains the metadata of the shards
+// ShardMetadata contains the metadata of the shards. Addrs and Replicas change when a shard elects a
+// new leader or a new shard map is applied, and Count and CurrIdx when a new shard map is applied; they
+// must be accessed through the methods below once the metadata is in use.
 type ShardMetadata struct {
-	Count   int
-	CurrIdx int
-	Addrs   map[int]string
+	Count    int
+	CurrIdx  int
+	Addrs    map[int]string
+	Replicas map[int][]string
+
+	mu sync.RWMutex
+	// terms is the election term in which the current leader of each shard was elected
+	terms map[int]uint64
+	ring  *Ring
+	// name is the name of the local shard and config the shard map the metadata was built from
+	name   string
+	config ShardConfig
 }
 
-// ParseShardMetadata parses the shard metadata
-func ParseShardMetadata(shards []Shard, currShardName string) (*ShardMetadata, error) {
+// ParseShardMetadata parses the shard metadata, virtualNodes is the number of points a shard of
+// weight 1 owns on the hash ring (DefaultVirtualNodes when 0)
+func ParseShardMetadata(shards []Shard, currShardName string, virtualNodes int) (*ShardMetadata, error) {
+	return NewShardMetadata(ShardConfig{VirtualNodes: virtualNodes, AvailableShard: shards}, currShardName)
+}
 
-	shardCount := len(shards)
+// NewShardMetadata builds the shard metadata from a shard map, a map without a version gets version 1
+func NewShardMetadata(c ShardConfig, currShardName string) (*ShardMetadata, error) {
+	if c.Version == 0 {
+		c.Version = 1
+	}
+	s := &ShardMetadata{name: currShardName}
+	if err := s.apply(c); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// apply replaces the shard map, the caller holds s.mu or is the only user of the metadata
+func (s *ShardMetadata) apply(c ShardConfig) error {
 	shardIdx := -1
 	addrShardPair := make(map[int]string)
+	replicas := make(map[int][]string)
+	weights := make(map[int]int)
 
-	for _, shard := range shards {
+	for _, shard := range c.AvailableShard {
 		if _, ok := addrShardPair[shard.ShardId]; ok {
-			return nil, fmt.Errorf("duplicate shard id %d", shard.ShardId)
+			return fmt.Errorf("duplicate shard id %d", shard.ShardId)
 		}
 		addrShardPair[shard.ShardId] = shard.Address
-		if shard.Name == currShardName {
+		replicas[shard.ShardId] = append([]string(nil), shard.Replicas...)
+		weights[shard.ShardId] = shard.Weight
+		if shard.Name == s.name {
 			shardIdx = shard.ShardId
 		}
 	}
 	if shardIdx < 0 {
-		return nil, fmt.Errorf("shard id %q not found", currShardName)
+		return fmt.Errorf("shard id %q not found", s.name)
+	}
+
+	// a leader elected since the previous map keeps leading if it is still a member of its shard
+	for shard, leader := range s.Addrs {
+		members := append([]string{addrShardPair[shard]}, replicas[shard]...)
+		for i, m := range members {
+			if i > 0 && m == leader {
+				members[0], members[i] = members[i], members[0]
+				addrShardPair[shard] = members[0]
+				replicas[shard] = members[1:]
+				break
+			}
+		}
 	}
 
-	return &ShardMetadata{
-		Count:   shardCount,
-		CurrIdx: shardIdx,
-		Addrs:   addrShardPair,
-	}, nil
+	s.Count = len(c.AvailableShard)
+	s.CurrIdx = shardIdx
+	s.Addrs = addrShardPair
+	s.Replicas = replicas
+	s.ring = NewRing(weights, c.VirtualNodes)
+	s.config = c
+	return nil
+}
+
+// ShardCount returns the number of shards of the shard map in use
+func (s *ShardMetadata) ShardCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Count
+}
+
+// CurrentShard returns the id of the shard of this node
+func (s *ShardMetadata) CurrentShard() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.CurrIdx
+}
+
+// Version returns the version of the shard map in use
+func (s *ShardMetadata) Version() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config.Version
+}
+
+// Config returns the shard map in use
+func (s *ShardMetadata) Config() ShardConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// Update applies a newer shard map. The local shard must still be part of it, and maps whose version
+// is not newer than the one in use are ignored and false is returned.
+func (s *ShardMetadata) Update(c ShardConfig) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.Version <= s.config.Version {
+		return false, nil
+	}
+	if err := s.apply(c); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // GetShardId returns the shard id for the given key
@@ -80,12 +205,115 @@ func (s *ShardConfig) GetAddrMapping() map[int]string {
 	return addrMapping
 }
 
-// GetShard returns the shard id for the given key
+// IsReplica reports whether addr is one of the replicas registered for the given shard
+func (s *ShardMetadata) IsReplica(shard int, addr string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, r := range s.Replicas[shard] {
+		if r == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Leader returns the address of the current leader of the shard
+func (s *ShardMetadata) Leader(shard int) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Addrs[shard]
+}
+
+// ReplicasOf returns the addresses of the current replicas of the shard
+func (s *ShardMetadata) ReplicasOf(shard int) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.Replicas[shard]...)
+}
+
+// Members returns the leader followed by the replicas of the shard
+func (s *ShardMetadata) Members(shard int) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string{s.Addrs[shard]}, s.Replicas[shard]...)
+}
+
+// Shards returns the ids of the shards in ascending order
+func (s *ShardMetadata) Shards() []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make([]int, 0, len(s.Addrs))
+	for id := range s.Addrs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// AllAddrs returns the address of every leader and replica in the cluster
+func (s *ShardMetadata) AllAddrs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var addrs []string
+	for shard, addr := range s.Addrs {
+		addrs = append(addrs, addr)
+		addrs = append(addrs, s.Replicas[shard]...)
+	}
+	return addrs
+}
+
+// SetLeader records that addr was elected leader of the shard in the given term; the previous leader
+// becomes a replica. Announcements from a term older than the known one are ignored and false is returned.
+func (s *ShardMetadata) SetLeader(shard int, addr string, term uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.terms == nil {
+		s.terms = make(map[int]uint64)
+	}
+	if term < s.terms[shard] {
+		return false
+	}
+	s.terms[shard] = term
+
+	old := s.Addrs[shard]
+	if old == addr {
+		return true
+	}
+	replicas := make([]string, 0, len(s.Replicas[shard]))
+	if old != "" {
+		replicas = append(replicas, old)
+	}
+	for _, r := range s.Replicas[shard] {
+		if r != addr {
+			replicas = append(replicas, r)
+		}
+	}
+	s.Addrs[shard] = addr
+	s.Replicas[shard] = replicas
+	return true
+}
+
+// GetShard returns the shard id owning the given key on the hash ring
 func (s *ShardMetadata) GetShard(key string) int {
-	hash := fnv.New64()
-	_, err := hash.Write([]byte(key))
-	if err != nil {
-		return 0
+	s.mu.RLock()
+	ring := s.ring
+	s.mu.RUnlock()
+	if ring == nil {
+		ring = s.buildRing()
+	}
+	return ring.Get(key)
+}
+
+// buildRing gives every shard of Addrs the same weight, for metadata that was not parsed from a config
+func (s *ShardMetadata) buildRing() *Ring {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ring == nil {
+		weights := make(map[int]int)
+		for id := range s.Addrs {
+			weights[id] = 1
+		}
+		s.ring = NewRing(weights, DefaultVirtualNodes)
 	}
-	return int(hash.Sum64() % uint64(s.Count))
+	return s.ring
 }
@@ -11,7 +11,8 @@ func TestParseShardConfig(t *testing.T) {
 	contents := `[[shard]]
                  name = "shard1"
                  address = "localhost:8080"
-				 shardId = 1`
+				 shardId = 1
+				 replicas = ["localhost:9080", "localhost:9081"]`
 	f, err := os.CreateTemp(os.TempDir(), "sharding.toml")
 	if err != nil {
 		t.Fatal(err)
@@ -37,4 +38,102 @@ func TestParseShardConfig(t *testing.T) {
 	c, err := config.ParseShardConfig(f.Name())
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(c.AvailableShard))
+	assert.Equal(t, []string{"localhost:9080", "localhost:9081"}, c.AvailableShard[0].Replicas)
+}
+
+func TestParseShardMetadata(t *testing.T) {
+	shards := []config.Shard{
+		{ShardId: 0, Name: "luffy", Address: "127.0.0.1:8080", Replicas: []string{"127.0.0.22:8080", "127.0.0.23:8080"}},
+		{ShardId: 1, Name: "zoro", Address: "127.0.0.1:8081"},
+	}
+	meta, err := config.ParseShardMetadata(shards, "luffy", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, meta.CurrentShard())
+	assert.Equal(t, "127.0.0.1:8081", meta.Addrs[1])
+	assert.True(t, meta.IsReplica(0, "127.0.0.23:8080"))
+	assert.False(t, meta.IsReplica(1, "127.0.0.23:8080"))
+
+	_, err = config.ParseShardMetadata(shards, "nami", 0)
+	assert.Error(t, err)
+}
+
+func TestSetLeader(t *testing.T) {
+	meta := &config.ShardMetadata{
+		Count:    1,
+		Addrs:    map[int]string{0: "a"},
+		Replicas: map[int][]string{0: {"b", "c"}},
+	}
+	assert.True(t, meta.SetLeader(0, "b", 2))
+	assert.Equal(t, "b", meta.Leader(0))
+	assert.Equal(t, []string{"a", "c"}, meta.ReplicasOf(0))
+
+	assert.False(t, meta.SetLeader(0, "c", 1), "announcement from an older term")
+	assert.Equal(t, "b", meta.Leader(0))
+	assert.Equal(t, []string{"b", "a", "c"}, meta.Members(0))
+}
+
+func TestUpdateShardMetadata(t *testing.T) {
+	shards := []config.Shard{
+		{ShardId: 0, Name: "luffy", Address: "a", Replicas: []string{"b", "c"}},
+		{ShardId: 1, Name: "zoro", Address: "d"},
+	}
+	meta, err := config.ParseShardMetadata(shards, "zoro", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), meta.Version())
+	assert.True(t, meta.SetLeader(0, "b", 2))
+
+	// shard 2 joins and zoro takes over the id 2, the leader elected for shard 0 keeps leading
+	next := config.ShardConfig{Version: 2, AvailableShard: []config.Shard{
+		{ShardId: 0, Name: "luffy", Address: "a", Replicas: []string{"b", "c"}},
+		{ShardId: 1, Name: "nami", Address: "e"},
+		{ShardId: 2, Name: "zoro", Address: "d"},
+	}}
+	applied, err := meta.Update(next)
+	assert.NoError(t, err)
+	assert.True(t, applied)
+	assert.Equal(t, uint64(2), meta.Version())
+	assert.Equal(t, 3, meta.ShardCount())
+	assert.Equal(t, 2, meta.CurrentShard())
+	assert.Equal(t, "e", meta.Leader(1))
+	assert.Equal(t, []string{"b", "a", "c"}, meta.Members(0))
+
+	applied, err = meta.Update(config.ShardConfig{Version: 2, AvailableShard: shards})
+	assert.NoError(t, err)
+	assert.False(t, applied, "same version")
+
+	_, err = meta.Update(config.ShardConfig{Version: 3, AvailableShard: shards[:1]})
+	assert.Error(t, err, "the local shard is missing")
+	assert.Equal(t, uint64(2), meta.Version())
+}
+
+func TestUpdateWhileInUse(t *testing.T) {
+	shards := []config.Shard{
+		{ShardId: 0, Name: "luffy", Address: "a"},
+		{ShardId: 1, Name: "zoro", Address: "b"},
+	}
+	meta, err := config.ParseShardMetadata(shards, "zoro", 0)
+	assert.NoError(t, err)
+
+	// the shard map is replaced while requests read it, run with -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for v := uint64(2); v < 100; v++ {
+			next := config.ShardConfig{Version: v, AvailableShard: []config.Shard{
+				{ShardId: 0, Name: "luffy", Address: "a"},
+				{ShardId: int(v%2) + 1, Name: "zoro", Address: "b"},
+			}}
+			_, err := meta.Update(next)
+			assert.NoError(t, err)
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		assert.Contains(t, []int{1, 2}, meta.CurrentShard())
+		assert.Equal(t, 2, meta.ShardCount())
+	}
 }
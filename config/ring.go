@@ -0,0 +1,76 @@
+package config
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points a shard of weight 1 owns on the hash ring
+const DefaultVirtualNodes = 128
+
+// Ring is a consistent hash ring. Every shard owns weight*virtualNodes points on the ring and a key
+// belongs to the shard owning the first point at or after the key's hash, so adding or removing a
+// shard only moves the keys between its points and their predecessors.
+type Ring struct {
+	points []uint64
+	owners map[uint64]int
+}
+
+// NewRing builds a ring from the weight of each shard id, weights below 1 count as 1
+func NewRing(weights map[int]int, virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	r := &Ring{owners: make(map[uint64]int)}
+
+	// iterate in id order so that colliding points are resolved the same way on every node
+	ids := make([]int, 0, len(weights))
+	for id := range weights {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		weight := weights[id]
+		if weight < 1 {
+			weight = 1
+		}
+		for i := 0; i < weight*virtualNodes; i++ {
+			point := hashKey(strconv.Itoa(id) + "#" + strconv.Itoa(i))
+			if _, ok := r.owners[point]; ok {
+				continue
+			}
+			r.owners[point] = id
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Get returns the shard id owning the key, or 0 when the ring is empty
+func (r *Ring) Get(key string) int {
+	if len(r.points) == 0 {
+		return 0
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// hashKey hashes with fnv and mixes the result, fnv alone places similar short strings close together
+func hashKey(key string) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(key))
+	h := hash.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
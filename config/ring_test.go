@@ -0,0 +1,63 @@
+package config_test
+
+import (
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const ringTestKeys = 30000
+
+func distribution(r *config.Ring) map[int]int {
+	counts := make(map[int]int)
+	for i := 0; i < ringTestKeys; i++ {
+		counts[r.Get(fmt.Sprintf("key-%d", i))]++
+	}
+	return counts
+}
+
+func TestRingBalance(t *testing.T) {
+	r := config.NewRing(map[int]int{0: 1, 1: 1, 2: 1}, config.DefaultVirtualNodes)
+	counts := distribution(r)
+	assert.Len(t, counts, 3)
+	for id, n := range counts {
+		assert.InDelta(t, ringTestKeys/3, n, ringTestKeys*0.05, "shard %d owns %d keys", id, n)
+	}
+}
+
+func TestRingWeights(t *testing.T) {
+	r := config.NewRing(map[int]int{0: 1, 1: 2, 2: 1}, config.DefaultVirtualNodes)
+	counts := distribution(r)
+	assert.InDelta(t, ringTestKeys/2, counts[1], ringTestKeys*0.05)
+	assert.InDelta(t, ringTestKeys/4, counts[0], ringTestKeys*0.05)
+	assert.InDelta(t, ringTestKeys/4, counts[2], ringTestKeys*0.05)
+}
+
+func TestRingMinimalMovement(t *testing.T) {
+	before := config.NewRing(map[int]int{0: 1, 1: 1, 2: 1}, config.DefaultVirtualNodes)
+	after := config.NewRing(map[int]int{0: 1, 1: 1, 2: 1, 3: 1}, config.DefaultVirtualNodes)
+
+	moved := 0
+	for i := 0; i < ringTestKeys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		from, to := before.Get(key), after.Get(key)
+		if from == to {
+			continue
+		}
+		moved++
+		assert.Equal(t, 3, to, "key %s moved between existing shards", key)
+	}
+	// growing to four shards moves roughly a quarter of the keys, modulo sharding moves three quarters
+	assert.InDelta(t, ringTestKeys/4, moved, ringTestKeys*0.05)
+}
+
+func TestRingIsDeterministic(t *testing.T) {
+	a := config.NewRing(map[int]int{0: 1, 1: 1}, 16)
+	b := config.NewRing(map[int]int{1: 1, 0: 1}, 16)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		assert.Equal(t, a.Get(key), b.Get(key))
+	}
+	assert.Equal(t, 0, config.NewRing(nil, 0).Get("key"))
+}
@@ -0,0 +1,459 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/auth"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/certs"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/config"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHeartbeatInterval is how often a leader tells its followers it is alive
+	DefaultHeartbeatInterval = 300 * time.Millisecond
+	// DefaultElectionTimeout is the minimum time without heartbeat before a follower runs for leader,
+	// the actual timeout is randomized between one and two times this value
+	DefaultElectionTimeout = 1500 * time.Millisecond
+	// announceEvery is the number of heartbeats between two announcements of the leader to the cluster
+	announceEvery = 30
+)
+
+// Role is the role of a node in its shard group
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// VoteRequest is sent by a candidate on /raft/vote
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	// LastTerm and LastSeq are the term and position of the last change log entry the candidate has,
+	// a node never votes for a candidate whose log is behind its own: ending in an earlier term, or in
+	// the same term with fewer entries
+	LastTerm uint64 `json:"lastTerm"`
+	LastSeq  uint64 `json:"lastSeq"`
+}
+
+// VoteResponse is the answer to a VoteRequest
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// Heartbeat is sent by the leader to the members of its shard on /raft/heartbeat
+type Heartbeat struct {
+	Term   uint64 `json:"term"`
+	Leader string `json:"leader"`
+}
+
+// HeartbeatResponse is the answer to a Heartbeat
+type HeartbeatResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+}
+
+// Announcement is sent by a new leader to every node of the cluster on /raft/leader so that they
+// route the requests of its shard to it
+type Announcement struct {
+	Shard  int    `json:"shard"`
+	Leader string `json:"leader"`
+	Term   uint64 `json:"term"`
+}
+
+// Node takes part in the leader election of its shard. The leader and the replicas of a shard form
+// the group; a majority of the group must be reachable to elect a leader, so a shard needs at least
+// two replicas to survive the loss of its leader. Changes are replicated asynchronously, writes that
+// no replica pulled before the leader died are not part of the new leader's history.
+type Node struct {
+	self  string
+	shard int
+	db    *db.KVDatabase
+	meta  *config.ShardMetadata
+
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration
+	// OnLeader is called when this node is elected leader, after its database was made writable
+	OnLeader func()
+	// OnFollower is called when this node follows a new leader, after its database was made read-only
+	OnFollower func(leader string)
+	// Credential authenticates the votes, heartbeats and announcements sent by this node
+	Credential *auth.Credential
+	// TLS sends them over mutual TLS with the certificates of the node
+	TLS *certs.Reloader
+
+	mu       sync.Mutex
+	role     Role
+	term     uint64
+	votedFor string
+	leader   string
+	deadline time.Time
+	// leaderSince is when this node was last elected, acks is when each peer last accepted one of its
+	// heartbeats since then
+	leaderSince time.Time
+	acks        map[string]time.Time
+
+	client *http.Client
+	scheme string
+}
+
+// NewNode creates the election node of self, a member of the given shard. The node starts as the
+// follower of the leader in the shard metadata, or campaigns right away if it is that leader.
+func NewNode(self string, shard int, kv *db.KVDatabase, meta *config.ShardMetadata) (*Node, error) {
+	term, votedFor, err := kv.ElectionState()
+	if err != nil {
+		return nil, fmt.Errorf("error loading election state: %w", err)
+	}
+	n := &Node{
+		self:              self,
+		shard:             shard,
+		db:                kv,
+		meta:              meta,
+		HeartbeatInterval: DefaultHeartbeatInterval,
+		ElectionTimeout:   DefaultElectionTimeout,
+		term:              term,
+		votedFor:          votedFor,
+		leader:            meta.Leader(shard),
+	}
+	return n, nil
+}
+
+// Role returns the current role and term of the node
+func (n *Node) Role() (Role, uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role, n.term
+}
+
+// Run drives the elections and heartbeats until done is closed
+func (n *Node) Run(done chan bool) {
+	n.client = &http.Client{Timeout: n.HeartbeatInterval}
+	n.scheme = "http"
+	if n.TLS != nil {
+		n.client.Transport = n.TLS.Transport()
+		n.scheme = "https"
+	}
+	if n.Credential != nil {
+		n.client.Transport = auth.NewTransport(n.client.Transport, n.Credential)
+	}
+
+	n.mu.Lock()
+	if n.leader == n.self {
+		// the configured leader does not wait for a timeout to claim its shard
+		n.deadline = time.Now()
+	} else {
+		n.resetDeadline()
+	}
+	n.mu.Unlock()
+
+	ticker := time.NewTicker(n.HeartbeatInterval / 3)
+	defer ticker.Stop()
+	var lastHeartbeat time.Time
+	heartbeats := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		role, term, expired := n.role, n.term, time.Now().After(n.deadline)
+		n.mu.Unlock()
+
+		switch {
+		case role == Leader && !n.hasQuorum(time.Now()):
+			// a leader cut off from its group steps down rather than accept writes that the
+			// leader elected by the majority does not see
+			log.Printf("shard %d: %s lost contact with a majority of its group", n.shard, n.self)
+			n.stepDown(term, "")
+		case role == Leader && time.Since(lastHeartbeat) >= n.HeartbeatInterval:
+			lastHeartbeat = time.Now()
+			n.sendHeartbeats(term)
+			if heartbeats%announceEvery == 0 {
+				go n.announce(term)
+			}
+			heartbeats++
+		case role != Leader && expired:
+			n.campaign()
+			heartbeats = 0
+		}
+	}
+}
+
+// resetDeadline schedules the next election at a random time, the caller holds n.mu
+func (n *Node) resetDeadline() {
+	timeout := n.ElectionTimeout + time.Duration(rand.Int63n(int64(n.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+func (n *Node) peers() []string {
+	var peers []string
+	for _, m := range n.meta.Members(n.shard) {
+		if m != n.self {
+			peers = append(peers, m)
+		}
+	}
+	return peers
+}
+
+func (n *Node) lastEntry() (seq, term uint64) {
+	seq, term, err := n.db.LastEntry()
+	if err != nil {
+		log.Println("error reading log position: ", err)
+	}
+	return seq, term
+}
+
+// upToDate reports whether the log of a candidate is at least as complete as the log of this node
+func (n *Node) upToDate(req *VoteRequest) bool {
+	seq, term := n.lastEntry()
+	return req.LastTerm > term || (req.LastTerm == term && req.LastSeq >= seq)
+}
+
+// campaign starts an election for the next term
+func (n *Node) campaign() {
+	n.mu.Lock()
+	n.role = Candidate
+	n.term++
+	n.votedFor = n.self
+	term := n.term
+	n.resetDeadline()
+	if err := n.db.SaveElectionState(term, n.self); err != nil {
+		log.Println("error saving election state: ", err)
+	}
+	n.mu.Unlock()
+
+	peers := n.peers()
+	log.Printf("shard %d: %s campaigning for term %d", n.shard, n.self, term)
+
+	req := &VoteRequest{Term: term, Candidate: n.self}
+	req.LastSeq, req.LastTerm = n.lastEntry()
+	votes := 1
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			var res VoteResponse
+			if err := n.post(peer, "/raft/vote", req, &res); err != nil {
+				return
+			}
+			if res.Term > term {
+				n.stepDown(res.Term, "")
+				return
+			}
+			if res.Granted {
+				mu.Lock()
+				votes++
+				mu.Unlock()
+			}
+		}(peer)
+	}
+	wg.Wait()
+
+	if votes <= (len(peers)+1)/2 {
+		log.Printf("shard %d: %s lost the election for term %d with %d votes", n.shard, n.self, term, votes)
+		return
+	}
+	n.becomeLeader(term)
+}
+
+func (n *Node) becomeLeader(term uint64) {
+	n.mu.Lock()
+	if n.role != Candidate || n.term != term {
+		n.mu.Unlock()
+		return
+	}
+	if err := n.db.Promote(term); err != nil {
+		n.mu.Unlock()
+		log.Println("error promoting the database: ", err)
+		return
+	}
+	n.role = Leader
+	n.leader = n.self
+	n.leaderSince = time.Now()
+	n.acks = make(map[string]time.Time)
+	n.mu.Unlock()
+
+	log.Printf("shard %d: %s elected leader for term %d", n.shard, n.self, term)
+	n.meta.SetLeader(n.shard, n.self, term)
+	if n.OnLeader != nil {
+		n.OnLeader()
+	}
+}
+
+// stepDown makes the node follow leader in the given term, leader may be empty if it is not known yet
+func (n *Node) stepDown(term uint64, leader string) {
+	n.mu.Lock()
+	if term < n.term {
+		n.mu.Unlock()
+		return
+	}
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		if err := n.db.SaveElectionState(term, ""); err != nil {
+			log.Println("error saving election state: ", err)
+		}
+	}
+	wasLeader := n.role == Leader
+	n.role = Follower
+	n.resetDeadline()
+	changed := leader != "" && leader != n.leader
+	if leader != "" {
+		n.leader = leader
+	}
+	n.mu.Unlock()
+
+	if wasLeader {
+		log.Printf("shard %d: %s stepping down in term %d", n.shard, n.self, term)
+		if err := n.db.SetReadOnly(true); err != nil {
+			log.Println("error demoting the database: ", err)
+		}
+	}
+	if changed {
+		log.Printf("shard %d: %s following %s in term %d", n.shard, n.self, leader, term)
+		n.meta.SetLeader(n.shard, leader, term)
+		if n.OnFollower != nil {
+			n.OnFollower(leader)
+		}
+	}
+}
+
+func (n *Node) sendHeartbeats(term uint64) {
+	req := &Heartbeat{Term: term, Leader: n.self}
+	for _, peer := range n.peers() {
+		go func(peer string) {
+			var res HeartbeatResponse
+			if err := n.post(peer, "/raft/heartbeat", req, &res); err != nil {
+				return
+			}
+			if res.Term > term {
+				n.stepDown(res.Term, "")
+				return
+			}
+			n.mu.Lock()
+			if res.Success && n.role == Leader && n.term == term {
+				n.acks[peer] = time.Now()
+			}
+			n.mu.Unlock()
+		}(peer)
+	}
+}
+
+// hasQuorum reports whether a majority of the group, counting this leader, accepted one of its
+// heartbeats within the last election timeout. A leader elected less than an election timeout ago has it.
+func (n *Node) hasQuorum(now time.Time) bool {
+	peers := n.peers()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if now.Sub(n.leaderSince) < n.ElectionTimeout {
+		return true
+	}
+	reached := 1
+	for _, peer := range peers {
+		if now.Sub(n.acks[peer]) < n.ElectionTimeout {
+			reached++
+		}
+	}
+	return reached > (len(peers)+1)/2
+}
+
+// announce tells every node of the cluster that this node leads its shard
+func (n *Node) announce(term uint64) {
+	a := &Announcement{Shard: n.shard, Leader: n.self, Term: term}
+	for _, addr := range n.meta.AllAddrs() {
+		if addr == n.self {
+			continue
+		}
+		if err := n.post(addr, "/raft/leader", a, nil); err != nil {
+			log.Printf("error announcing leader to %s: %v", addr, err)
+		}
+	}
+}
+
+func (n *Node) post(addr, path string, req, res interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.scheme+"://"+addr+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s%s returned %s", addr, path, resp.Status)
+	}
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+// VoteHandler answers the vote requests of candidates
+func (n *Node) VoteHandler(w http.ResponseWriter, r *http.Request) {
+	var req VoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	n.mu.Lock()
+	newer := req.Term > n.term
+	n.mu.Unlock()
+	if newer {
+		n.stepDown(req.Term, "")
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	res := &VoteResponse{Term: n.term}
+	if req.Term == n.term && (n.votedFor == "" || n.votedFor == req.Candidate) && n.upToDate(&req) {
+		n.votedFor = req.Candidate
+		if err := n.db.SaveElectionState(n.term, n.votedFor); err != nil {
+			log.Println("error saving election state: ", err)
+		} else {
+			res.Granted = true
+			n.resetDeadline()
+		}
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// HeartbeatHandler receives the heartbeats of the shard leader
+func (n *Node) HeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	var req Heartbeat
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	n.stepDown(req.Term, req.Leader)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	json.NewEncoder(w).Encode(&HeartbeatResponse{Term: n.term, Success: req.Term == n.term})
+}
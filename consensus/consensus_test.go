@@ -0,0 +1,188 @@
+package consensus_test
+
+import (
+	"encoding/json"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/config"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/consensus"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	node   *consensus.Node
+	db     *db.KVDatabase
+	meta   *config.ShardMetadata
+	server *httptest.Server
+	done   chan bool
+}
+
+func createTempDb(t *testing.T) *db.KVDatabase {
+	t.Helper()
+	f, err := os.CreateTemp(os.TempDir(), "kvdb-raft")
+	assert.NoError(t, err)
+
+	name := f.Name()
+	assert.NoError(t, f.Close())
+	t.Cleanup(func() {
+		assert.NoError(t, os.Remove(name))
+	})
+
+	kvdb, err := db.NewDatabase(name, true)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, kvdb.Close())
+	})
+	return kvdb
+}
+
+func startGroup(t *testing.T, size int) []*testNode {
+	nodes := make([]*testNode, size)
+	addrs := make([]string, size)
+	for i := range nodes {
+		server := httptest.NewUnstartedServer(nil)
+		nodes[i] = &testNode{server: server, db: createTempDb(t), done: make(chan bool)}
+		addrs[i] = server.Listener.Addr().String()
+	}
+
+	for i, n := range nodes {
+		n.meta = &config.ShardMetadata{
+			Count:    1,
+			Addrs:    map[int]string{0: addrs[0]},
+			Replicas: map[int][]string{0: append([]string(nil), addrs[1:]...)},
+		}
+		node, err := consensus.NewNode(addrs[i], 0, n.db, n.meta)
+		assert.NoError(t, err)
+		node.HeartbeatInterval = 30 * time.Millisecond
+		node.ElectionTimeout = 150 * time.Millisecond
+		n.node = node
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/raft/vote", node.VoteHandler)
+		mux.HandleFunc("/raft/heartbeat", node.HeartbeatHandler)
+		n.server.Config.Handler = mux
+		n.server.Start()
+		go node.Run(n.done)
+	}
+	t.Cleanup(func() {
+		for _, n := range nodes {
+			stop(n)
+		}
+	})
+	return nodes
+}
+
+func stop(n *testNode) {
+	select {
+	case <-n.done:
+	default:
+		close(n.done)
+		n.server.Close()
+	}
+}
+
+func leaders(nodes []*testNode) []*testNode {
+	var res []*testNode
+	for _, n := range nodes {
+		select {
+		case <-n.done:
+			continue
+		default:
+		}
+		if role, _ := n.node.Role(); role == consensus.Leader {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+func TestElectionAndFailover(t *testing.T) {
+	nodes := startGroup(t, 3)
+
+	// the configured leader claims the shard first
+	assert.Eventually(t, func() bool {
+		l := leaders(nodes)
+		return len(l) == 1 && l[0] == nodes[0]
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, nodes[0].db.ReadOnly())
+	assert.True(t, nodes[1].db.ReadOnly())
+	assert.True(t, nodes[2].db.ReadOnly())
+	_, firstTerm := nodes[0].node.Role()
+
+	stop(nodes[0])
+
+	var newLeader *testNode
+	assert.Eventually(t, func() bool {
+		l := leaders(nodes)
+		if len(l) != 1 {
+			return false
+		}
+		newLeader = l[0]
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, term := newLeader.node.Role()
+	assert.Greater(t, term, firstTerm)
+	assert.False(t, newLeader.db.ReadOnly())
+
+	follower := nodes[1]
+	if newLeader == nodes[1] {
+		follower = nodes[2]
+	}
+	assert.True(t, follower.db.ReadOnly())
+	assert.Eventually(t, func() bool {
+		return follower.meta.Leader(0) == newLeader.server.Listener.Addr().String()
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, newLeader.meta.ReplicasOf(0), nodes[0].server.Listener.Addr().String())
+}
+
+func TestLeaderStepsDownWithoutMajority(t *testing.T) {
+	nodes := startGroup(t, 3)
+	assert.Eventually(t, func() bool {
+		l := leaders(nodes)
+		return len(l) == 1 && l[0] == nodes[0]
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the leader keeps its role while a single follower is lost
+	stop(nodes[1])
+	time.Sleep(3 * nodes[0].node.ElectionTimeout)
+	role, _ := nodes[0].node.Role()
+	assert.Equal(t, consensus.Leader, role)
+
+	// and stops accepting writes once it no longer reaches a majority
+	stop(nodes[2])
+	assert.Eventually(t, func() bool {
+		role, _ := nodes[0].node.Role()
+		return role != consensus.Leader
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, nodes[0].db.ReadOnly())
+}
+
+func TestVoteRequiresUpToDateLog(t *testing.T) {
+	kvdb := createTempDb(t)
+	assert.NoError(t, kvdb.ApplyLog([]db.LogEntry{{Seq: 1, Term: 3, Op: db.OpSet, Key: "key", Value: db.Value{Data: []byte("value")}}}))
+	meta := &config.ShardMetadata{Count: 1, Addrs: map[int]string{0: "a"}, Replicas: map[int][]string{0: {"b", "c"}}}
+	node, err := consensus.NewNode("b", 0, kvdb, meta)
+	assert.NoError(t, err)
+
+	vote := func(body string) consensus.VoteResponse {
+		w := httptest.NewRecorder()
+		node.VoteHandler(w, httptest.NewRequest(http.MethodPost, "/raft/vote", strings.NewReader(body)))
+		var res consensus.VoteResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		return res
+	}
+
+	assert.False(t, vote(`{"term":4,"candidate":"c","lastTerm":3,"lastSeq":0}`).Granted)
+	// a longer log ending in an earlier term misses the entry of term 3
+	assert.False(t, vote(`{"term":5,"candidate":"c","lastTerm":2,"lastSeq":5}`).Granted)
+	assert.True(t, vote(`{"term":6,"candidate":"c","lastTerm":3,"lastSeq":1}`).Granted)
+	// only one vote per term
+	assert.False(t, vote(`{"term":6,"candidate":"a","lastTerm":4,"lastSeq":5}`).Granted)
+	assert.True(t, vote(`{"term":7,"candidate":"a","lastTerm":4,"lastSeq":0}`).Granted)
+}
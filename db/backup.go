@@ -0,0 +1,138 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"os"
+	"time"
+)
+
+// BackupInfo describes a snapshot of the database
+type BackupInfo struct {
+	// Seq is the position in the change log of the last change in the snapshot, a replica restored
+	// from it pulls the changes of its leader after it
+	Seq uint64 `json:"seq"`
+	// Size is the size of the snapshot in bytes
+	Size int64 `json:"size"`
+}
+
+// Snapshot is a consistent copy of the database at the time it was taken by Backup
+type Snapshot struct {
+	tx   *bolt.Tx
+	Info BackupInfo
+}
+
+// Backup takes a snapshot of the database, every namespace and its change log included. It holds a
+// read transaction, so writes go on while it is copied, but the pages they free are not reused and the
+// writes that grow the file wait until the snapshot is closed.
+func (db *KVDatabase) Backup() (*Snapshot, error) {
+	tx, err := db.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{tx: tx, Info: BackupInfo{Seq: backupSeq(tx), Size: tx.Size()}}, nil
+}
+
+// WriteTo writes the snapshot to w as a bolt file
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	return s.tx.WriteTo(w)
+}
+
+// Close releases the snapshot
+func (s *Snapshot) Close() error {
+	return s.tx.Rollback()
+}
+
+// backupSeq returns the position of the database in the change log: the last entry written on a
+// leader, the last entry of the leader applied on a replica
+func backupSeq(tx *bolt.Tx) uint64 {
+	seq := tx.Bucket([]byte(logBucket)).Sequence()
+	if applied := readSeq(tx, appliedSeqKey); applied > seq {
+		seq = applied
+	}
+	return seq
+}
+
+// Restore creates the database at dbLocation, which must not exist, from a snapshot written by
+// Backup, and returns the metadata of the snapshot. The position of the snapshot is recorded as the
+// applied position of the change log, so that a node started from it as a replica resumes pulling
+// the log of its leader after it instead of copying everything again. Encrypted values stay encrypted
+// with the keys of the node the snapshot was taken on.
+func Restore(backup, dbLocation string) (BackupInfo, error) {
+	if _, err := os.Stat(dbLocation); err == nil {
+		return BackupInfo{}, fmt.Errorf("%s already exists, move it away to restore over it", dbLocation)
+	} else if !os.IsNotExist(err) {
+		return BackupInfo{}, err
+	}
+
+	// the copy is moved into place once complete, an interrupted restore leaves no database behind
+	tmp := dbLocation + ".restoring"
+	if err := copyFile(backup, tmp); err != nil {
+		os.Remove(tmp)
+		return BackupInfo{}, err
+	}
+	info, err := recordRestore(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return BackupInfo{}, fmt.Errorf("invalid backup %s: %w", backup, err)
+	}
+	if err := os.Rename(tmp, dbLocation); err != nil {
+		os.Remove(tmp)
+		return BackupInfo{}, err
+	}
+	return info, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// recordRestore checks that the file is a database of this store, records its position as applied and
+// drops the state of the node the snapshot was taken on: the positions of its replicas, which the
+// database recreates empty, and its vote. The election term is kept, as terms only grow. The prepared
+// and coordinated transactions are replicated state of the shard and are kept, an unknown coordinated
+// transaction would be reported as aborted to shards that may have committed it.
+func recordRestore(file string) (BackupInfo, error) {
+	boltDb, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	defer boltDb.Close()
+	var info BackupInfo
+	err = boltDb.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{defaultBucket, logBucket, metaBucket} {
+			if tx.Bucket([]byte(bucket)) == nil {
+				return fmt.Errorf("bucket %s not found", bucket)
+			}
+		}
+		info = BackupInfo{Seq: backupSeq(tx), Size: tx.Size()}
+		if err := tx.DeleteBucket([]byte(acksBucket)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		meta := tx.Bucket([]byte(metaBucket))
+		if err := meta.Delete(votedForKey); err != nil {
+			return err
+		}
+		return meta.Put(appliedSeqKey, seqKey(info.Seq))
+	})
+	return info, err
+}
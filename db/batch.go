@@ -0,0 +1,91 @@
+package db
+
+import (
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// GetKeys returns the values of the keys that exist, read from a single snapshot
+func (db *KVDatabase) GetKeys(keys []string) (map[string]Value, error) {
+	values := make(map[string]Value, len(keys))
+	err := db.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		bucket := dataBucket(tx, db.ns)
+		for _, key := range keys {
+			v := bucket.Get([]byte(key))
+			if v == nil {
+				continue
+			}
+			value, err := db.decodeValue(v, dataPlace(db.ns, []byte(key)))
+			if err != nil {
+				return fmt.Errorf("error reading key %s: %w", key, err)
+			}
+			if !value.Expired(now) {
+				values[key] = value
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// SetKeys writes the pairs in a single transaction, either all of them are written or none, and
+// returns the version of each value
+func (db *KVDatabase) SetKeys(pairs []KeyValue) ([]uint64, error) {
+	if db.ReadOnly() {
+		return nil, fmt.Errorf("db is read only")
+	}
+	versions := make([]uint64, len(pairs))
+	err := db.update(func(tx *bolt.Tx) error {
+		for _, p := range pairs {
+			if err := checkLock(tx, db.ns, p.Key); err != nil {
+				return err
+			}
+		}
+		return withinQuota(tx, db.ns, func() error {
+			for i, p := range pairs {
+				seq, err := db.appendLog(tx, LogEntry{Op: OpSet, Namespace: db.ns, Key: p.Key, Value: p.Value})
+				if err != nil {
+					return err
+				}
+				p.Value.Version = seq
+				if err := db.putValue(tx, db.ns, []byte(p.Key), p.Value); err != nil {
+					return fmt.Errorf("error writing to bucket %s: %s", defaultBucket, err)
+				}
+				versions[i] = seq
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// DeleteKeys deletes the keys in a single transaction and records the deletions in the change log
+func (db *KVDatabase) DeleteKeys(keys []string) error {
+	if db.ReadOnly() {
+		return fmt.Errorf("db is read only")
+	}
+	return db.update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			if err := checkLock(tx, db.ns, key); err != nil {
+				return err
+			}
+		}
+		for _, key := range keys {
+			if err := deleteValue(tx, db.ns, []byte(key)); err != nil {
+				return fmt.Errorf("error deleting from bucket %s: %s", defaultBucket, err)
+			}
+			if _, err := db.appendLog(tx, LogEntry{Op: OpDelete, Namespace: db.ns, Key: key}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
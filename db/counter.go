@@ -0,0 +1,66 @@
+package db
+
+import (
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Increment atomically adds delta, which may be negative, to the integer stored as decimal text in the
+// key and returns the new value and its version. A missing key counts as 0.
+func (db *KVDatabase) Increment(key string, delta int64) (int64, uint64, error) {
+	return db.IncrementExpiring(key, delta, 0)
+}
+
+// IncrementExpiring is Increment for a counter that expires at expiresAt, in unix nanoseconds, when the
+// increment creates it. An existing counter keeps its expiry, so that a rate limit window is not extended
+// by every hit.
+func (db *KVDatabase) IncrementExpiring(key string, delta int64, expiresAt int64) (int64, uint64, error) {
+	if db.ReadOnly() {
+		return 0, 0, fmt.Errorf("db is read only")
+	}
+	var n int64
+	var version uint64
+	err := db.update(func(tx *bolt.Tx) error {
+		if err := checkLock(tx, db.ns, key); err != nil {
+			return err
+		}
+		value := Value{ExpiresAt: expiresAt}
+		if v := dataBucket(tx, db.ns).Get([]byte(key)); v != nil {
+			current, err := db.decodeValue(v, dataPlace(db.ns, []byte(key)))
+			if err != nil {
+				return fmt.Errorf("error reading key %s: %w", key, err)
+			}
+			if !current.Expired(time.Now()) {
+				if n, err = strconv.ParseInt(string(current.Data), 10, 64); err != nil {
+					return fmt.Errorf("%w: key %s", ErrNotNumeric, key)
+				}
+				value = current
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return fmt.Errorf("%w: key %s", ErrOverflow, key)
+		}
+		n += delta
+		value.Data = []byte(strconv.FormatInt(n, 10))
+
+		// the resulting value is logged, so that replicas store it rather than apply the increment again
+		return withinQuota(tx, db.ns, func() error {
+			var err error
+			if version, err = db.appendLog(tx, LogEntry{Op: OpSet, Namespace: db.ns, Key: key, Value: value}); err != nil {
+				return err
+			}
+			value.Version = version
+			if err := db.putValue(tx, db.ns, []byte(key), value); err != nil {
+				return fmt.Errorf("error writing to bucket %s: %s", defaultBucket, err)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, version, nil
+}
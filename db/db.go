@@ -1,45 +1,105 @@
 package db
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	bolt "go.etcd.io/bbolt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const defaultBucket = "kv"
-const replicaBucket = "replica"
+const logBucket = "log"
+const metaBucket = "meta"
+const acksBucket = "acks"
 
-// KVDatabase is the database struct
+var (
+	// ErrNotFound is returned when a key does not exist
+	ErrNotFound = errors.New("key not found")
+	// ErrExists is returned by a write conditioned on the key being absent when it exists
+	ErrExists = errors.New("key already exists")
+	// ErrVersionMismatch is returned by a write conditioned on a version the key does not have
+	ErrVersionMismatch = errors.New("version does not match")
+	// ErrValueMismatch is returned by a transaction conditioned on a value the key does not have
+	ErrValueMismatch = errors.New("value does not match")
+	// ErrNotNumeric is returned when incrementing a key whose value is not an integer
+	ErrNotNumeric = errors.New("value is not an integer")
+	// ErrOverflow is returned when an increment goes past the range of a 64-bit integer
+	ErrOverflow = errors.New("increment overflows a 64-bit integer")
+)
+
+// KVDatabase is the database struct, it reads and writes the keys of one namespace
 type KVDatabase struct {
+	*store
+	// ns is the namespace of the keys, "" for the default one
+	ns string
+}
+
+// store is the connection shared by the handles on the namespaces of a database
+type store struct {
 	db        *bolt.DB
 	closeFunc func() error
-	readOnly  bool
+	// readOnly is flipped when a replica is promoted to leader or a leader steps down
+	readOnly atomic.Bool
+	// changed is closed and replaced after every write, see Changes
+	mu      sync.Mutex
+	changed chan struct{}
+	// keys encrypts the values at rest, nil when they are stored in the clear
+	keys *Keyring
+	// term is the election term recorded in the log entries written by this node, see Promote
+	term atomic.Uint64
 }
 
 // NewDatabase creates a new database connection
-func NewDatabase(dbLocation string, readOnly bool) (*KVDatabase, error) {
+func NewDatabase(dbLocation string, readOnly bool, opts ...Option) (*KVDatabase, error) {
 	db, err := bolt.Open(dbLocation, 0600, nil)
 	if err != nil {
 		return nil, err
 	}
-	boltDb := &KVDatabase{db: db, closeFunc: db.Close, readOnly: readOnly}
+	boltDb := &KVDatabase{store: &store{db: db, closeFunc: db.Close, changed: make(chan struct{})}}
+	for _, opt := range opts {
+		opt(boltDb.store)
+	}
 
 	if err := boltDb.createBuckets(); err != nil {
 		_ = boltDb.Close()
 		return nil, err
 	}
+	// the node may have changed role since the file was last open, line the log up with the requested one
+	boltDb.readOnly.Store(!readOnly)
+	if err := boltDb.SetReadOnly(readOnly); err != nil {
+		_ = boltDb.Close()
+		return nil, err
+	}
 	return boltDb, nil
 }
 
 func (db *KVDatabase) createBuckets() error {
-	return db.db.Update(func(tx *bolt.Tx) error {
-
+	return db.update(func(tx *bolt.Tx) error {
+		fresh := tx.Bucket([]byte(defaultBucket)) == nil
 		if _, err := tx.CreateBucketIfNotExists([]byte(defaultBucket)); err != nil {
 			return fmt.Errorf("error creating bucket %s: %s", defaultBucket, err)
 		}
-		if _, err := tx.CreateBucketIfNotExists([]byte(replicaBucket)); err != nil {
-			return fmt.Errorf("error creating bucket %s: %s", replicaBucket, err)
+		if _, err := tx.CreateBucketIfNotExists([]byte(logBucket)); err != nil {
+			return fmt.Errorf("error creating bucket %s: %s", logBucket, err)
 		}
-		return nil
+		if _, err := tx.CreateBucketIfNotExists([]byte(metaBucket)); err != nil {
+			return fmt.Errorf("error creating bucket %s: %s", metaBucket, err)
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(acksBucket)); err != nil {
+			return fmt.Errorf("error creating bucket %s: %s", acksBucket, err)
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(expiryBucket)); err != nil {
+			return fmt.Errorf("error creating bucket %s: %s", expiryBucket, err)
+		}
+		for _, name := range []string{preparedBucket, locksBucket, txnsBucket, resolvedBucket, namespacesBucket, resyncBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("error creating bucket %s: %s", name, err)
+			}
+		}
+		return db.migrate(tx, fresh)
 	})
 }
 
@@ -49,37 +109,180 @@ func (db *KVDatabase) Close() error {
 	return db.closeFunc()
 }
 
+// ReadOnly reports whether the database is a read-only replica
+func (db *KVDatabase) ReadOnly() bool {
+	return db.readOnly.Load()
+}
+
+// SetReadOnly promotes a replica to a writable leader or demotes a leader to a read-only replica.
+// A promoted replica continues the log numbering from the last entry it applied. A demoted leader
+// keeps its log as it is, the replication compares it with the log of the new leader and rolls back
+// the entries the new leader does not have.
+func (db *KVDatabase) SetReadOnly(readOnly bool) error {
+	if db.readOnly.Load() == readOnly {
+		return nil
+	}
+	if !readOnly {
+		err := db.update(func(tx *bolt.Tx) error {
+			logs := tx.Bucket([]byte(logBucket))
+			if applied := readSeq(tx, appliedSeqKey); applied > logs.Sequence() {
+				return logs.SetSequence(applied)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	db.readOnly.Store(readOnly)
+	return nil
+}
+
+// Promote makes the node a writable leader elected in term, the entries it writes record that term
+func (db *KVDatabase) Promote(term uint64) error {
+	db.term.Store(term)
+	return db.SetReadOnly(false)
+}
+
+// Condition restricts a write to a state of the key, the zero Condition always matches
+type Condition struct {
+	// IfAbsent only writes when the key does not exist
+	IfAbsent bool
+	// IfVersion only writes when the key exists with this version, 0 matches any version
+	IfVersion uint64
+}
+
+// check returns ErrExists or ErrVersionMismatch when the current state of the key does not match
+func (c Condition) check(h header, exists bool) error {
+	if c.IfAbsent && exists {
+		return ErrExists
+	}
+	if c.IfVersion != 0 && (!exists || h.version != c.IfVersion) {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
 // SetKey sets the key value pair in the database
-func (db *KVDatabase) SetKey(key, value string) error {
-	if db.readOnly {
-		return fmt.Errorf("db is read only")
+func (db *KVDatabase) SetKey(key string, value Value) error {
+	_, err := db.SetKeyIf(key, value, Condition{})
+	return err
+}
+
+// SetKeyIf sets the key value pair if the key matches the condition and returns the version of the
+// new value. The check and the write happen in the same transaction.
+func (db *KVDatabase) SetKeyIf(key string, value Value, cond Condition) (uint64, error) {
+	if db.ReadOnly() {
+		return 0, fmt.Errorf("db is read only")
 	}
-	return db.db.Update(func(tx *bolt.Tx) error {
-		if err := tx.Bucket([]byte(defaultBucket)).Put([]byte(key), []byte(value)); err != nil {
-			return fmt.Errorf("error writing to bucket %s: %s", defaultBucket, err)
+	var version uint64
+	err := db.update(func(tx *bolt.Tx) error {
+		if err := checkLock(tx, db.ns, key); err != nil {
+			return err
 		}
-		return tx.Bucket([]byte(replicaBucket)).Put([]byte(key), []byte(value))
+		h, exists, err := currentHeader(tx, db.ns, []byte(key), time.Now())
+		if err != nil {
+			return err
+		}
+		if err := cond.check(h, exists); err != nil {
+			return err
+		}
+		return withinQuota(tx, db.ns, func() error {
+			var err error
+			if version, err = db.appendLog(tx, LogEntry{Op: OpSet, Namespace: db.ns, Key: key, Value: value}); err != nil {
+				return err
+			}
+			value.Version = version
+			if err := db.putValue(tx, db.ns, []byte(key), value); err != nil {
+				return fmt.Errorf("error writing to bucket %s: %s", defaultBucket, err)
+			}
+			return nil
+		})
 	})
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
 }
 
-// GetKey gets the value for the given key
-func (db *KVDatabase) GetKey(key string) (string, error) {
-	var value string
-	err := db.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(defaultBucket))
-		if bucket == nil {
-			return fmt.Errorf("bucket %s not found", defaultBucket)
+// DeleteKey deletes the key from the database and records the deletion in the change log
+func (db *KVDatabase) DeleteKey(key string) error {
+	return db.DeleteKeyIf(key, Condition{})
+}
+
+// DeleteKeyIf deletes the key if it matches the condition and records the deletion in the change log
+func (db *KVDatabase) DeleteKeyIf(key string, cond Condition) error {
+	if db.ReadOnly() {
+		return fmt.Errorf("db is read only")
+	}
+	return db.update(func(tx *bolt.Tx) error {
+		if err := checkLock(tx, db.ns, key); err != nil {
+			return err
+		}
+		h, exists, err := currentHeader(tx, db.ns, []byte(key), time.Now())
+		if err != nil {
+			return err
+		}
+		if err := cond.check(h, exists); err != nil {
+			return err
 		}
-		val := copySlice(bucket.Get([]byte(key)))
-		value = string(val)
+		if err := deleteValue(tx, db.ns, []byte(key)); err != nil {
+			return fmt.Errorf("error deleting from bucket %s: %s", defaultBucket, err)
+		}
+		_, err = db.appendLog(tx, LogEntry{Op: OpDelete, Namespace: db.ns, Key: key})
+		return err
+	})
+}
+
+// currentHeader returns the metadata of the value of the key and whether it exists, expired values do not
+func currentHeader(tx *bolt.Tx, ns string, key []byte, now time.Time) (header, bool, error) {
+	v := dataBucket(tx, ns).Get(key)
+	if v == nil {
+		return header{}, false, nil
+	}
+	h, _, err := decodeHeader(v)
+	if err != nil {
+		return header{}, false, fmt.Errorf("error reading key %s: %w", key, err)
+	}
+	return h, !h.expired(now), nil
+}
+
+// GetKey gets the value for the given key, ErrNotFound is returned if it does not exist or has expired
+func (db *KVDatabase) GetKey(key string) (Value, error) {
+	var value Value
+	err := db.ReadKey(key, func(v Value) error {
+		value = v
+		value.Data = copySlice(v.Data)
 		return nil
 	})
 	if err != nil {
-		return "", err
+		return Value{}, err
 	}
 	return value, nil
 }
 
+// ReadKey calls read with the value of the key in a read transaction, ErrNotFound is returned if it
+// does not exist or has expired. The data of a value stored in the clear is the memory of the database
+// itself, so that a large value is written out without being copied: it is only valid until read
+// returns and must not be modified. Writes that grow the file wait for read to return.
+func (db *KVDatabase) ReadKey(key string, read func(Value) error) error {
+	return db.db.View(func(tx *bolt.Tx) error {
+		val := dataBucket(tx, db.ns).Get([]byte(key))
+		if val == nil {
+			return ErrNotFound
+		}
+		value, err := db.viewValue(val, dataPlace(db.ns, []byte(key)))
+		if err != nil {
+			return fmt.Errorf("error reading key %s: %w", key, err)
+		}
+		if value.Expired(time.Now()) {
+			// the sweeper has not deleted it yet
+			return ErrNotFound
+		}
+		return read(value)
+	})
+}
+
 func copySlice(s []byte) []byte {
 	if s == nil {
 		return nil
@@ -89,40 +292,128 @@ func copySlice(s []byte) []byte {
 	return b
 }
 
-// GetKeysForReplication gets the key value pair for replication
-func (d *KVDatabase) GetKeysForReplication() (key, value []byte, err error) {
-	err = d.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(replicaBucket))
-		k, v := bucket.Cursor().First()
-		key = copySlice(k)
-		value = copySlice(v)
+// KeyValue is a key and its value
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value Value  `json:"value"`
+}
+
+// ReadKeys returns up to limit key value pairs whose key sorts after the given key, in key order
+func (db *KVDatabase) ReadKeys(after string, limit int) ([]KeyValue, error) {
+	var pairs []KeyValue
+	err := db.db.View(func(tx *bolt.Tx) error {
+		c := dataBucket(tx, db.ns).Cursor()
+		k, v := c.Seek([]byte(after))
+		if k != nil && after != "" && string(k) == after {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(pairs) < limit; k, v = c.Next() {
+			value, err := db.decodeValue(v, dataPlace(db.ns, k))
+			if err != nil {
+				return fmt.Errorf("error reading key %s: %w", k, err)
+			}
+			pairs = append(pairs, KeyValue{Key: string(k), Value: value})
+		}
 		return nil
 	})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return key, value, nil
+	return pairs, nil
 }
 
-// DeleteReplicaKey deletes the key value pair from the database
-func (d *KVDatabase) DeleteReplicaKey(key, value string) error {
-	return d.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(replicaBucket))
-		v := bucket.Get([]byte(key))
-		if v == nil {
-			return fmt.Errorf("key %s not found", key)
+// ImportKeys writes the pairs whose key does not exist yet, or has expired, in a single transaction,
+// and returns the keys the database now holds. Existing keys are kept and returned: they hold the pair
+// from an earlier attempt, or a value written since the pair was read elsewhere, as a key is only
+// written on the shard that owns it. The pairs that expired are neither written nor returned, and the
+// keys held by a prepared transaction are returned apart as locked.
+func (db *KVDatabase) ImportKeys(pairs []KeyValue) (stored, locked []string, err error) {
+	if db.ReadOnly() {
+		return nil, nil, fmt.Errorf("db is read only")
+	}
+	err = db.update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		for _, p := range pairs {
+			if p.Value.Expired(now) {
+				continue
+			}
+			if checkLock(tx, db.ns, p.Key) != nil {
+				locked = append(locked, p.Key)
+				continue
+			}
+			_, exists, err := currentHeader(tx, db.ns, []byte(p.Key), now)
+			if err != nil {
+				return fmt.Errorf("error reading key %s: %w", p.Key, err)
+			}
+			if !exists {
+				seq, err := db.appendLog(tx, LogEntry{Op: OpSet, Namespace: db.ns, Key: p.Key, Value: p.Value})
+				if err != nil {
+					return err
+				}
+				p.Value.Version = seq
+				if err := db.putValue(tx, db.ns, []byte(p.Key), p.Value); err != nil {
+					return fmt.Errorf("error writing to bucket %s: %s", defaultBucket, err)
+				}
+			}
+			stored = append(stored, p.Key)
 		}
-		if string(v) != value {
-			return fmt.Errorf("value mismatch for key %s", key)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return stored, locked, nil
+}
+
+// DeleteKeysIfUnchanged deletes the pairs whose value is still the given one and that no prepared
+// transaction holds, in a single transaction, and returns the number of keys deleted
+func (db *KVDatabase) DeleteKeysIfUnchanged(pairs []KeyValue) (int, error) {
+	if db.ReadOnly() {
+		return 0, fmt.Errorf("db is read only")
+	}
+	deleted := 0
+	err := db.update(func(tx *bolt.Tx) error {
+		bucket := dataBucket(tx, db.ns)
+		for _, p := range pairs {
+			v := bucket.Get([]byte(p.Key))
+			if v == nil || checkLock(tx, db.ns, p.Key) != nil {
+				continue
+			}
+			// encrypted values differ on every write, compare them in the clear
+			current, err := db.decodeValue(v, dataPlace(db.ns, []byte(p.Key)))
+			if err != nil {
+				return fmt.Errorf("error reading key %s: %w", p.Key, err)
+			}
+			if !bytes.Equal(encodePlainValue(current), encodePlainValue(p.Value)) {
+				continue
+			}
+			if err := deleteValue(tx, db.ns, []byte(p.Key)); err != nil {
+				return fmt.Errorf("error deleting from bucket %s: %s", defaultBucket, err)
+			}
+			if _, err := db.appendLog(tx, LogEntry{Op: OpDelete, Namespace: db.ns, Key: p.Key}); err != nil {
+				return err
+			}
+			deleted++
 		}
-		return bucket.Delete([]byte(key))
+		return nil
 	})
+	return deleted, err
 }
 
-// SetKeyOnReplica sets the key value pair in the database
-func (db *KVDatabase) SetKeyOnReplica(key, value string) error {
-	return db.db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket([]byte(defaultBucket)).Put([]byte(key), []byte(value))
+// GetMeta returns the value stored under name in the metadata bucket, nil if there is none
+func (db *KVDatabase) GetMeta(name string) ([]byte, error) {
+	var value []byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		value = copySlice(tx.Bucket([]byte(metaBucket)).Get([]byte(name)))
+		return nil
+	})
+	return value, err
+}
+
+// SetMeta stores value under name in the metadata bucket, it is not replicated
+func (db *KVDatabase) SetMeta(name string, value []byte) error {
+	return db.update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(metaBucket)).Put([]byte(name), value)
 	})
 }
 
@@ -130,11 +421,7 @@ func (db *KVDatabase) SetKeyOnReplica(key, value string) error {
 func (db *KVDatabase) DeleteUnwantedKeys(shouldDelete func(key string) bool) error {
 	var keysToDelete []string
 	err := db.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(defaultBucket))
-		if bucket == nil {
-			return fmt.Errorf("bucket %s not found", defaultBucket)
-		}
-		return bucket.ForEach(func(k, v []byte) error {
+		return dataBucket(tx, db.ns).ForEach(func(k, v []byte) error {
 			if shouldDelete(string(k)) {
 				keysToDelete = append(keysToDelete, string(k))
 			}
@@ -145,13 +432,15 @@ func (db *KVDatabase) DeleteUnwantedKeys(shouldDelete func(key string) bool) err
 		return err
 	}
 
-	err = db.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(defaultBucket))
-		if bucket == nil {
-			return fmt.Errorf("bucket %s not found", defaultBucket)
-		}
+	err = db.update(func(tx *bolt.Tx) error {
 		for _, key := range keysToDelete {
-			if err := bucket.Delete([]byte(key)); err != nil {
+			if err := deleteValue(tx, db.ns, []byte(key)); err != nil {
+				return err
+			}
+			if db.ReadOnly() {
+				continue
+			}
+			if _, err := db.appendLog(tx, LogEntry{Op: OpDelete, Namespace: db.ns, Key: key}); err != nil {
 				return err
 			}
 		}
@@ -1,11 +1,18 @@
 package db_test
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func createTempDb(t *testing.T, readOnly bool) *db.KVDatabase {
@@ -30,51 +37,227 @@ func createTempDb(t *testing.T, readOnly bool) *db.KVDatabase {
 
 func TestGetSet(t *testing.T) {
 	kvdb := createTempDb(t, false)
-	err := kvdb.SetKey("key", "value")
+	err := kvdb.SetKey("key", db.Value{Data: []byte("value")})
 	assert.NoError(t, err)
 	value, err := kvdb.GetKey("key")
 	assert.NoError(t, err)
-	assert.Equal(t, "value", value)
+	assert.Equal(t, db.Value{Data: []byte("value"), Version: 1}, value)
+	_, err = kvdb.GetKey("missing")
+	assert.ErrorIs(t, err, db.ErrNotFound)
 
-	k, v, err := kvdb.GetKeysForReplication()
+	entries, err := kvdb.ReadLog(1, 10)
 	assert.NoError(t, err)
-	assert.Equal(t, "key", string(k))
-	assert.Equal(t, "value", string(v))
+	assert.Equal(t, []db.LogEntry{{Seq: 1, Op: db.OpSet, Key: "key", Value: db.Value{Data: []byte("value")}}}, entries)
+
+	// values are binary safe and keep their content type
+	blob := db.Value{Data: []byte{0, 0xff, '&', '=', 0}, ContentType: "application/octet-stream"}
+	assert.NoError(t, kvdb.SetKey("blob", blob))
+	value, err = kvdb.GetKey("blob")
+	assert.NoError(t, err)
+	assert.Equal(t, blob.Data, value.Data)
+	assert.Equal(t, blob.ContentType, value.ContentType)
+	entries, err = kvdb.ReadLog(2, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []db.LogEntry{{Seq: 2, Op: db.OpSet, Key: "blob", Value: blob}}, entries)
 }
 
-func TestDeleteReplicationKey(t *testing.T) {
+func TestDeleteKey(t *testing.T) {
 	kvdb := createTempDb(t, false)
 	setKey(t, kvdb, "key", "value")
+	assert.NoError(t, kvdb.DeleteKey("key"))
+	assert.Equal(t, "", getKey(t, kvdb, "key"))
 
-	k, v, err := kvdb.GetKeysForReplication()
+	entries, err := kvdb.ReadLog(2, 10)
 	assert.NoError(t, err)
-	assert.Equal(t, "key", string(k))
-	assert.Equal(t, "value", string(v))
+	assert.Equal(t, []db.LogEntry{{Seq: 2, Op: db.OpDelete, Key: "key"}}, entries)
+}
 
-	if err := kvdb.DeleteReplicaKey("key", "value1"); err == nil {
-		t.Fatal("key value pair should not exist and hence should throw error")
-	}
-	if err := kvdb.DeleteReplicaKey("key", "value"); err != nil {
-		t.Fatal(err)
+func TestChangeLog(t *testing.T) {
+	kvdb := createTempDb(t, false)
+	setKey(t, kvdb, "key2", "value1")
+	setKey(t, kvdb, "key1", "value1")
+	setKey(t, kvdb, "key2", "value2")
+	assert.NoError(t, kvdb.DeleteKey("key1"))
+
+	// rapid writes to the same key are kept and the order across keys is preserved
+	entries, err := kvdb.ReadLog(1, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []db.LogEntry{
+		{Seq: 1, Op: db.OpSet, Key: "key2", Value: db.Value{Data: []byte("value1")}},
+		{Seq: 2, Op: db.OpSet, Key: "key1", Value: db.Value{Data: []byte("value1")}},
+		{Seq: 3, Op: db.OpSet, Key: "key2", Value: db.Value{Data: []byte("value2")}},
+		{Seq: 4, Op: db.OpDelete, Key: "key1"},
+	}, entries)
+
+	assert.NoError(t, kvdb.TruncateLog(2))
+	first, last, err := kvdb.LogPosition()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), first)
+	assert.Equal(t, uint64(4), last)
+
+	rest, err := kvdb.ReadLog(1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, entries[2:3], rest)
+
+	replica := createTempDb(t, false)
+	assert.NoError(t, replica.ApplyLog(entries[:2]))
+	assert.NoError(t, replica.ApplyLog(entries[1:]))
+	assert.Equal(t, "", getKey(t, replica, "key1"))
+	assert.Equal(t, "value2", getKey(t, replica, "key2"))
+
+	applied, err := replica.AppliedSeq()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), applied)
+
+	assert.Error(t, replica.ApplyLog([]db.LogEntry{{Seq: 6, Op: db.OpSet, Key: "key3", Value: db.Value{Data: []byte("value3")}}}))
+}
+
+func TestAckReplica(t *testing.T) {
+	kvdb := createTempDb(t, false)
+	for i := 0; i < 5; i++ {
+		setKey(t, kvdb, "key", "value")
 	}
-	k, v, err = kvdb.GetKeysForReplication()
+	replicas := []string{"replica-1", "replica-2"}
+
+	upto, err := kvdb.AckReplica("replica-1", 4, replicas)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), upto, "replica-2 has not acknowledged anything yet")
+
+	upto, err = kvdb.AckReplica("replica-2", 2, replicas)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), upto)
+
+	// a stale acknowledgement does not move the replica backwards
+	upto, err = kvdb.AckReplica("replica-1", 1, replicas)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), upto)
+
+	first, _, err := kvdb.LogPosition()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), first)
+
+	acks, err := kvdb.ReplicaAcks()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"replica-1": 4, "replica-2": 2}, acks)
+}
+
+func TestPromoteReplica(t *testing.T) {
+	kvdb := createTempDb(t, false)
+	assert.NoError(t, kvdb.SetReadOnly(true))
+	assert.Error(t, kvdb.SetKey("key", db.Value{Data: []byte("value")}))
+
+	assert.NoError(t, kvdb.ApplyLog([]db.LogEntry{
+		{Seq: 1, Op: db.OpSet, Key: "key1", Value: db.Value{Data: []byte("value1")}},
+		{Seq: 2, Op: db.OpSet, Key: "key2", Value: db.Value{Data: []byte("value2")}},
+	}))
+
+	// once promoted, the replica continues the leader's numbering in its own term
+	assert.NoError(t, kvdb.Promote(2))
+	setKey(t, kvdb, "key3", "value3")
+	entries, err := kvdb.ReadLog(1, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 3}, []uint64{entries[0].Seq, entries[1].Seq, entries[2].Seq})
+	assert.Equal(t, []uint64{0, 0, 2}, []uint64{entries[0].Term, entries[1].Term, entries[2].Term})
+
+	// its own writes stay in the log when it steps down, the next leader decides whether they are kept
+	assert.NoError(t, kvdb.SetReadOnly(true))
+	seq, term, err := kvdb.LastEntry()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3, 2}, []uint64{seq, term})
+	applied, err := kvdb.AppliedSeq()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), applied)
+}
+
+func TestRollbackLog(t *testing.T) {
+	kvdb := createTempDb(t, false)
+	assert.NoError(t, kvdb.Promote(1))
+	setKey(t, kvdb, "key1", "value1")
+	setKey(t, kvdb, "key2", "value2")
+	assert.NoError(t, kvdb.Promote(2))
+	setKey(t, kvdb, "key1", "lost")
+	_, err := kvdb.CreateNamespace("ns", 0, 0)
 	assert.NoError(t, err)
-	if k != nil || v != nil {
-		t.Fatal("key value pair should be deleted")
+	ns, err := kvdb.Namespace("ns")
+	assert.NoError(t, err)
+	assert.NoError(t, ns.SetKey("key3", db.Value{Data: []byte("lost")}))
+	assert.NoError(t, kvdb.Prepare(db.PreparedTxn{ID: "lost", Ops: []db.TxnOp{{Key: "key2", Delete: true}}}))
+	assert.NoError(t, kvdb.SetReadOnly(true))
+
+	// the terms only grow along the log
+	for _, c := range []struct{ upto, maxTerm, seq uint64 }{{5, 2, 5}, {5, 1, 2}, {1, 1, 1}, {5, 0, 0}, {9, 1, 2}} {
+		seq, err := kvdb.LastSeqOfTerm(c.upto, c.maxTerm)
+		assert.NoError(t, err)
+		assert.Equal(t, c.seq, seq, "up to %d in term %d", c.upto, c.maxTerm)
 	}
+
+	removed, err := kvdb.RollbackLog(2)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, removed)
+	seq, term, err := kvdb.LastEntry()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2, 1}, []uint64{seq, term})
+	applied, err := kvdb.AppliedSeq()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), applied)
+
+	// the keys of the removed entries keep their values until they are copied from the leader
+	refs, err := kvdb.ResyncKeys(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []db.KeyRef{{Key: "key1"}, {Namespace: "ns", Key: "key3"}}, refs)
+	assert.NoError(t, kvdb.Resync([]db.KeyState{
+		{KeyRef: refs[0], Value: &db.Value{Data: []byte("value1"), Version: 1}},
+		{KeyRef: refs[1]},
+	}))
+	assert.Equal(t, "value1", getKey(t, kvdb, "key1"))
+	_, err = ns.GetKey("key3")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	refs, err = kvdb.ResyncKeys(10)
+	assert.NoError(t, err)
+	assert.Empty(t, refs)
+	// and the transactions are replaced with the ones of the leader
+	pending, err := kvdb.TxnsToResync()
+	assert.NoError(t, err)
+	assert.True(t, pending)
+	assert.NoError(t, kvdb.ResyncTxns(nil, []db.CoordinatedTxn{{ID: "kept", State: db.TxnCommitted}}))
+	prepared, err := kvdb.PreparedTxns()
+	assert.NoError(t, err)
+	assert.Empty(t, prepared)
+	coordinated, err := kvdb.CoordinatedTxns()
+	assert.NoError(t, err)
+	assert.Equal(t, []db.CoordinatedTxn{{ID: "kept", State: db.TxnCommitted}}, coordinated)
+	pending, err = kvdb.TxnsToResync()
+	assert.NoError(t, err)
+	assert.False(t, pending)
+
+	// the entries of the new leader follow the kept ones
+	assert.NoError(t, kvdb.ApplyLog([]db.LogEntry{{Seq: 3, Term: 3, Op: db.OpSet, Key: "key2", Value: db.Value{Data: []byte("new")}}}))
+	assert.Equal(t, "new", getKey(t, kvdb, "key2"))
+
+	// truncated entries can not be rolled back
+	assert.NoError(t, kvdb.TruncateLog(2))
+	term, ok, err := kvdb.TermAt(2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), term)
+	_, err = kvdb.RollbackLog(1)
+	assert.Error(t, err)
 }
 
 func setKey(t *testing.T, kvdb *db.KVDatabase, key, value string) {
 	t.Helper()
-	err := kvdb.SetKey(key, value)
+	err := kvdb.SetKey(key, db.Value{Data: []byte(value)})
 	assert.NoError(t, err)
 }
 
 func getKey(t *testing.T, kvdb *db.KVDatabase, key string) string {
 	t.Helper()
 	value, err := kvdb.GetKey(key)
+	if errors.Is(err, db.ErrNotFound) {
+		return ""
+	}
 	assert.NoError(t, err)
-	return value
+	return string(value.Data)
 }
 
 func TestDeleteUnwantedKeys(t *testing.T) {
@@ -107,3 +290,758 @@ func TestDeleteUnwantedKeys(t *testing.T) {
 	assert.Equal(t, "", getKey(t, kvdb, "key1"))
 	assert.Equal(t, "value2", getKey(t, kvdb, "key2"))
 }
+
+func TestExpiry(t *testing.T) {
+	kvdb := createTempDb(t, false)
+	now := time.Now()
+	past := db.Value{Data: []byte("value"), ExpiresAt: now.Add(-time.Second).UnixNano()}
+	future := db.Value{Data: []byte("value"), ExpiresAt: now.Add(time.Hour).UnixNano()}
+	for i := 0; i < 3; i++ {
+		setKeyValue(t, kvdb, fmt.Sprintf("expired-%d", i), past)
+	}
+	setKeyValue(t, kvdb, "later", future)
+	setKeyValue(t, kvdb, "renewed", past)
+	setKey(t, kvdb, "renewed", "value")
+
+	_, err := kvdb.GetKey("expired-0")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	value, err := kvdb.GetKey("later")
+	assert.NoError(t, err)
+	assert.Equal(t, future.ExpiresAt, value.ExpiresAt)
+
+	// the sweeper deletes in bounded batches and logs the deletions for the replicas
+	n, err := kvdb.ExpireKeys(now, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = kvdb.ExpireKeys(now, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = kvdb.ExpireKeys(now, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, "value", getKey(t, kvdb, "renewed"))
+
+	entries, err := kvdb.ReadLog(7, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	for _, e := range entries {
+		assert.Equal(t, db.OpDelete, e.Op)
+	}
+
+	n, err = kvdb.ExpireKeys(now.Add(2*time.Hour), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "", getKey(t, kvdb, "later"))
+}
+
+func setKeyValue(t *testing.T, kvdb *db.KVDatabase, key string, value db.Value) {
+	t.Helper()
+	assert.NoError(t, kvdb.SetKey(key, value))
+}
+
+func TestConditionalWrites(t *testing.T) {
+	kvdb := createTempDb(t, false)
+	v1, err := kvdb.SetKeyIf("key", db.Value{Data: []byte("first")}, db.Condition{IfAbsent: true})
+	assert.NoError(t, err)
+	_, err = kvdb.SetKeyIf("key", db.Value{Data: []byte("second")}, db.Condition{IfAbsent: true})
+	assert.ErrorIs(t, err, db.ErrExists)
+
+	v2, err := kvdb.SetKeyIf("key", db.Value{Data: []byte("second")}, db.Condition{IfVersion: v1})
+	assert.NoError(t, err)
+	assert.Greater(t, v2, v1)
+	_, err = kvdb.SetKeyIf("key", db.Value{Data: []byte("third")}, db.Condition{IfVersion: v1})
+	assert.ErrorIs(t, err, db.ErrVersionMismatch)
+	assert.Equal(t, "second", getKey(t, kvdb, "key"))
+
+	assert.ErrorIs(t, kvdb.DeleteKeyIf("key", db.Condition{IfVersion: v1}), db.ErrVersionMismatch)
+	assert.NoError(t, kvdb.DeleteKeyIf("key", db.Condition{IfVersion: v2}))
+	assert.ErrorIs(t, kvdb.DeleteKeyIf("key", db.Condition{IfVersion: v2}), db.ErrVersionMismatch)
+
+	// an expired key counts as absent
+	_, err = kvdb.SetKeyIf("session", db.Value{Data: []byte("old"), ExpiresAt: time.Now().Add(-time.Second).UnixNano()}, db.Condition{})
+	assert.NoError(t, err)
+	_, err = kvdb.SetKeyIf("session", db.Value{Data: []byte("new")}, db.Condition{IfAbsent: true})
+	assert.NoError(t, err)
+
+	// replicas assign the same versions as their leader
+	entries, err := kvdb.ReadLog(1, 10)
+	assert.NoError(t, err)
+	replica := createTempDb(t, true)
+	assert.NoError(t, replica.ApplyLog(entries))
+	leaderValue, err := kvdb.GetKey("session")
+	assert.NoError(t, err)
+	replicaValue, err := replica.GetKey("session")
+	assert.NoError(t, err)
+	assert.Equal(t, leaderValue.Version, replicaValue.Version)
+}
+
+func TestScan(t *testing.T) {
+	kvdb := createTempDb(t, false)
+	for _, key := range []string{"user:1:name", "user:1:mail", "user:12:name", "user:2:name", "users", "video:1"} {
+		setKey(t, kvdb, key, "value")
+	}
+	setKeyValue(t, kvdb, "user:1:token", db.Value{Data: []byte("expired"), ExpiresAt: time.Now().Add(-time.Second).UnixNano()})
+
+	keys := func(pairs []db.KeyValue, err error) []string {
+		assert.NoError(t, err)
+		var res []string
+		for _, p := range pairs {
+			res = append(res, p.Key)
+		}
+		return res
+	}
+	assert.Equal(t, []string{"user:1:mail", "user:1:name"}, keys(kvdb.Prefix("user:1:", 10)))
+	assert.Equal(t, []string{"user:12:name", "user:1:mail", "user:1:name"}, keys(kvdb.Prefix("user:1", 10)))
+	assert.Equal(t, []string{"user:12:name"}, keys(kvdb.Prefix("user:1", 1)))
+	assert.Equal(t, []string{"user:2:name", "users"}, keys(kvdb.Scan("user:2", "video", 10)))
+	assert.Equal(t, []string{"users", "video:1"}, keys(kvdb.Scan("users", "", 10)))
+	assert.Equal(t, "", db.PrefixEnd("\xff\xff"))
+	assert.Equal(t, "b", db.PrefixEnd("a\xff"))
+}
+
+func TestBatch(t *testing.T) {
+	kvdb := createTempDb(t, false)
+
+	versions, err := kvdb.SetKeys([]db.KeyValue{
+		{Key: "a", Value: db.Value{Data: []byte("1")}},
+		{Key: "b", Value: db.Value{Data: []byte("2"), ExpiresAt: time.Now().Add(-time.Second).UnixNano()}},
+		{Key: "c", Value: db.Value{Data: []byte("3")}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 3}, versions)
+
+	values, err := kvdb.GetKeys([]string{"a", "b", "c", "d"})
+	assert.NoError(t, err)
+	assert.Len(t, values, 2)
+	assert.Equal(t, "1", string(values["a"].Data))
+	assert.Equal(t, uint64(3), values["c"].Version)
+
+	assert.NoError(t, kvdb.DeleteKeys([]string{"a", "d"}))
+	assert.Equal(t, "", getKey(t, kvdb, "a"))
+	assert.Equal(t, "3", getKey(t, kvdb, "c"))
+
+	entries, err := kvdb.ReadLog(1, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 5)
+}
+
+func TestImportKeys(t *testing.T) {
+	kvdb := createTempDb(t, false)
+	setKey(t, kvdb, "newer", "written-here")
+
+	stored, locked, err := kvdb.ImportKeys([]db.KeyValue{
+		{Key: "moved", Value: db.Value{Data: []byte("moved")}},
+		{Key: "newer", Value: db.Value{Data: []byte("moved")}},
+		{Key: "expired", Value: db.Value{Data: []byte("moved"), ExpiresAt: time.Now().Add(-time.Second).UnixNano()}},
+	})
+	assert.NoError(t, err)
+	// the existing key is kept and confirmed, the expired pair is not confirmed
+	assert.Equal(t, []string{"moved", "newer"}, stored)
+	assert.Empty(t, locked)
+	assert.Equal(t, "moved", getKey(t, kvdb, "moved"))
+	assert.Equal(t, "written-here", getKey(t, kvdb, "newer"))
+	assert.Equal(t, "", getKey(t, kvdb, "expired"))
+}
+
+func TestTxn(t *testing.T) {
+	kvdb := createTempDb(t, false)
+	setKey(t, kvdb, "record", "v1")
+
+	// the record and its index entry are written together
+	versions, err := kvdb.Txn([]db.Compare{
+		{Key: "record", IfValue: []byte("v1")},
+		{Key: "index:v2", Condition: db.Condition{IfAbsent: true}},
+	}, []db.TxnOp{
+		{Key: "record", Value: db.Value{Data: []byte("v2")}},
+		{Key: "index:v2", Value: db.Value{Data: []byte("record")}},
+		{Key: "index:v1", Delete: true},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2, 3, 0}, versions)
+	assert.Equal(t, "v2", getKey(t, kvdb, "record"))
+	assert.Equal(t, "record", getKey(t, kvdb, "index:v2"))
+
+	// nothing is written when a condition does not hold
+	_, err = kvdb.Txn([]db.Compare{
+		{Key: "record", Condition: db.Condition{IfVersion: 2}},
+		{Key: "record", IfValue: []byte("v1")},
+	}, []db.TxnOp{{Key: "record", Value: db.Value{Data: []byte("v3")}}})
+	var failed *db.CompareError
+	assert.True(t, errors.As(err, &failed))
+	assert.Equal(t, 1, failed.Index)
+	assert.True(t, errors.Is(err, db.ErrValueMismatch))
+	assert.Equal(t, "v2", getKey(t, kvdb, "record"))
+
+	_, err = kvdb.Txn([]db.Compare{{Key: "index:v2", Condition: db.Condition{IfAbsent: true}}}, []db.TxnOp{{Key: "index:v2", Delete: true}})
+	assert.True(t, errors.Is(err, db.ErrExists))
+	assert.Equal(t, "record", getKey(t, kvdb, "index:v2"))
+}
+
+func TestPreparedTxn(t *testing.T) {
+	kvdb := createTempDb(t, false)
+	setKey(t, kvdb, "record", "v1")
+
+	p := db.PreparedTxn{
+		ID:               "txn-1",
+		CoordinatorShard: 1,
+		Compares:         []db.Compare{{Key: "record", IfValue: []byte("v1")}},
+		Ops:              []db.TxnOp{{Key: "record", Value: db.Value{Data: []byte("v2")}}},
+	}
+	assert.NoError(t, kvdb.Prepare(p))
+	// preparing again is a no-op
+	assert.NoError(t, kvdb.Prepare(p))
+
+	// the keys are locked until the outcome is known
+	assert.True(t, errors.Is(kvdb.SetKey("record", db.Value{Data: []byte("v3")}), db.ErrLocked))
+	assert.True(t, errors.Is(kvdb.Prepare(db.PreparedTxn{ID: "txn-2", Compares: []db.Compare{{Key: "record"}}}), db.ErrLocked))
+	prepared, err := kvdb.PreparedTxns()
+	assert.NoError(t, err)
+	assert.Len(t, prepared, 1)
+	assert.Equal(t, 1, prepared[0].CoordinatorShard)
+
+	// the locked keys are neither imported, deleted once moved to another shard, nor expired
+	stored, locked, err := kvdb.ImportKeys([]db.KeyValue{{Key: "record", Value: db.Value{Data: []byte("moved")}}})
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+	assert.Equal(t, []string{"record"}, locked)
+	locked, err = kvdb.LockedKeys([]string{"other", "record"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"record"}, locked)
+	deleted, err := kvdb.DeleteKeysIfUnchanged([]db.KeyValue{{Key: "record", Value: db.Value{Data: []byte("v1"), Version: 1}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	// a replica pulling the log holds the prepared transaction too
+	replica := createTempDb(t, false)
+	entries, err := kvdb.ReadLog(1, 10)
+	assert.NoError(t, err)
+	assert.NoError(t, replica.ApplyLog(entries))
+	prepared, err = replica.PreparedTxns()
+	assert.NoError(t, err)
+	assert.Len(t, prepared, 1)
+
+	versions, err := kvdb.CommitPrepared("txn-1")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3}, versions)
+	assert.Equal(t, "v2", getKey(t, kvdb, "record"))
+	// the outcome may be delivered more than once, but not changed
+	versions, err = kvdb.CommitPrepared("txn-1")
+	assert.NoError(t, err)
+	assert.Empty(t, versions)
+	assert.ErrorIs(t, kvdb.AbortPrepared("txn-1"), db.ErrTxnOutcome)
+	assert.ErrorIs(t, kvdb.Prepare(p), db.ErrTxnOutcome)
+	// a transaction this shard never prepared can not be committed
+	_, err = kvdb.CommitPrepared("unknown")
+	assert.ErrorIs(t, err, db.ErrUnknownTxn)
+
+	entries, err = kvdb.ReadLog(3, 10)
+	assert.NoError(t, err)
+	assert.NoError(t, replica.ApplyLog(entries))
+	prepared, err = replica.PreparedTxns()
+	assert.NoError(t, err)
+	assert.Empty(t, prepared)
+	assert.Equal(t, "v2", getKey(t, replica, "record"))
+
+	p = db.PreparedTxn{ID: "txn-3", Ops: []db.TxnOp{{Key: "record", Delete: true}}}
+	assert.NoError(t, kvdb.Prepare(p))
+	assert.NoError(t, kvdb.AbortPrepared("txn-3"))
+	assert.Equal(t, "v2", getKey(t, kvdb, "record"))
+	setKey(t, kvdb, "record", "v3")
+	_, err = kvdb.CommitPrepared("txn-3")
+	assert.ErrorIs(t, err, db.ErrTxnOutcome)
+
+	// once forgotten, the outcome is unknown
+	pruned, err := kvdb.PruneResolvedTxns(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pruned)
+	_, err = kvdb.CommitPrepared("txn-1")
+	assert.ErrorIs(t, err, db.ErrUnknownTxn)
+
+	// an expired key held by a transaction is deleted once the transaction is resolved
+	setKeyValue(t, kvdb, "ttl", db.Value{Data: []byte("value"), ExpiresAt: time.Now().Add(-time.Second).UnixNano()})
+	assert.NoError(t, kvdb.Prepare(db.PreparedTxn{ID: "txn-4", Ops: []db.TxnOp{{Key: "ttl", Delete: true}}}))
+	n, err := kvdb.ExpireKeys(time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.NoError(t, kvdb.AbortPrepared("txn-4"))
+	n, err = kvdb.ExpireKeys(time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestPreparedTxnQuota(t *testing.T) {
+	kvdb := createTempDb(t, false)
+	_, err := kvdb.CreateNamespace("web", 2, 0)
+	assert.NoError(t, err)
+	web, err := kvdb.Namespace("web")
+	assert.NoError(t, err)
+	setKey(t, web, "session", "a")
+
+	set := func(key string) db.TxnOp {
+		return db.TxnOp{Key: key, Value: db.Value{Data: []byte("v")}}
+	}
+	assert.NoError(t, web.Prepare(db.PreparedTxn{ID: "txn-1", Ops: []db.TxnOp{set("token")}}))
+	// the keys of the transactions already prepared count towards the quota
+	err = web.Prepare(db.PreparedTxn{ID: "txn-2", Ops: []db.TxnOp{set("third")}})
+	assert.True(t, errors.Is(err, db.ErrQuotaExceeded))
+	// a transaction that does not grow the namespace is prepared
+	assert.NoError(t, web.Prepare(db.PreparedTxn{ID: "txn-3", Ops: []db.TxnOp{{Key: "session", Delete: true}, set("third")}}))
+	prepared, err := kvdb.PreparedTxns()
+	assert.NoError(t, err)
+	assert.Len(t, prepared, 2)
+
+	_, err = web.CommitPrepared("txn-1")
+	assert.NoError(t, err)
+	_, err = web.CommitPrepared("txn-3")
+	assert.NoError(t, err)
+	namespaces, err := kvdb.Namespaces()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), namespaces[0].Keys)
+}
+
+func TestReadChanges(t *testing.T) {
+	kvdb := createTempDb(t, false)
+
+	changed := kvdb.Changes()
+	setKey(t, kvdb, "a", "1")
+	select {
+	case <-changed:
+	default:
+		t.Fatal("a write did not notify the watchers")
+	}
+	assert.NoError(t, kvdb.DeleteKey("a"))
+	setKey(t, kvdb, "b", "2")
+
+	entries, err := kvdb.ReadChanges(2, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, db.OpDelete, entries[0].Op)
+	assert.Equal(t, "b", entries[1].Key)
+	assert.Equal(t, uint64(3), entries[1].Value.Version)
+
+	entries, err = kvdb.ReadChanges(4, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	assert.NoError(t, kvdb.TruncateLog(2))
+	_, err = kvdb.ReadChanges(1, 10)
+	assert.True(t, errors.Is(err, db.ErrCompacted))
+	entries, err = kvdb.ReadChanges(3, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestIncrement(t *testing.T) {
+	kvdb := createTempDb(t, false)
+
+	n, version, err := kvdb.Increment("hits", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, uint64(1), version)
+	n, _, err = kvdb.Increment("hits", -5)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-4), n)
+	assert.Equal(t, "-4", getKey(t, kvdb, "hits"))
+
+	// the log carries the resulting value, replicas do not apply the increment again
+	entries, err := kvdb.ReadLog(2, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "-4", string(entries[0].Value.Data))
+
+	// a counter keeps the expiry it was created with
+	expiresAt := time.Now().Add(time.Hour).UnixNano()
+	_, _, err = kvdb.IncrementExpiring("window", 1, expiresAt)
+	assert.NoError(t, err)
+	_, _, err = kvdb.IncrementExpiring("window", 1, time.Now().Add(2*time.Hour).UnixNano())
+	assert.NoError(t, err)
+	value, err := kvdb.GetKey("window")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(value.Data))
+	assert.Equal(t, expiresAt, value.ExpiresAt)
+
+	// an expired counter starts over
+	setKeyValue(t, kvdb, "expired", db.Value{Data: []byte("10"), ExpiresAt: time.Now().Add(-time.Second).UnixNano()})
+	n, _, err = kvdb.Increment("expired", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	setKey(t, kvdb, "name", "luffy")
+	_, _, err = kvdb.Increment("name", 1)
+	assert.True(t, errors.Is(err, db.ErrNotNumeric))
+	assert.Equal(t, "luffy", getKey(t, kvdb, "name"))
+
+	setKey(t, kvdb, "big", "9223372036854775807")
+	_, _, err = kvdb.Increment("big", 1)
+	assert.True(t, errors.Is(err, db.ErrOverflow))
+}
+
+func TestNamespaces(t *testing.T) {
+	kvdb := createTempDb(t, false)
+
+	_, err := kvdb.Namespace("web")
+	assert.True(t, errors.Is(err, db.ErrNoNamespace))
+	_, err = kvdb.CreateNamespace("bad/name", 0, 0)
+	assert.Error(t, err)
+
+	_, err = kvdb.CreateNamespace("web", 2, 0)
+	assert.NoError(t, err)
+	web, err := kvdb.Namespace("web")
+	assert.NoError(t, err)
+	assert.Equal(t, "web", web.Name())
+
+	// the same key lives independently in each namespace
+	setKey(t, kvdb, "session", "default")
+	setKey(t, web, "session", "web")
+	assert.Equal(t, "default", getKey(t, kvdb, "session"))
+	assert.Equal(t, "web", getKey(t, web, "session"))
+	pairs, err := web.Scan("", "", 10)
+	assert.NoError(t, err)
+	assert.Len(t, pairs, 1)
+
+	// the quota counts keys per namespace, overwriting and deleting keep it in bounds
+	setKey(t, web, "token", "a")
+	_, err = web.SetKeyIf("third", db.Value{Data: []byte("c")}, db.Condition{})
+	assert.True(t, errors.Is(err, db.ErrQuotaExceeded))
+	_, err = web.GetKey("third")
+	assert.True(t, errors.Is(err, db.ErrNotFound))
+	setKey(t, web, "token", "b")
+	_, err = web.SetKeys([]db.KeyValue{{Key: "third", Value: db.Value{Data: []byte("c")}}})
+	assert.True(t, errors.Is(err, db.ErrQuotaExceeded))
+	assert.NoError(t, web.DeleteKey("token"))
+	setKey(t, web, "third", "c")
+
+	// a byte quota stops a write that grows the namespace past it
+	_, err = kvdb.CreateNamespace("web", 0, 64)
+	assert.NoError(t, err)
+	_, err = web.SetKeyIf("large", db.Value{Data: []byte(strings.Repeat("x", 64))}, db.Condition{})
+	assert.True(t, errors.Is(err, db.ErrQuotaExceeded))
+	namespaces, err := kvdb.Namespaces()
+	assert.NoError(t, err)
+	assert.Len(t, namespaces, 1)
+	assert.Equal(t, int64(2), namespaces[0].Keys)
+	assert.Equal(t, int64(64), namespaces[0].MaxBytes)
+
+	// a replica creates the namespace and applies its keys from the log
+	replica := createTempDb(t, false)
+	assert.NoError(t, replica.SetReadOnly(true))
+	entries, err := kvdb.ReadLog(1, 100)
+	assert.NoError(t, err)
+	assert.NoError(t, replica.ApplyLog(entries))
+	replicaWeb, err := replica.Namespace("web")
+	assert.NoError(t, err)
+	assert.Equal(t, "web", getKey(t, replicaWeb, "session"))
+	assert.Equal(t, "default", getKey(t, replica, "session"))
+	replicaNamespaces, err := replica.Namespaces()
+	assert.NoError(t, err)
+	assert.Equal(t, namespaces, replicaNamespaces)
+
+	// expired keys of every namespace are swept
+	setKeyValue(t, web, "old", db.Value{Data: []byte("v"), ExpiresAt: time.Now().Add(-time.Second).UnixNano()})
+	n, err := kvdb.ExpireKeys(time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	entries, err = kvdb.ReadLog(1, 100)
+	assert.NoError(t, err)
+	last := entries[len(entries)-1]
+	assert.Equal(t, db.OpDelete, last.Op)
+	assert.Equal(t, "web", last.Namespace)
+}
+
+func testKey(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestEncryption(t *testing.T) {
+	for _, text := range []string{"", "k1", "k1:not base64", "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), testKey("k1", 1) + "," + testKey("k1", 2)} {
+		_, err := db.ParseKeyring(text)
+		assert.Error(t, err, text)
+	}
+	k1, err := db.ParseKeyring("# old key\n" + testKey("k1", 1))
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", k1.Current())
+	rotated, err := db.ParseKeyring(testKey("k1", 1) + "," + testKey("k2", 2))
+	assert.NoError(t, err)
+	assert.Equal(t, "k2", rotated.Current())
+	k2, err := db.ParseKeyring(testKey("k2", 2))
+	assert.NoError(t, err)
+
+	name := filepath.Join(t.TempDir(), "kvdb")
+	open := func(opts ...db.Option) *db.KVDatabase {
+		kvdb, err := db.NewDatabase(name, false, opts...)
+		assert.NoError(t, err)
+		return kvdb
+	}
+
+	// values written in the clear are still read once encryption is enabled
+	kvdb := open()
+	setKey(t, kvdb, "plain", "plain-value")
+	assert.NoError(t, kvdb.Close())
+
+	kvdb = open(db.WithEncryption(k1))
+	assert.Equal(t, "plain-value", getKey(t, kvdb, "plain"))
+	setKeyValue(t, kvdb, "secret", db.Value{Data: []byte("secret-value"), ContentType: "text/plain", ExpiresAt: time.Now().Add(time.Hour).UnixNano()})
+	value, err := kvdb.GetKey("secret")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", value.ContentType)
+	assert.NotZero(t, value.ExpiresAt)
+	// the header in the clear keeps the conditions working
+	_, err = kvdb.SetKeyIf("secret", db.Value{Data: []byte("secret-value-2")}, db.Condition{IfVersion: value.Version + 1})
+	assert.True(t, errors.Is(err, db.ErrVersionMismatch))
+	_, err = kvdb.SetKeyIf("secret", db.Value{Data: []byte("secret-value-2")}, db.Condition{IfVersion: value.Version})
+	assert.NoError(t, err)
+	assert.NoError(t, kvdb.Prepare(db.PreparedTxn{ID: "txn-1", Ops: []db.TxnOp{{Key: "pending", Value: db.Value{Data: []byte("pending-value")}}}}))
+	assert.Equal(t, "secret-value-2", getKey(t, kvdb, "secret"))
+	entries, err := kvdb.ReadLog(2, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3, "two sets and the prepare")
+	assert.Equal(t, "secret-value", string(entries[0].Value.Data))
+	prepared, err := kvdb.PreparedTxns()
+	assert.NoError(t, err)
+	assert.Len(t, prepared, 1)
+	// the values are only kept encrypted, in the data, the log and the prepared transactions
+	n, err := kvdb.Reencrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n, "the plain value and its log entry")
+	assert.NoError(t, kvdb.Close())
+	file, err := os.ReadFile(name)
+	assert.NoError(t, err)
+	for _, plain := range []string{"secret-value", "pending-value"} {
+		assert.False(t, bytes.Contains(file, []byte(plain)), plain)
+	}
+
+	// without the key the values can not be read
+	kvdb = open()
+	_, err = kvdb.GetKey("secret")
+	assert.True(t, errors.Is(err, db.ErrNoKey))
+	assert.NoError(t, kvdb.Close())
+
+	// after a rotation the old key still decrypts until the database is re-encrypted
+	kvdb = open(db.WithEncryption(rotated))
+	assert.Equal(t, "secret-value-2", getKey(t, kvdb, "secret"))
+	setKey(t, kvdb, "new", "new-value")
+	n, err = kvdb.Reencrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, 7, n, "two values, four log entries and a prepared transaction")
+	n, err = kvdb.Reencrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.NoError(t, kvdb.Close())
+
+	kvdb = open(db.WithEncryption(k2))
+	defer func() { assert.NoError(t, kvdb.Close()) }()
+	for key, want := range map[string]string{"plain": "plain-value", "secret": "secret-value-2", "new": "new-value"} {
+		assert.Equal(t, want, getKey(t, kvdb, key))
+	}
+	entries, err = kvdb.ReadLog(1, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 5)
+	versions, err := kvdb.CommitPrepared("txn-1")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.Equal(t, "pending-value", getKey(t, kvdb, "pending"))
+	// a conditional delete compares the decrypted values
+	value, err = kvdb.GetKey("new")
+	assert.NoError(t, err)
+	deleted, err := kvdb.DeleteKeysIfUnchanged([]db.KeyValue{{Key: "new", Value: value}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+}
+
+func TestEncryptedValueIsBoundToItsKey(t *testing.T) {
+	keys, err := db.ParseKeyring(testKey("k1", 1))
+	assert.NoError(t, err)
+	name := filepath.Join(t.TempDir(), "kvdb")
+	kvdb, err := db.NewDatabase(name, false, db.WithEncryption(keys))
+	assert.NoError(t, err)
+	setKey(t, kvdb, "admin", "admin-token")
+	setKey(t, kvdb, "guest", "guest-token")
+	assert.NoError(t, kvdb.Close())
+
+	// a sealed value copied under another key does not decrypt
+	boltDb, err := bolt.Open(name, 0600, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, boltDb.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("kv"))
+		return b.Put([]byte("guest"), b.Get([]byte("admin")))
+	}))
+	assert.NoError(t, boltDb.Close())
+
+	kvdb, err = db.NewDatabase(name, false, db.WithEncryption(keys))
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, kvdb.Close()) }()
+	assert.Equal(t, "admin-token", getKey(t, kvdb, "admin"))
+	_, err = kvdb.GetKey("guest")
+	assert.Error(t, err)
+}
+
+func TestCompactFile(t *testing.T) {
+	keys, err := db.ParseKeyring(testKey("k1", 1))
+	assert.NoError(t, err)
+	name := filepath.Join(t.TempDir(), "kvdb")
+	kvdb, err := db.NewDatabase(name, false)
+	assert.NoError(t, err)
+	large := strings.Repeat("plain-value ", 1000)
+	setKey(t, kvdb, "large", large)
+	assert.NoError(t, kvdb.Close())
+
+	kvdb, err = db.NewDatabase(name, false, db.WithEncryption(keys))
+	assert.NoError(t, err)
+	n, err := kvdb.Reencrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.NoError(t, kvdb.Close())
+
+	// the pages freed by the rewrite keep the value in the clear until the file is compacted
+	file, err := os.ReadFile(name)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Contains(file, []byte("plain-value")))
+	assert.NoError(t, db.CompactFile(name))
+	file, err = os.ReadFile(name)
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(file, []byte("plain-value")))
+
+	kvdb, err = db.NewDatabase(name, false, db.WithEncryption(keys))
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, kvdb.Close()) }()
+	assert.Equal(t, large, getKey(t, kvdb, "large"))
+	setKey(t, kvdb, "next", "value")
+	value, err := kvdb.GetKey("next")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), value.Version, "the log numbering is kept")
+}
+
+func TestBackup(t *testing.T) {
+	// the snapshot is copied from the file, it must stay around unlike with createTempDb
+	dir := t.TempDir()
+	kvdb, err := db.NewDatabase(filepath.Join(dir, "kv.db"), false)
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, kvdb.Close()) }()
+	_, err = kvdb.CreateNamespace("web", 0, 0)
+	assert.NoError(t, err)
+	web, err := kvdb.Namespace("web")
+	assert.NoError(t, err)
+	setKey(t, kvdb, "key", "value")
+	setKey(t, web, "session", "web")
+	// the vote and the replicas of the node itself are not restored
+	assert.NoError(t, kvdb.SaveElectionState(2, "node-2"))
+	_, err = kvdb.AckReplica("replica-1", 1, []string{"replica-1"})
+	assert.NoError(t, err)
+	assert.NoError(t, kvdb.SaveTxn(db.CoordinatedTxn{ID: "txn-1", State: db.TxnPending, Shards: []int{1}}))
+
+	snapshot, err := kvdb.Backup()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), snapshot.Info.Seq)
+	// writes go on while the snapshot is copied and are not part of it, those growing the file wait
+	// for the snapshot to be closed
+	written := make(chan error)
+	go func() {
+		written <- kvdb.SetKey("later", db.Value{Data: []byte("value")})
+	}()
+	backup := filepath.Join(dir, "backup.db")
+	f, err := os.Create(backup)
+	assert.NoError(t, err)
+	n, err := snapshot.WriteTo(f)
+	assert.NoError(t, err)
+	assert.Equal(t, snapshot.Info.Size, n)
+	assert.NoError(t, f.Close())
+	assert.NoError(t, snapshot.Close())
+	assert.NoError(t, <-written)
+
+	restored := filepath.Join(dir, "restored.db")
+	info, err := db.Restore(backup, restored)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), info.Seq)
+	_, err = db.Restore(backup, restored)
+	assert.Error(t, err, "the database already exists")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "garbage.db"), []byte("garbage"), 0600))
+	_, err = db.Restore(filepath.Join(dir, "garbage.db"), filepath.Join(dir, "other.db"))
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "other.db"))
+	assert.True(t, os.IsNotExist(err))
+
+	// a replica restored from the snapshot resumes from its position
+	replica, err := db.NewDatabase(restored, true)
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, replica.Close()) }()
+	applied, err := replica.AppliedSeq()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), applied)
+	term, votedFor, err := replica.ElectionState()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), term)
+	assert.Equal(t, "", votedFor)
+	acks, err := replica.ReplicaAcks()
+	assert.NoError(t, err)
+	assert.Empty(t, acks)
+	// the coordinated transactions belong to the shard, their outcome is still needed by the participants
+	txns, err := replica.CoordinatedTxns()
+	assert.NoError(t, err)
+	assert.Equal(t, []db.CoordinatedTxn{{ID: "txn-1", State: db.TxnPending, Shards: []int{1}}}, txns)
+	replicaWeb, err := replica.Namespace("web")
+	assert.NoError(t, err)
+	assert.Equal(t, "web", getKey(t, replicaWeb, "session"))
+	assert.Equal(t, "", getKey(t, replica, "later"))
+	entries, err := kvdb.ReadLog(applied+1, 10)
+	assert.NoError(t, err)
+	assert.NoError(t, replica.ApplyLog(entries))
+	assert.Equal(t, "value", getKey(t, replica, "later"))
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	// a database of the first release: raw values, and the keys not yet replicated queued in a bucket
+	name := filepath.Join(t.TempDir(), "kv.db")
+	legacy, err := bolt.Open(name, 0600, nil)
+	assert.NoError(t, err)
+	raw := map[string][]byte{
+		"plain":  []byte("value-1"),
+		"framed": {3, 0, 0, 0, 'x'},
+		"empty":  {},
+	}
+	assert.NoError(t, legacy.Update(func(tx *bolt.Tx) error {
+		kv, err := tx.CreateBucket([]byte("kv"))
+		if err != nil {
+			return err
+		}
+		for k, v := range raw {
+			if err := kv.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		replica, err := tx.CreateBucket([]byte("replica"))
+		if err != nil {
+			return err
+		}
+		return replica.Put([]byte("plain"), []byte("value-1"))
+	}))
+	assert.NoError(t, legacy.Close())
+
+	kvdb, err := db.NewDatabase(name, false)
+	assert.NoError(t, err)
+	for k, v := range raw {
+		value, err := kvdb.GetKey(k)
+		assert.NoError(t, err, k)
+		assert.Equal(t, v, value.Data, k)
+	}
+	pairs, err := kvdb.Scan("", "", 10)
+	assert.NoError(t, err)
+	assert.Len(t, pairs, 3)
+	// the queued key is handed to the replicas through the log
+	entries, err := kvdb.ReadLog(1, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []db.LogEntry{{Seq: 1, Op: db.OpSet, Key: "plain", Value: db.Value{Data: []byte("value-1")}}}, entries)
+	value, err := kvdb.GetKey("plain")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), value.Version)
+	assert.NoError(t, kvdb.Close())
+
+	// the migration runs once
+	kvdb, err = db.NewDatabase(name, false)
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, kvdb.Close()) }()
+	value, err = kvdb.GetKey("framed")
+	assert.NoError(t, err)
+	assert.Equal(t, raw["framed"], value.Data)
+	entries, err = kvdb.ReadLog(1, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
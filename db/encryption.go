@@ -0,0 +1,436 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"strings"
+	"time"
+)
+
+// encryptedFormat is the first byte of values encrypted at rest: the expiry and the version are kept in
+// the clear like in valueFormat, so that expiry and conditions work without decrypting, followed by the
+// content type and the data sealed by the keyring. Prepared transactions encrypted at rest start with it
+// as well. The seal authenticates the header and the place of the value, its bucket and key, so that a
+// value copied under another key or into the log does not decrypt.
+const encryptedFormat byte = 5
+
+// legacyEncryptedFormat values and records were sealed with only their header authenticated, they are
+// still read and Reencrypt rewrites them in encryptedFormat
+const legacyEncryptedFormat byte = 4
+
+// ErrNoKey is returned when a value was encrypted with a key the keyring does not have
+var ErrNoKey = errors.New("encryption key not found")
+
+// Keyring holds the keys encrypting the values at rest. Every encrypted value is prefixed with the id
+// of its key, so that keys can be rotated: the current key encrypts new writes, the older ones still
+// decrypt the values written with them until the database is re-encrypted.
+type Keyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// ParseKeyring parses keys written as id:base64key, separated by newlines or commas. The keys are
+// AES keys of 16, 24 or 32 bytes and the last one is the current key. Empty lines and lines starting
+// with # are ignored.
+func ParseKeyring(text string) (*Keyring, error) {
+	k := &Keyring{aeads: make(map[string]cipher.AEAD)}
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, ":")
+		if !ok || id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid key %q, expected id:base64key", line)
+		}
+		if _, ok := k.aeads[id]; ok {
+			return nil, fmt.Errorf("duplicate key %s", id)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+		if k.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+		k.current = id
+	}
+	if k.current == "" {
+		return nil, fmt.Errorf("no encryption key")
+	}
+	return k, nil
+}
+
+// KeysEnv is the environment variable holding the keys when there is no key file
+const KeysEnv = "KV_ENCRYPTION_KEYS"
+
+// LoadKeyring reads the keys from a file in the format of ParseKeyring, or from the KeysEnv
+// environment variable when file is empty. It returns nil when neither is set.
+func LoadKeyring(file string) (*Keyring, error) {
+	if file == "" {
+		if keys := os.Getenv(KeysEnv); keys != "" {
+			return ParseKeyring(keys)
+		}
+		return nil, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(b))
+}
+
+// Current returns the id of the key encrypting new writes
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// seal encrypts plain with the current key, bound to the additional data, as
+// uvarint(len(id)) | id | nonce | ciphertext
+func (k *Keyring) seal(plain, additional []byte) []byte {
+	aead := k.aeads[k.current]
+	b := binary.AppendUvarint(nil, uint64(len(k.current)))
+	b = append(b, k.current...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("error reading random nonce: %v", err))
+	}
+	b = append(b, nonce...)
+	return aead.Seal(b, nonce, plain, additional)
+}
+
+// open decrypts a sealed message with the key it names
+func (k *Keyring) open(sealed, additional []byte) ([]byte, error) {
+	id, rest, err := sealedKeyID(sealed)
+	if err != nil {
+		return nil, err
+	}
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoKey, id)
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("corrupt encrypted value")
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], additional)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting with key %s: %w", id, err)
+	}
+	return plain, nil
+}
+
+// sealedKeyID returns the id of the key of a sealed message and the rest of it
+func sealedKeyID(sealed []byte) (string, []byte, error) {
+	idLen, n := binary.Uvarint(sealed)
+	if n <= 0 || uint64(len(sealed)-n) < idLen {
+		return "", nil, fmt.Errorf("corrupt encrypted value")
+	}
+	return string(sealed[n : n+int(idLen)]), sealed[n+int(idLen):], nil
+}
+
+// Option configures optional behaviour of the database
+type Option func(*store)
+
+// WithEncryption encrypts the values at rest with the keyring: the values of the keys, the values in
+// the change log and the prepared transactions. Values written before encryption was enabled are still
+// read, Reencrypt encrypts them.
+func WithEncryption(keys *Keyring) Option {
+	return func(s *store) {
+		s.keys = keys
+	}
+}
+
+// valuePlace identifies where a value is stored, as uvarint(len(bucket)) | bucket | key, it is
+// authenticated along with the encrypted values and records
+func valuePlace(bucket, key []byte) []byte {
+	b := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(bucket)+len(key)), uint64(len(bucket)))
+	b = append(b, bucket...)
+	return append(b, key...)
+}
+
+// dataPlace is the place of the value of a key of the namespace
+func dataPlace(ns string, key []byte) []byte {
+	return valuePlace(namespaceBucketName(defaultBucket, ns), key)
+}
+
+// logPlace is the place of the value of a change log entry
+func logPlace(seq uint64) []byte {
+	return valuePlace([]byte(logBucket), seqKey(seq))
+}
+
+// preparedPlace is the place of a prepared transaction
+func preparedPlace(id []byte) []byte {
+	return valuePlace([]byte(preparedBucket), id)
+}
+
+// encrypted reports whether a stored value or record is encrypted
+func encrypted(b []byte) bool {
+	return len(b) > 0 && (b[0] == encryptedFormat || b[0] == legacyEncryptedFormat)
+}
+
+// encodeValue encodes the value to be stored at place, encrypted when the database has a keyring
+func (s *store) encodeValue(v Value, place []byte) []byte {
+	if s.keys == nil {
+		return encodePlainValue(v)
+	}
+	b := make([]byte, 1, 1+2*binary.MaxVarintLen64)
+	b[0] = encryptedFormat
+	b = binary.AppendUvarint(b, uint64(v.ExpiresAt))
+	b = binary.AppendUvarint(b, v.Version)
+	body := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(v.ContentType)+len(v.Data)), uint64(len(v.ContentType)))
+	body = append(body, v.ContentType...)
+	body = append(body, v.Data...)
+	// the header is authenticated, so that the expiry or version of a value can not be changed, and so is
+	// the place, so that the value can not be moved
+	return append(b, s.keys.seal(body, append(b[:len(b):len(b)], place...))...)
+}
+
+// decodeValue decodes a value stored at place, decrypting it if it is encrypted
+func (s *store) decodeValue(b, place []byte) (Value, error) {
+	if !encrypted(b) {
+		return decodePlainValue(b)
+	}
+	return s.openValue(b, place)
+}
+
+// viewValue decodes a stored value like decodeValue, the data of a value stored in the clear is a slice of b
+func (s *store) viewValue(b, place []byte) (Value, error) {
+	if !encrypted(b) {
+		return viewPlainValue(b)
+	}
+	return s.openValue(b, place)
+}
+
+// openValue decrypts an encrypted value
+func (s *store) openValue(b, place []byte) (Value, error) {
+	if s.keys == nil {
+		return Value{}, fmt.Errorf("%w: the value is encrypted and the database has no keyring", ErrNoKey)
+	}
+	h, sealed, err := decodeHeader(b)
+	if err != nil {
+		return Value{}, err
+	}
+	headerLen := len(b) - len(sealed)
+	additional := b[:headerLen:headerLen]
+	if b[0] == encryptedFormat {
+		additional = append(additional, place...)
+	}
+	body, err := s.keys.open(sealed, additional)
+	if err != nil {
+		return Value{}, err
+	}
+	typeLen, n := binary.Uvarint(body)
+	if n <= 0 || uint64(len(body)-n) < typeLen {
+		return Value{}, fmt.Errorf("corrupt value")
+	}
+	body = body[n:]
+	return Value{
+		ContentType: string(body[:typeLen]),
+		Data:        body[typeLen:],
+		ExpiresAt:   h.expiresAt,
+		Version:     h.version,
+	}, nil
+}
+
+// encodeRecord encrypts a JSON record stored at place when the database has a keyring
+func (s *store) encodeRecord(record, place []byte) []byte {
+	if s.keys == nil {
+		return record
+	}
+	return append([]byte{encryptedFormat}, s.keys.seal(record, append([]byte{encryptedFormat}, place...))...)
+}
+
+// decodeRecord returns the JSON of a record stored at place, decrypting it if it is encrypted
+func (s *store) decodeRecord(b, place []byte) ([]byte, error) {
+	if !encrypted(b) {
+		return b, nil
+	}
+	if s.keys == nil {
+		return nil, fmt.Errorf("%w: the record is encrypted and the database has no keyring", ErrNoKey)
+	}
+	additional := b[:1:1]
+	if b[0] == encryptedFormat {
+		additional = append(additional, place...)
+	}
+	return s.keys.open(b[1:], additional)
+}
+
+// staleValue reports whether a stored value must be rewritten to be encrypted with the current key
+func (s *store) staleValue(b []byte) bool {
+	if len(b) == 0 || b[0] != encryptedFormat {
+		return true
+	}
+	_, sealed, err := decodeHeader(b)
+	return err != nil || s.staleSealed(sealed)
+}
+
+// staleRecord reports whether a stored record must be rewritten to be encrypted with the current key
+func (s *store) staleRecord(b []byte) bool {
+	return len(b) == 0 || b[0] != encryptedFormat || s.staleSealed(b[1:])
+}
+
+func (s *store) staleSealed(sealed []byte) bool {
+	id, _, err := sealedKeyID(sealed)
+	return err != nil || id != s.keys.current
+}
+
+// reencryptBatchSize is the largest number of values rewritten in one transaction by Reencrypt
+const reencryptBatchSize = 1000
+
+// Reencrypt rewrites every value, change log entry and prepared transaction that is not encrypted with
+// the current key of the keyring, and returns the number of rewritten ones. Versions, expiries and the
+// change log numbering are unchanged, so replicas are not affected; they encrypt what they receive with
+// their own keyring. It is meant to run offline, after a key rotation or when enabling encryption on an
+// existing database, with every key still used by the database in the keyring, and followed by
+// CompactFile, as the old copies of the values stay in the pages freed by the rewrite.
+func (db *KVDatabase) Reencrypt() (int, error) {
+	if db.keys == nil {
+		return 0, fmt.Errorf("the database has no keyring")
+	}
+	var namespaces []string
+	if err := db.db.View(func(tx *bolt.Tx) error {
+		namespaces = namespaceNames(tx)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, ns := range namespaces {
+		ns := ns
+		n, err := db.reencryptBucket(func(tx *bolt.Tx) *bolt.Bucket { return dataBucket(tx, ns) }, db.staleValue, func(tx *bolt.Tx, k, v []byte) ([]byte, error) {
+			value, err := db.decodeValue(v, dataPlace(ns, k))
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", k, err)
+			}
+			enc := db.encodeValue(value, dataPlace(ns, k))
+			return enc, addUsage(tx, ns, 0, int64(len(enc)-len(v)))
+		})
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
+	staleEntry := func(v []byte) bool {
+		_, value, err := splitLogEntry(v)
+		return err != nil || value != nil && db.staleValue(value)
+	}
+	n, err := db.reencryptBucket(func(tx *bolt.Tx) *bolt.Bucket { return tx.Bucket([]byte(logBucket)) }, staleEntry, func(tx *bolt.Tx, k, v []byte) ([]byte, error) {
+		e, err := db.decodeLogEntry(k, v)
+		if err != nil {
+			return nil, err
+		}
+		return db.encodeLogEntry(e), nil
+	})
+	total += n
+	if err != nil {
+		return total, err
+	}
+
+	n, err = db.reencryptBucket(func(tx *bolt.Tx) *bolt.Bucket { return tx.Bucket([]byte(preparedBucket)) }, db.staleRecord, func(tx *bolt.Tx, k, v []byte) ([]byte, error) {
+		record, err := db.decodeRecord(v, preparedPlace(k))
+		if err != nil {
+			return nil, fmt.Errorf("prepared transaction %s: %w", k, err)
+		}
+		return db.encodeRecord(record, preparedPlace(k)), nil
+	})
+	return total + n, err
+}
+
+// reencryptBucket rewrites the stale entries of a bucket in batches of reencryptBatchSize
+func (db *KVDatabase) reencryptBucket(bucket func(tx *bolt.Tx) *bolt.Bucket, stale func(v []byte) bool, rewrite func(tx *bolt.Tx, k, v []byte) ([]byte, error)) (int, error) {
+	total := 0
+	var after []byte
+	for {
+		n, last := 0, []byte(nil)
+		err := db.db.Update(func(tx *bolt.Tx) error {
+			b := bucket(tx)
+			type entry struct{ k, v []byte }
+			var rewrites []entry
+			c := b.Cursor()
+			k, v := c.First()
+			if after != nil {
+				if k, v = c.Seek(after); k != nil && string(k) == string(after) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && len(rewrites) < reencryptBatchSize; k, v = c.Next() {
+				last = copySlice(k)
+				if v != nil && stale(v) {
+					rewrites = append(rewrites, entry{last, copySlice(v)})
+				}
+			}
+			for _, e := range rewrites {
+				enc, err := rewrite(tx, e.k, e.v)
+				if err != nil {
+					return err
+				}
+				if err := b.Put(e.k, enc); err != nil {
+					return err
+				}
+			}
+			n = len(rewrites)
+			return nil
+		})
+		total += n
+		if err != nil || last == nil {
+			return total, err
+		}
+		after = last
+	}
+}
+
+// compactTxSize is the largest amount of data copied in one transaction by CompactFile
+const compactTxSize = 64 << 20
+
+// CompactFile replaces the database file at dbLocation, which must not be open, with a compacted copy.
+// Bolt keeps the pages it frees until it reuses them, and with them the old copies of the values
+// rewritten since; the copy only holds the live data, so after Reencrypt no value is left in the clear
+// or sealed with a retired key.
+func CompactFile(dbLocation string) error {
+	stat, err := os.Stat(dbLocation)
+	if err != nil {
+		return err
+	}
+	src, err := bolt.Open(dbLocation, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// the copy is moved into place once complete, an interrupted compaction leaves the file untouched
+	tmp := dbLocation + ".compacting"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dst, err := bolt.Open(tmp, stat.Mode(), &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, src, compactTxSize); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("error compacting %s: %w", dbLocation, err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dbLocation); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
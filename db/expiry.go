@@ -0,0 +1,146 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"time"
+)
+
+const expiryBucket = "expiry"
+
+const (
+	// DefaultSweepInterval is how often the leader looks for expired keys
+	DefaultSweepInterval = time.Second
+	// DefaultSweepBatchSize is the largest number of expired keys deleted in one transaction
+	DefaultSweepBatchSize = 1000
+)
+
+// expiryKey orders the expiry index by time: 8-byte big-endian expiresAt | key
+func expiryKey(expiresAt int64, key []byte) []byte {
+	b := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(b, uint64(expiresAt))
+	return append(b, key...)
+}
+
+// putValue writes the value in the bucket of the namespace and keeps its expiry index and usage in sync
+func (s *store) putValue(tx *bolt.Tx, ns string, key []byte, v Value) error {
+	bucket := dataBucket(tx, ns)
+	old := bucket.Get(key)
+	if err := unindexExpiry(tx, ns, key, old); err != nil {
+		return err
+	}
+	enc := s.encodeValue(v, dataPlace(ns, key))
+	keys, size := int64(1), int64(len(key)+len(enc))
+	if old != nil {
+		keys, size = 0, size-int64(len(key)+len(old))
+	}
+	if err := bucket.Put(key, enc); err != nil {
+		return err
+	}
+	if err := addUsage(tx, ns, keys, size); err != nil {
+		return err
+	}
+	if v.ExpiresAt == 0 {
+		return nil
+	}
+	return expiryIndex(tx, ns).Put(expiryKey(v.ExpiresAt, key), []byte{})
+}
+
+// deleteValue deletes the key from the bucket of the namespace and from its expiry index
+func deleteValue(tx *bolt.Tx, ns string, key []byte) error {
+	bucket := dataBucket(tx, ns)
+	old := bucket.Get(key)
+	if old == nil {
+		return nil
+	}
+	if err := unindexExpiry(tx, ns, key, old); err != nil {
+		return err
+	}
+	if err := addUsage(tx, ns, -1, -int64(len(key)+len(old))); err != nil {
+		return err
+	}
+	return bucket.Delete(key)
+}
+
+// unindexExpiry removes the expiry index entry of old, the current value of the key, if it has one
+func unindexExpiry(tx *bolt.Tx, ns string, key, old []byte) error {
+	if old == nil {
+		return nil
+	}
+	h, _, err := decodeHeader(old)
+	if err != nil || h.expiresAt == 0 {
+		return err
+	}
+	return expiryIndex(tx, ns).Delete(expiryKey(h.expiresAt, key))
+}
+
+// ExpireKeys deletes up to limit keys of every namespace that expired at the given time in a single
+// transaction and returns the number of keys deleted. The deletions are logged, so that replicas drop
+// the keys too. The keys held by a prepared transaction are deleted once it is resolved.
+func (db *KVDatabase) ExpireKeys(now time.Time, limit int) (int, error) {
+	if db.ReadOnly() {
+		return 0, fmt.Errorf("db is read only")
+	}
+	deleted := 0
+	err := db.update(func(tx *bolt.Tx) error {
+		for _, ns := range namespaceNames(tx) {
+			if deleted == limit {
+				return nil
+			}
+			var keys [][]byte
+			c := expiryIndex(tx, ns).Cursor()
+			for k, _ := c.First(); k != nil && deleted+len(keys) < limit; k, _ = c.Next() {
+				if len(k) < 8 || int64(binary.BigEndian.Uint64(k)) > now.UnixNano() {
+					break
+				}
+				if checkLock(tx, ns, string(k[8:])) != nil {
+					continue
+				}
+				keys = append(keys, copySlice(k[8:]))
+			}
+			for _, key := range keys {
+				if err := deleteValue(tx, ns, key); err != nil {
+					return fmt.Errorf("error deleting from bucket %s: %s", namespaceBucketName(defaultBucket, ns), err)
+				}
+				if _, err := db.appendLog(tx, LogEntry{Op: OpDelete, Namespace: ns, Key: string(key)}); err != nil {
+					return err
+				}
+			}
+			deleted += len(keys)
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// RunSweeper deletes expired keys in batches of batchSize every interval until done is closed. It
+// only runs while the database is writable, replicas receive the deletions from their leader.
+func (db *KVDatabase) RunSweeper(done chan bool, interval time.Duration, batchSize int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		for !db.ReadOnly() {
+			n, err := db.ExpireKeys(time.Now(), batchSize)
+			if err != nil {
+				log.Println("error deleting expired keys: ", err)
+				break
+			}
+			if n < batchSize {
+				break
+			}
+			// more keys expired than fit in a batch, keep going without holding the lock for too long
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// Op is the kind of mutation recorded in the change log
+type Op byte
+
+const (
+	OpSet    Op = 's'
+	OpDelete Op = 'd'
+	// OpNamespace creates a namespace or sets its quotas, the key is the name of the namespace
+	OpNamespace Op = 'n'
+	// OpPrepare records a cross-shard transaction prepared on the shard, the key is the id of the
+	// transaction and the value its PreparedTxn
+	OpPrepare Op = 'p'
+	// OpRelease releases the keys of a prepared transaction once its outcome is applied, the key is
+	// the id of the transaction and the value its TxnState
+	OpRelease Op = 'r'
+	// OpTxn records the state of a transaction coordinated by the node, the key is the id of the
+	// transaction and the value its CoordinatedTxn
+	OpTxn Op = 't'
+	// OpForgetTxn drops a coordinated transaction, the key is the id of the transaction
+	OpForgetTxn Op = 'f'
+)
+
+// hasValue reports whether the entries of op carry a value
+func (op Op) hasValue() bool {
+	return op == OpSet || op == OpNamespace || op == OpPrepare || op == OpRelease || op == OpTxn
+}
+
+// namespaceFlag is set on the op byte of the encoded entries of a named namespace
+const namespaceFlag byte = 0x80
+
+var (
+	appliedSeqKey = []byte("appliedSeq")
+	termKey       = []byte("term")
+	votedForKey   = []byte("votedFor")
+	// truncatedKey holds the sequence number and term of the last entry removed by truncateLog, so
+	// that the entry before the oldest retained one can still be compared with the replicas
+	truncatedKey = []byte("truncated")
+)
+
+// LogEntry is a single mutation in the change log
+type LogEntry struct {
+	Seq uint64
+	// Term is the election term of the leader that wrote the entry, zero without elections
+	Term uint64
+	Op   Op
+	// Namespace is the namespace of the key, "" for the default one
+	Namespace string
+	Key       string
+	Value     Value
+}
+
+// appendLog appends the mutation to the change log of the given transaction and returns its sequence number
+func (s *store) appendLog(tx *bolt.Tx, e LogEntry) (uint64, error) {
+	bucket := tx.Bucket([]byte(logBucket))
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return 0, fmt.Errorf("error allocating log sequence: %s", err)
+	}
+	e.Seq, e.Term = seq, s.term.Load()
+	if err := bucket.Put(seqKey(seq), s.encodeLogEntry(e)); err != nil {
+		return 0, fmt.Errorf("error writing to bucket %s: %s", logBucket, err)
+	}
+	return seq, nil
+}
+
+func seqKey(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+// encodeLogEntry encodes the entry as op | uvarint(term) | uvarint(len(key)) | key | value, the value
+// is encoded as in the kv bucket, bound to the seq of the entry when encrypted, and only present for the
+// ops that have one. The entries of a named namespace have the namespaceFlag set on op, followed by
+// uvarint(len(namespace)) | namespace before the key.
+func (s *store) encodeLogEntry(e LogEntry) []byte {
+	b := make([]byte, 1, 1+3*binary.MaxVarintLen64+len(e.Namespace)+len(e.Key))
+	b[0] = byte(e.Op)
+	b = binary.AppendUvarint(b, e.Term)
+	if e.Namespace != "" {
+		b[0] |= namespaceFlag
+		b = binary.AppendUvarint(b, uint64(len(e.Namespace)))
+		b = append(b, e.Namespace...)
+	}
+	b = binary.AppendUvarint(b, uint64(len(e.Key)))
+	b = append(b, e.Key...)
+	if e.Op.hasValue() {
+		b = append(b, s.encodeValue(e.Value, logPlace(e.Seq))...)
+	}
+	return b
+}
+
+func (s *store) decodeLogEntry(k, v []byte) (LogEntry, error) {
+	if len(k) != 8 {
+		return LogEntry{}, fmt.Errorf("corrupt log entry at %x", k)
+	}
+	e, value, err := splitLogEntry(v)
+	if err != nil {
+		return LogEntry{}, fmt.Errorf("corrupt log entry at %x", k)
+	}
+	e.Seq = binary.BigEndian.Uint64(k)
+	if value != nil {
+		if e.Value, err = s.decodeValue(value, logPlace(e.Seq)); err != nil {
+			return LogEntry{}, fmt.Errorf("corrupt log entry at %x: %w", k, err)
+		}
+	}
+	return e, nil
+}
+
+// splitLogEntry decodes an entry without its value, and returns the encoded value of the ops that have one
+func splitLogEntry(v []byte) (LogEntry, []byte, error) {
+	if len(v) == 0 {
+		return LogEntry{}, nil, fmt.Errorf("empty log entry")
+	}
+	e := LogEntry{Op: Op(v[0] &^ namespaceFlag)}
+	term, n := binary.Uvarint(v[1:])
+	if n <= 0 {
+		return LogEntry{}, nil, fmt.Errorf("corrupt term")
+	}
+	e.Term = term
+	rest := v[1+n:]
+	if v[0]&namespaceFlag != 0 {
+		nsLen, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < nsLen {
+			return LogEntry{}, nil, fmt.Errorf("corrupt namespace")
+		}
+		e.Namespace = string(rest[n : n+int(nsLen)])
+		rest = rest[n+int(nsLen):]
+	}
+	keyLen, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < keyLen {
+		return LogEntry{}, nil, fmt.Errorf("corrupt key")
+	}
+	rest = rest[n:]
+	e.Key = string(rest[:keyLen])
+	if e.Op.hasValue() {
+		return e, rest[keyLen:], nil
+	}
+	return e, nil, nil
+}
+
+// ReadLog returns up to limit entries of the change log starting at fromSeq, in sequence order
+func (db *KVDatabase) ReadLog(fromSeq uint64, limit int) ([]LogEntry, error) {
+	var entries []LogEntry
+	err := db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(logBucket)).Cursor()
+		for k, v := c.Seek(seqKey(fromSeq)); k != nil && len(entries) < limit; k, v = c.Next() {
+			e, err := db.decodeLogEntry(k, v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// TruncateLog removes every entry of the change log up to and including uptoSeq
+func (db *KVDatabase) TruncateLog(uptoSeq uint64) error {
+	return db.update(func(tx *bolt.Tx) error {
+		return truncateLog(tx, uptoSeq)
+	})
+}
+
+func truncateLog(tx *bolt.Tx, uptoSeq uint64) error {
+	bucket := tx.Bucket([]byte(logBucket))
+	var keys [][]byte
+	var last LogEntry
+	c := bucket.Cursor()
+	for k, v := c.First(); k != nil && binary.BigEndian.Uint64(k) <= uptoSeq; k, v = c.Next() {
+		e, _, err := splitLogEntry(v)
+		if err != nil {
+			return fmt.Errorf("corrupt log entry at %x", k)
+		}
+		last = LogEntry{Seq: binary.BigEndian.Uint64(k), Term: e.Term}
+		keys = append(keys, copySlice(k))
+	}
+	for _, k := range keys {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return tx.Bucket([]byte(metaBucket)).Put(truncatedKey, append(seqKey(last.Seq), seqKey(last.Term)...))
+}
+
+// termAt returns the term of the entry at seq, and false when the log no longer or never had it. The
+// position zero, before the first entry, is in every log with the term zero.
+func termAt(tx *bolt.Tx, seq uint64) (uint64, bool, error) {
+	if seq == 0 {
+		return 0, true, nil
+	}
+	if v := tx.Bucket([]byte(logBucket)).Get(seqKey(seq)); v != nil {
+		e, _, err := splitLogEntry(v)
+		if err != nil {
+			return 0, false, fmt.Errorf("corrupt log entry at %d", seq)
+		}
+		return e.Term, true, nil
+	}
+	if v := tx.Bucket([]byte(metaBucket)).Get(truncatedKey); len(v) == 16 && binary.BigEndian.Uint64(v) == seq {
+		return binary.BigEndian.Uint64(v[8:]), true, nil
+	}
+	return 0, false, nil
+}
+
+// TermAt returns the term of the entry of the change log at seq, ok is false when the log does not
+// have it anymore or never had it
+func (db *KVDatabase) TermAt(seq uint64) (term uint64, ok bool, err error) {
+	err = db.db.View(func(tx *bolt.Tx) error {
+		term, ok, err = termAt(tx, seq)
+		return err
+	})
+	return term, ok, err
+}
+
+// LastEntry returns the sequence number and term of the last entry of the change log, the candidates
+// of an election compare them to find the one with the most complete log
+func (db *KVDatabase) LastEntry() (seq, term uint64, err error) {
+	err = db.db.View(func(tx *bolt.Tx) error {
+		seq = tx.Bucket([]byte(logBucket)).Sequence()
+		term, _, err = termAt(tx, seq)
+		return err
+	})
+	return seq, term, err
+}
+
+// AckReplica records that the replica has applied every entry up to seq, and truncates the log up to
+// the lowest position acknowledged by all of the registered replicas. It returns that position.
+func (db *KVDatabase) AckReplica(replica string, seq uint64, registered []string) (uint64, error) {
+	var upto uint64
+	err := db.update(func(tx *bolt.Tx) error {
+		acks := tx.Bucket([]byte(acksBucket))
+		// acknowledgements can arrive out of order, a replica never moves backwards
+		if prev := acks.Get([]byte(replica)); len(prev) != 8 || binary.BigEndian.Uint64(prev) < seq {
+			if err := acks.Put([]byte(replica), seqKey(seq)); err != nil {
+				return err
+			}
+		}
+
+		for i, r := range registered {
+			v := acks.Get([]byte(r))
+			if len(v) != 8 {
+				// this replica has not acknowledged anything yet, nothing can be dropped
+				upto = 0
+				return nil
+			}
+			if acked := binary.BigEndian.Uint64(v); i == 0 || acked < upto {
+				upto = acked
+			}
+		}
+		return truncateLog(tx, upto)
+	})
+	return upto, err
+}
+
+// ReplicaAcks returns the last position acknowledged by each replica
+func (db *KVDatabase) ReplicaAcks() (map[string]uint64, error) {
+	acks := make(map[string]uint64)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(acksBucket)).ForEach(func(k, v []byte) error {
+			if len(v) == 8 {
+				acks[string(k)] = binary.BigEndian.Uint64(v)
+			}
+			return nil
+		})
+	})
+	return acks, err
+}
+
+// LogPosition returns the sequence number of the oldest retained entry and of the last written entry.
+// first is zero when the log is empty.
+func (db *KVDatabase) LogPosition() (first, last uint64, err error) {
+	err = db.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(logBucket))
+		if k, _ := bucket.Cursor().First(); k != nil {
+			first = binary.BigEndian.Uint64(k)
+		}
+		last = bucket.Sequence()
+		return nil
+	})
+	return first, last, err
+}
+
+// ApplyLog applies the entries received from the leader in a single transaction and records the
+// sequence number of the last one, so that the replica knows where to resume from. The entries are
+// also kept in the replica's own log with the leader's numbering and terms, so that it can serve them
+// to the other replicas if it gets promoted. The first entry must follow the last one of the log,
+// entries this node wrote as a leader that the new leader does not have are removed by RollbackLog first.
+func (db *KVDatabase) ApplyLog(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return db.update(func(tx *bolt.Tx) error {
+		logs := tx.Bucket([]byte(logBucket))
+		applied := logs.Sequence()
+		for _, e := range entries {
+			if e.Seq <= applied {
+				continue
+			}
+			if e.Seq != applied+1 {
+				return fmt.Errorf("log gap: expected seq %d, got %d", applied+1, e.Seq)
+			}
+			if err := db.applyEntry(tx, e); err != nil {
+				return err
+			}
+			if err := logs.Put(seqKey(e.Seq), db.encodeLogEntry(e)); err != nil {
+				return err
+			}
+			applied = e.Seq
+		}
+		if err := logs.SetSequence(applied); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(metaBucket)).Put(appliedSeqKey, seqKey(applied))
+	})
+}
+
+func (s *store) applyEntry(tx *bolt.Tx, e LogEntry) error {
+	var err error
+	if e.Namespace != "" && e.Op != OpNamespace {
+		// the namespace is created by an earlier entry, unless that one was truncated before this replica joined
+		_, err = ensureNamespace(tx, e.Namespace)
+	}
+	switch {
+	case err != nil:
+	case e.Op == OpSet:
+		// the version of a value is the sequence number of its write, on the leader and its replicas alike
+		e.Value.Version = e.Seq
+		err = s.putValue(tx, e.Namespace, []byte(e.Key), e.Value)
+	case e.Op == OpDelete:
+		err = deleteValue(tx, e.Namespace, []byte(e.Key))
+	case e.Op == OpNamespace:
+		var quota namespaceQuota
+		if err = json.Unmarshal(e.Value.Data, &quota); err == nil {
+			_, err = configureNamespace(tx, e.Key, quota.MaxKeys, quota.MaxBytes)
+		}
+	case e.Op == OpPrepare:
+		var p PreparedTxn
+		if err = json.Unmarshal(e.Value.Data, &p); err == nil {
+			err = s.putPrepared(tx, p, e.Value.Data)
+		}
+	case e.Op == OpRelease:
+		err = s.resolvePrepared(tx, e.Key, TxnState(e.Value.Data), time.Now())
+	case e.Op == OpTxn:
+		err = tx.Bucket([]byte(txnsBucket)).Put([]byte(e.Key), e.Value.Data)
+	case e.Op == OpForgetTxn:
+		err = tx.Bucket([]byte(txnsBucket)).Delete([]byte(e.Key))
+	default:
+		err = fmt.Errorf("unknown op %q", e.Op)
+	}
+	if err != nil {
+		return fmt.Errorf("error applying seq %d on key %s: %s", e.Seq, e.Key, err)
+	}
+	return nil
+}
+
+// AppliedSeq returns the sequence number of the last leader entry applied on this replica
+func (db *KVDatabase) AppliedSeq() (uint64, error) {
+	var seq uint64
+	err := db.db.View(func(tx *bolt.Tx) error {
+		seq = readSeq(tx, appliedSeqKey)
+		return nil
+	})
+	return seq, err
+}
+
+func readSeq(tx *bolt.Tx, key []byte) uint64 {
+	v := tx.Bucket([]byte(metaBucket)).Get(key)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// ElectionState returns the last election term seen by this node and the candidate it voted for in it
+func (db *KVDatabase) ElectionState() (term uint64, votedFor string, err error) {
+	err = db.db.View(func(tx *bolt.Tx) error {
+		term = readSeq(tx, termKey)
+		votedFor = string(tx.Bucket([]byte(metaBucket)).Get(votedForKey))
+		return nil
+	})
+	return term, votedFor, err
+}
+
+// SaveElectionState persists the election term and vote, so that a restarted node never votes twice in a term
+func (db *KVDatabase) SaveElectionState(term uint64, votedFor string) error {
+	return db.update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucket))
+		if err := meta.Put(termKey, seqKey(term)); err != nil {
+			return err
+		}
+		return meta.Put(votedForKey, []byte(votedFor))
+	})
+}
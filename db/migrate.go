@@ -0,0 +1,110 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+)
+
+// storageFormat is the layout of the stored values and log entries, recorded in the meta bucket under
+// formatKey. Databases without one were written before values were framed: the kv bucket holds the
+// raw bytes of the values, and the changes not yet pulled by the replicas are queued in legacyReplicaBucket.
+const storageFormat uint64 = 1
+
+var formatKey = []byte("format")
+
+// legacyReplicaBucket queued the keys to replicate before the change log
+const legacyReplicaBucket = "replica"
+
+// migrate brings a database written by an older release to storageFormat. It runs in the transaction
+// creating the buckets, so that a crash leaves the database either untouched or fully migrated; a raw
+// value is never read as a framed one.
+func (s *store) migrate(tx *bolt.Tx, fresh bool) error {
+	format := readSeq(tx, formatKey)
+	if fresh || format == storageFormat {
+		return tx.Bucket([]byte(metaBucket)).Put(formatKey, seqKey(storageFormat))
+	}
+	if format > storageFormat {
+		return fmt.Errorf("storage format %d is newer than the supported %d", format, storageFormat)
+	}
+
+	// collected first, a bucket can not be written while it is iterated
+	var keys, values [][]byte
+	data := tx.Bucket([]byte(defaultBucket))
+	if err := data.ForEach(func(k, v []byte) error {
+		keys, values = append(keys, copySlice(k)), append(values, copySlice(v))
+		return nil
+	}); err != nil {
+		return err
+	}
+	for i, k := range keys {
+		if err := data.Put(k, s.encodeValue(Value{Data: values[i]}, dataPlace("", k))); err != nil {
+			return err
+		}
+	}
+	if err := s.migrateLog(tx); err != nil {
+		return err
+	}
+	// the replicas of an older release still miss the queued keys, they get them from the log instead
+	if pending := tx.Bucket([]byte(legacyReplicaBucket)); pending != nil {
+		var queued [][]byte
+		if err := pending.ForEach(func(k, _ []byte) error {
+			queued = append(queued, copySlice(k))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range queued {
+			raw := data.Get(k)
+			if raw == nil {
+				continue
+			}
+			value, err := s.decodeValue(raw, dataPlace("", k))
+			if err != nil {
+				return err
+			}
+			if value.Version, err = s.appendLog(tx, LogEntry{Op: OpSet, Key: string(k), Value: value}); err != nil {
+				return err
+			}
+			if err := s.putValue(tx, "", k, value); err != nil {
+				return err
+			}
+		}
+		if err := tx.DeleteBucket([]byte(legacyReplicaBucket)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(metaBucket)).Put(formatKey, seqKey(storageFormat))
+}
+
+// migrateLog frames the values of the log entries written before the storage format, laid out as
+// op | uvarint(len(key)) | key | raw value
+func (s *store) migrateLog(tx *bolt.Tx) error {
+	logs := tx.Bucket([]byte(logBucket))
+	var keys, entries [][]byte
+	if err := logs.ForEach(func(k, v []byte) error {
+		keys, entries = append(keys, copySlice(k)), append(entries, copySlice(v))
+		return nil
+	}); err != nil {
+		return err
+	}
+	for i, k := range keys {
+		v := entries[i]
+		if len(v) == 0 {
+			return fmt.Errorf("corrupt log entry at %x", k)
+		}
+		keyLen, n := binary.Uvarint(v[1:])
+		if n <= 0 || uint64(len(v)-1-n) < keyLen {
+			return fmt.Errorf("corrupt log entry at %x", k)
+		}
+		rest := v[1+n:]
+		e := LogEntry{Seq: binary.BigEndian.Uint64(k), Op: Op(v[0]), Key: string(rest[:keyLen])}
+		if e.Op == OpSet {
+			e.Value = Value{Data: rest[keyLen:]}
+		}
+		if err := logs.Put(k, s.encodeLogEntry(e)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+)
+
+// namespacesBucket holds the registry of the named namespaces, by name
+const namespacesBucket = "namespaces"
+
+// maxNamespaceLen is the longest namespace name
+const maxNamespaceLen = 64
+
+var (
+	// ErrNoNamespace is returned when a namespace was not created
+	ErrNoNamespace = errors.New("namespace not found")
+	// ErrQuotaExceeded is returned by a write that takes a namespace past one of its quotas
+	ErrQuotaExceeded = errors.New("namespace quota exceeded")
+)
+
+// Namespace is a named set of keys stored in buckets of its own, the keys written without a namespace
+// belong to the default one. Quotas and usage are counted per shard.
+type Namespace struct {
+	Name string `json:"name"`
+	// MaxKeys is the largest number of keys of the namespace, 0 for no limit
+	MaxKeys int64 `json:"maxKeys,omitempty"`
+	// MaxBytes is the largest size of the keys and stored values of the namespace, 0 for no limit
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	// Keys and Bytes are the current usage of the namespace, expired keys count until they are swept
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// namespaceQuota is the part of a namespace recorded in the change log
+type namespaceQuota struct {
+	MaxKeys  int64 `json:"maxKeys,omitempty"`
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+}
+
+// ValidNamespace returns an error when the name can not be used for a namespace: names are made of
+// letters, digits, '-', '_' and '.'
+func ValidNamespace(name string) error {
+	if name == "" || len(name) > maxNamespaceLen {
+		return fmt.Errorf("namespace name must be 1 to %d characters long", maxNamespaceLen)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("invalid character %q in namespace %q", c, name)
+		}
+	}
+	return nil
+}
+
+// dataBucket returns the bucket of the keys of the namespace
+func dataBucket(tx *bolt.Tx, ns string) *bolt.Bucket {
+	return tx.Bucket(namespaceBucketName(defaultBucket, ns))
+}
+
+// expiryIndex returns the expiry index of the namespace
+func expiryIndex(tx *bolt.Tx, ns string) *bolt.Bucket {
+	return tx.Bucket(namespaceBucketName(expiryBucket, ns))
+}
+
+// namespaceBucketName is the name of the bucket of the namespace, name/ns, the default namespace uses
+// the bucket name alone
+func namespaceBucketName(name, ns string) []byte {
+	if ns == "" {
+		return []byte(name)
+	}
+	return []byte(name + "/" + ns)
+}
+
+// lockKey is the key of the locks bucket of a key of the namespace
+func lockKey(ns, key string) []byte {
+	if ns == "" {
+		return []byte(key)
+	}
+	return []byte("\x00" + ns + "\x00" + key)
+}
+
+// Name returns the namespace of the keys read and written through this handle, "" for the default one
+func (db *KVDatabase) Name() string {
+	return db.ns
+}
+
+// Namespace returns a handle on the keys of the namespace, which shares the connection of db. The
+// empty name is the default namespace and ErrNoNamespace is returned when the namespace was not created.
+func (db *KVDatabase) Namespace(name string) (*KVDatabase, error) {
+	if name == "" {
+		return &KVDatabase{store: db.store}, nil
+	}
+	err := db.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(namespacesBucket)).Get([]byte(name)) == nil {
+			return fmt.Errorf("%w: %s", ErrNoNamespace, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &KVDatabase{store: db.store, ns: name}, nil
+}
+
+// CreateNamespace creates the namespace, or updates the quotas of an existing one, and returns it. The
+// change is logged, so that replicas create the namespace too. Lowering a quota below the usage does
+// not delete anything, writes that grow the namespace are refused until it is cleaned up.
+func (db *KVDatabase) CreateNamespace(name string, maxKeys, maxBytes int64) (Namespace, error) {
+	if db.ReadOnly() {
+		return Namespace{}, fmt.Errorf("db is read only")
+	}
+	if err := ValidNamespace(name); err != nil {
+		return Namespace{}, err
+	}
+	if maxKeys < 0 || maxBytes < 0 {
+		return Namespace{}, fmt.Errorf("quotas of namespace %s can not be negative", name)
+	}
+	var n Namespace
+	err := db.update(func(tx *bolt.Tx) error {
+		quota, err := json.Marshal(&namespaceQuota{MaxKeys: maxKeys, MaxBytes: maxBytes})
+		if err != nil {
+			return err
+		}
+		if _, err := db.appendLog(tx, LogEntry{Op: OpNamespace, Key: name, Value: Value{Data: quota}}); err != nil {
+			return err
+		}
+		n, err = configureNamespace(tx, name, maxKeys, maxBytes)
+		return err
+	})
+	return n, err
+}
+
+// Namespaces returns the named namespaces with their usage on this shard, sorted by name
+func (db *KVDatabase) Namespaces() ([]Namespace, error) {
+	var namespaces []Namespace
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(namespacesBucket)).ForEach(func(k, v []byte) error {
+			var n Namespace
+			if err := json.Unmarshal(v, &n); err != nil {
+				return fmt.Errorf("corrupt namespace %s: %w", k, err)
+			}
+			namespaces = append(namespaces, n)
+			return nil
+		})
+	})
+	return namespaces, err
+}
+
+// namespaceNames returns the default namespace followed by the named ones in order
+func namespaceNames(tx *bolt.Tx) []string {
+	names := []string{""}
+	tx.Bucket([]byte(namespacesBucket)).ForEach(func(k, v []byte) error {
+		names = append(names, string(k))
+		return nil
+	})
+	sort.Strings(names[1:])
+	return names
+}
+
+// configureNamespace creates the buckets of the namespace if needed and sets its quotas
+func configureNamespace(tx *bolt.Tx, name string, maxKeys, maxBytes int64) (Namespace, error) {
+	n, err := ensureNamespace(tx, name)
+	if err != nil {
+		return n, err
+	}
+	n.MaxKeys, n.MaxBytes = maxKeys, maxBytes
+	return n, putNamespace(tx, n)
+}
+
+// ensureNamespace creates the buckets and the registry entry of the namespace unless they exist
+func ensureNamespace(tx *bolt.Tx, name string) (Namespace, error) {
+	n, ok, err := readNamespace(tx, name)
+	if err != nil || ok {
+		return n, err
+	}
+	for _, bucket := range []string{defaultBucket, expiryBucket} {
+		if _, err := tx.CreateBucketIfNotExists(namespaceBucketName(bucket, name)); err != nil {
+			return n, fmt.Errorf("error creating bucket %s: %s", namespaceBucketName(bucket, name), err)
+		}
+	}
+	n = Namespace{Name: name}
+	return n, putNamespace(tx, n)
+}
+
+func readNamespace(tx *bolt.Tx, name string) (Namespace, bool, error) {
+	var n Namespace
+	v := tx.Bucket([]byte(namespacesBucket)).Get([]byte(name))
+	if v == nil {
+		return n, false, nil
+	}
+	if err := json.Unmarshal(v, &n); err != nil {
+		return n, false, fmt.Errorf("corrupt namespace %s: %w", name, err)
+	}
+	return n, true, nil
+}
+
+func putNamespace(tx *bolt.Tx, n Namespace) error {
+	b, err := json.Marshal(&n)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(namespacesBucket)).Put([]byte(n.Name), b)
+}
+
+// addUsage adds to the usage of a named namespace, the default namespace is not accounted
+func addUsage(tx *bolt.Tx, ns string, keys, bytes int64) error {
+	if ns == "" || (keys == 0 && bytes == 0) {
+		return nil
+	}
+	n, ok, err := readNamespace(tx, ns)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoNamespace, ns)
+	}
+	n.Keys += keys
+	n.Bytes += bytes
+	return putNamespace(tx, n)
+}
+
+// withinQuota runs the writes of fn and returns ErrQuotaExceeded if they took the namespace past one of
+// its quotas. Writes that do not grow the namespace pass even over the quota, so that it can be cleaned up.
+func withinQuota(tx *bolt.Tx, ns string, fn func() error) error {
+	if ns == "" {
+		return fn()
+	}
+	before, _, err := readNamespace(tx, ns)
+	if err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	after, _, err := readNamespace(tx, ns)
+	if err != nil {
+		return err
+	}
+	return quotaError(before, after)
+}
+
+// quotaError returns ErrQuotaExceeded if the namespace grew from before to after past one of its quotas
+func quotaError(before, after Namespace) error {
+	if after.MaxKeys > 0 && after.Keys > after.MaxKeys && after.Keys > before.Keys {
+		return fmt.Errorf("%w: namespace %s would hold %d keys, its quota is %d", ErrQuotaExceeded, after.Name, after.Keys, after.MaxKeys)
+	}
+	if after.MaxBytes > 0 && after.Bytes > after.MaxBytes && after.Bytes > before.Bytes {
+		return fmt.Errorf("%w: namespace %s would hold %d bytes, its quota is %d", ErrQuotaExceeded, after.Name, after.Bytes, after.MaxBytes)
+	}
+	return nil
+}
+
+// checkPreparedQuota returns ErrQuotaExceeded if committing the operations, together with the transactions
+// already prepared on the namespace, would take it past one of its quotas. Nothing is written.
+func (s *store) checkPreparedQuota(tx *bolt.Tx, ns string, ops []TxnOp) error {
+	if ns == "" {
+		return nil
+	}
+	before, _, err := readNamespace(tx, ns)
+	if err != nil {
+		return err
+	}
+	after := before
+	keys, size := s.opsUsage(tx, ns, ops)
+	after.Keys, after.Bytes = after.Keys+keys, after.Bytes+size
+	err = tx.Bucket([]byte(preparedBucket)).ForEach(func(id, _ []byte) error {
+		p, _, err := s.readPrepared(tx, string(id))
+		if err != nil || p.Namespace != ns {
+			return err
+		}
+		keys, size := s.opsUsage(tx, ns, p.Ops)
+		before.Keys, before.Bytes = before.Keys+keys, before.Bytes+size
+		after.Keys, after.Bytes = after.Keys+keys, after.Bytes+size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return quotaError(before, after)
+}
+
+// opsUsage returns how many keys and bytes applying the operations would add to the namespace, the sizes
+// of the values are those they would have if they were written now
+func (s *store) opsUsage(tx *bolt.Tx, ns string, ops []TxnOp) (int64, int64) {
+	last := make(map[string]TxnOp, len(ops))
+	for _, op := range ops {
+		last[op.Key] = op
+	}
+	version := tx.Bucket([]byte(logBucket)).Sequence() + 1
+	var keys, size int64
+	for key, op := range last {
+		if old := dataBucket(tx, ns).Get([]byte(key)); old != nil {
+			keys, size = keys-1, size-int64(len(key)+len(old))
+		}
+		if !op.Delete {
+			op.Value.Version = version
+			keys, size = keys+1, size+int64(len(key)+len(s.encodeValue(op.Value, dataPlace(ns, []byte(key)))))
+		}
+	}
+	return keys, size
+}
@@ -0,0 +1,384 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+const (
+	// preparedBucket holds the transactions this shard voted to commit, by id
+	preparedBucket = "prepared"
+	// locksBucket maps each key of a prepared transaction to the id of the transaction
+	locksBucket = "locks"
+	// txnsBucket holds the state of the transactions coordinated by this node, by id
+	txnsBucket = "txns"
+	// resolvedBucket holds the outcome of the transactions resolved on this shard and when they were
+	// resolved, by id, until PruneResolvedTxns drops them
+	resolvedBucket = "resolved"
+)
+
+var (
+	// ErrLocked is returned by writes on a key held by a prepared transaction
+	ErrLocked = errors.New("key is locked by a prepared transaction")
+	// ErrUnknownTxn is returned when committing a transaction that was not prepared on this shard
+	ErrUnknownTxn = errors.New("transaction is not prepared on this shard")
+	// ErrTxnOutcome is returned when preparing a transaction that is already resolved, or when resolving
+	// it with the other outcome
+	ErrTxnOutcome = errors.New("transaction was resolved with another outcome")
+)
+
+// PreparedTxn is the part of a cross-shard transaction applied by this shard. Once prepared its keys
+// are locked until the coordinator tells the outcome of the transaction.
+type PreparedTxn struct {
+	ID string `json:"id"`
+	// Namespace is the namespace of the keys of the transaction, "" for the default one
+	Namespace string `json:"namespace,omitempty"`
+	// CoordinatorShard is the shard whose leader decides the outcome, its current leader is asked for it
+	CoordinatorShard int `json:"coordinatorShard"`
+	// Coordinator is the address of the node deciding the outcome of the transactions prepared by older
+	// releases, empty otherwise
+	Coordinator string    `json:"coordinator,omitempty"`
+	Compares    []Compare `json:"compares,omitempty"`
+	Ops         []TxnOp   `json:"ops,omitempty"`
+	PreparedAt  int64     `json:"preparedAt"`
+}
+
+// TxnState is the outcome of a cross-shard transaction
+type TxnState string
+
+const (
+	// TxnPending is the state of a transaction until every shard voted
+	TxnPending TxnState = "pending"
+	// TxnCommitted transactions are applied by every shard
+	TxnCommitted TxnState = "committed"
+	// TxnAborted transactions are dropped by every shard
+	TxnAborted TxnState = "aborted"
+)
+
+// CoordinatedTxn is the state of a transaction coordinated by this node
+type CoordinatedTxn struct {
+	ID    string   `json:"id"`
+	State TxnState `json:"state"`
+	// Shards are the shards that have not been told the outcome yet
+	Shards    []int `json:"shards"`
+	StartedAt int64 `json:"startedAt"`
+}
+
+// checkLock returns ErrLocked when the key of the namespace is held by a prepared transaction
+func checkLock(tx *bolt.Tx, ns, key string) error {
+	if id := tx.Bucket([]byte(locksBucket)).Get(lockKey(ns, key)); id != nil {
+		return fmt.Errorf("%w: key %s is held by transaction %s", ErrLocked, key, id)
+	}
+	return nil
+}
+
+// LockedKeys returns the given keys of the namespace that are held by a prepared transaction, in order
+func (db *KVDatabase) LockedKeys(keys []string) ([]string, error) {
+	var locked []string
+	err := db.db.View(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			if checkLock(tx, db.ns, key) != nil {
+				locked = append(locked, key)
+			}
+		}
+		return nil
+	})
+	return locked, err
+}
+
+// txnKeys returns the keys read or written by the transaction
+func txnKeys(compares []Compare, ops []TxnOp) []string {
+	keys := make([]string, 0, len(compares)+len(ops))
+	for _, c := range compares {
+		keys = append(keys, c.Key)
+	}
+	for _, op := range ops {
+		keys = append(keys, op.Key)
+	}
+	return keys
+}
+
+// Prepare checks the conditions of the transaction and, if they hold, persists it and locks its keys so
+// that it can be committed later whatever happens in between. Preparing a transaction twice is a no-op.
+// The transaction applies to the namespace of db, ErrQuotaExceeded is returned if committing it along
+// with the transactions already prepared there would take the namespace past one of its quotas. The
+// transaction is logged, so that a replica promoted before the outcome is known holds it too.
+func (db *KVDatabase) Prepare(p PreparedTxn) error {
+	if db.ReadOnly() {
+		return fmt.Errorf("db is read only")
+	}
+	p.Namespace = db.ns
+	return db.update(func(tx *bolt.Tx) error {
+		prepared := tx.Bucket([]byte(preparedBucket))
+		if prepared.Get([]byte(p.ID)) != nil {
+			return nil
+		}
+		if state := resolvedState(tx, p.ID); state != "" {
+			return fmt.Errorf("%w: %s is %s", ErrTxnOutcome, p.ID, state)
+		}
+		keys := txnKeys(p.Compares, p.Ops)
+		for _, key := range keys {
+			if err := checkLock(tx, p.Namespace, key); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		for i, c := range p.Compares {
+			if err := db.checkCompare(tx, p.Namespace, c, now); err != nil {
+				return &CompareError{Index: i, Key: c.Key, Err: err}
+			}
+		}
+		if err := db.checkPreparedQuota(tx, p.Namespace, p.Ops); err != nil {
+			return err
+		}
+
+		p.PreparedAt = now.UnixNano()
+		b, err := json.Marshal(&p)
+		if err != nil {
+			return err
+		}
+		if _, err := db.appendLog(tx, LogEntry{Op: OpPrepare, Key: p.ID, Value: Value{Data: b}}); err != nil {
+			return err
+		}
+		return db.putPrepared(tx, p, b)
+	})
+}
+
+// putPrepared persists the prepared transaction, whose encoding is record, and locks its keys
+func (s *store) putPrepared(tx *bolt.Tx, p PreparedTxn, record []byte) error {
+	locks := tx.Bucket([]byte(locksBucket))
+	for _, key := range txnKeys(p.Compares, p.Ops) {
+		if err := locks.Put(lockKey(p.Namespace, key), []byte(p.ID)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(preparedBucket)).Put([]byte(p.ID), s.encodeRecord(record, preparedPlace([]byte(p.ID))))
+}
+
+// CommitPrepared applies the prepared transaction, releases its keys and returns the version of each
+// operation. A transaction committed before returns no versions, ErrTxnOutcome is returned when it was
+// aborted and ErrUnknownTxn when it was never prepared on this shard, or resolved so long ago that its
+// outcome is forgotten.
+func (db *KVDatabase) CommitPrepared(id string) ([]uint64, error) {
+	if db.ReadOnly() {
+		return nil, fmt.Errorf("db is read only")
+	}
+	var versions []uint64
+	err := db.update(func(tx *bolt.Tx) error {
+		p, ok, err := db.readPrepared(tx, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			state := resolvedState(tx, id)
+			switch {
+			case state == "":
+				return fmt.Errorf("%w: %s", ErrUnknownTxn, id)
+			case state != TxnCommitted:
+				return fmt.Errorf("%w: %s is %s", ErrTxnOutcome, id, state)
+			}
+			return nil
+		}
+		if versions, err = db.applyOps(tx, p.Namespace, p.Ops); err != nil {
+			return err
+		}
+		return db.logResolved(tx, id, TxnCommitted)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// AbortPrepared drops the prepared transaction and releases its keys. Aborting a transaction that was
+// not prepared on this shard is a no-op, ErrTxnOutcome is returned when it was committed.
+func (db *KVDatabase) AbortPrepared(id string) error {
+	if db.ReadOnly() {
+		return fmt.Errorf("db is read only")
+	}
+	return db.update(func(tx *bolt.Tx) error {
+		_, ok, err := db.readPrepared(tx, id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if state := resolvedState(tx, id); state == TxnCommitted {
+				return fmt.Errorf("%w: %s is %s", ErrTxnOutcome, id, state)
+			}
+			return nil
+		}
+		return db.logResolved(tx, id, TxnAborted)
+	})
+}
+
+// logResolved logs the outcome of the prepared transaction and releases it
+func (s *store) logResolved(tx *bolt.Tx, id string, state TxnState) error {
+	if _, err := s.appendLog(tx, LogEntry{Op: OpRelease, Key: id, Value: Value{Data: []byte(state)}}); err != nil {
+		return err
+	}
+	return s.resolvePrepared(tx, id, state, time.Now())
+}
+
+// resolvePrepared releases the prepared transaction and remembers its outcome
+func (s *store) resolvePrepared(tx *bolt.Tx, id string, state TxnState, now time.Time) error {
+	p, ok, err := s.readPrepared(tx, id)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if err := releasePrepared(tx, p); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(resolvedBucket)).Put([]byte(id), append(seqKey(uint64(now.UnixNano())), state...))
+}
+
+// resolvedState returns the outcome of a transaction resolved on this shard, "" when it is not known
+func resolvedState(tx *bolt.Tx, id string) TxnState {
+	v := tx.Bucket([]byte(resolvedBucket)).Get([]byte(id))
+	if len(v) < 8 {
+		return ""
+	}
+	return TxnState(v[8:])
+}
+
+// PruneResolvedTxns forgets the outcome of the transactions resolved before the given time and returns
+// how many were forgotten. A coordinator retrying a commit after that gets ErrUnknownTxn.
+func (db *KVDatabase) PruneResolvedTxns(before time.Time) (int, error) {
+	var pruned int
+	err := db.update(func(tx *bolt.Tx) error {
+		resolved := tx.Bucket([]byte(resolvedBucket))
+		var ids [][]byte
+		if err := resolved.ForEach(func(k, v []byte) error {
+			if len(v) < 8 || int64(binary.BigEndian.Uint64(v)) < before.UnixNano() {
+				ids = append(ids, copySlice(k))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := resolved.Delete(id); err != nil {
+				return err
+			}
+		}
+		pruned = len(ids)
+		return nil
+	})
+	return pruned, err
+}
+
+// PreparedTxns returns the transactions prepared on this shard whose outcome is not known yet
+func (db *KVDatabase) PreparedTxns() ([]PreparedTxn, error) {
+	var txns []PreparedTxn
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(preparedBucket)).ForEach(func(k, v []byte) error {
+			var p PreparedTxn
+			record, err := db.decodeRecord(v, preparedPlace(k))
+			if err != nil {
+				return fmt.Errorf("error reading prepared transaction %s: %w", k, err)
+			}
+			if err := json.Unmarshal(record, &p); err != nil {
+				return fmt.Errorf("corrupt prepared transaction %s: %w", k, err)
+			}
+			txns = append(txns, p)
+			return nil
+		})
+	})
+	return txns, err
+}
+
+func (s *store) readPrepared(tx *bolt.Tx, id string) (PreparedTxn, bool, error) {
+	var p PreparedTxn
+	v := tx.Bucket([]byte(preparedBucket)).Get([]byte(id))
+	if v == nil {
+		return p, false, nil
+	}
+	record, err := s.decodeRecord(v, preparedPlace([]byte(id)))
+	if err != nil {
+		return p, false, fmt.Errorf("error reading prepared transaction %s: %w", id, err)
+	}
+	if err := json.Unmarshal(record, &p); err != nil {
+		return p, false, fmt.Errorf("corrupt prepared transaction %s: %w", id, err)
+	}
+	return p, true, nil
+}
+
+func releasePrepared(tx *bolt.Tx, p PreparedTxn) error {
+	locks := tx.Bucket([]byte(locksBucket))
+	for _, key := range txnKeys(p.Compares, p.Ops) {
+		if string(locks.Get(lockKey(p.Namespace, key))) != p.ID {
+			continue
+		}
+		if err := locks.Delete(lockKey(p.Namespace, key)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(preparedBucket)).Delete([]byte(p.ID))
+}
+
+// SaveTxn persists the state of a transaction coordinated by this node. The state is logged, so that
+// the replica that takes over the leadership of the shard finishes the transaction.
+func (db *KVDatabase) SaveTxn(t CoordinatedTxn) error {
+	if db.ReadOnly() {
+		return fmt.Errorf("db is read only")
+	}
+	b, err := json.Marshal(&t)
+	if err != nil {
+		return err
+	}
+	return db.update(func(tx *bolt.Tx) error {
+		if _, err := db.appendLog(tx, LogEntry{Op: OpTxn, Key: t.ID, Value: Value{Data: b}}); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(txnsBucket)).Put([]byte(t.ID), b)
+	})
+}
+
+// LookupTxn returns the state of a transaction coordinated by this node, false once it is forgotten
+func (db *KVDatabase) LookupTxn(id string) (CoordinatedTxn, bool, error) {
+	var t CoordinatedTxn
+	var ok bool
+	err := db.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(txnsBucket)).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(v, &t)
+	})
+	return t, ok, err
+}
+
+// CoordinatedTxns returns the transactions coordinated by this node that are not forgotten yet
+func (db *KVDatabase) CoordinatedTxns() ([]CoordinatedTxn, error) {
+	var txns []CoordinatedTxn
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(txnsBucket)).ForEach(func(k, v []byte) error {
+			var t CoordinatedTxn
+			if err := json.Unmarshal(v, &t); err != nil {
+				return fmt.Errorf("corrupt transaction %s: %w", k, err)
+			}
+			txns = append(txns, t)
+			return nil
+		})
+	})
+	return txns, err
+}
+
+// ForgetTxn drops a coordinated transaction once every shard knows its outcome
+func (db *KVDatabase) ForgetTxn(id string) error {
+	if db.ReadOnly() {
+		return fmt.Errorf("db is read only")
+	}
+	return db.update(func(tx *bolt.Tx) error {
+		if _, err := db.appendLog(tx, LogEntry{Op: OpForgetTxn, Key: id}); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(txnsBucket)).Delete([]byte(id))
+	})
+}
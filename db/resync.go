@@ -0,0 +1,214 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+)
+
+// resyncBucket holds the keys written by the log entries a replica rolled back, until their values
+// are copied from the leader, see RollbackLog
+const resyncBucket = "resync"
+
+// resyncTxnsKey is set in the meta bucket when the log entries a replica rolled back changed the state
+// of the cross-shard transactions, until it is copied from the leader, see ResyncTxns
+var resyncTxnsKey = []byte("resyncTxns")
+
+// KeyRef names a key of a namespace
+type KeyRef struct {
+	// Namespace is the namespace of the key, "" for the default one
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+}
+
+// KeyState is the current state of a key on the leader
+type KeyState struct {
+	KeyRef
+	// Value is nil when the key does not exist
+	Value *Value `json:"value,omitempty"`
+}
+
+func resyncKey(ref KeyRef) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(ref.Namespace)))
+	b = append(b, ref.Namespace...)
+	return append(b, ref.Key...)
+}
+
+func parseResyncKey(k []byte) (KeyRef, error) {
+	nsLen, n := binary.Uvarint(k)
+	if n <= 0 || uint64(len(k)-n) < nsLen {
+		return KeyRef{}, fmt.Errorf("corrupt resync key %x", k)
+	}
+	return KeyRef{Namespace: string(k[n : n+int(nsLen)]), Key: string(k[n+int(nsLen):])}, nil
+}
+
+// LastSeqOfTerm returns the sequence number of the last entry up to uptoSeq written in maxTerm or an
+// earlier term. The terms only grow along a log, so when two logs disagree on an entry they can only
+// agree again on an entry before it with a term no higher than either of theirs. It returns the
+// position before the oldest retained entry when none qualifies.
+func (db *KVDatabase) LastSeqOfTerm(uptoSeq, maxTerm uint64) (uint64, error) {
+	seq := uptoSeq
+	err := db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(logBucket)).Cursor()
+		k, v := c.Seek(seqKey(uptoSeq))
+		if k == nil {
+			k, v = c.Last()
+		} else if binary.BigEndian.Uint64(k) > uptoSeq {
+			k, v = c.Prev()
+		}
+		for ; k != nil; k, v = c.Prev() {
+			e, _, err := splitLogEntry(v)
+			if err != nil {
+				return fmt.Errorf("corrupt log entry at %x", k)
+			}
+			seq = binary.BigEndian.Uint64(k)
+			if e.Term <= maxTerm {
+				return nil
+			}
+			seq--
+		}
+		return nil
+	})
+	return seq, err
+}
+
+// RollbackLog removes the entries of the change log after afterSeq, written by this node as a leader
+// but never received by the leader elected after it. Their keys are recorded in the resync bucket,
+// until Resync replaces them with their values on the new leader; the later entries of the new leader
+// are applied over them. The namespaces created by the removed entries are kept. When the entries
+// prepared or resolved transactions, the transactions are flagged to be copied by ResyncTxns. It
+// returns the number of removed entries.
+func (db *KVDatabase) RollbackLog(afterSeq uint64) (int, error) {
+	var removed int
+	err := db.update(func(tx *bolt.Tx) error {
+		if _, ok, err := termAt(tx, afterSeq); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("log entry %d is truncated, the log can not be rolled back to it", afterSeq)
+		}
+		logs := tx.Bucket([]byte(logBucket))
+		resync := tx.Bucket([]byte(resyncBucket))
+		var keys [][]byte
+		c := logs.Cursor()
+		for k, v := c.Seek(seqKey(afterSeq + 1)); k != nil; k, v = c.Next() {
+			e, _, err := splitLogEntry(v)
+			if err != nil {
+				return fmt.Errorf("corrupt log entry at %x", k)
+			}
+			switch e.Op {
+			case OpSet, OpDelete:
+				if err := resync.Put(resyncKey(KeyRef{Namespace: e.Namespace, Key: e.Key}), []byte{}); err != nil {
+					return err
+				}
+			case OpPrepare, OpRelease, OpTxn, OpForgetTxn:
+				if err := tx.Bucket([]byte(metaBucket)).Put(resyncTxnsKey, []byte{1}); err != nil {
+					return err
+				}
+			}
+			keys = append(keys, copySlice(k))
+		}
+		for _, k := range keys {
+			if err := logs.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		if err := logs.SetSequence(afterSeq); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(metaBucket)).Put(appliedSeqKey, seqKey(afterSeq))
+	})
+	return removed, err
+}
+
+// ResyncKeys returns up to limit keys recorded by RollbackLog that still have to be copied from the leader
+func (db *KVDatabase) ResyncKeys(limit int) ([]KeyRef, error) {
+	var refs []KeyRef
+	err := db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(resyncBucket)).Cursor()
+		for k, _ := c.First(); k != nil && len(refs) < limit; k, _ = c.Next() {
+			ref, err := parseResyncKey(k)
+			if err != nil {
+				return err
+			}
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// Resync stores the states of the keys read on the leader, as they are and without logging them, and
+// removes the keys from the ones to resync
+func (db *KVDatabase) Resync(states []KeyState) error {
+	return db.update(func(tx *bolt.Tx) error {
+		resync := tx.Bucket([]byte(resyncBucket))
+		for _, s := range states {
+			var err error
+			switch {
+			case s.Value == nil && dataBucket(tx, s.Namespace) == nil:
+				// the namespace was only created by the rolled back entries
+			case s.Value == nil:
+				err = deleteValue(tx, s.Namespace, []byte(s.Key))
+			case s.Namespace != "":
+				if _, err = ensureNamespace(tx, s.Namespace); err == nil {
+					err = db.putValue(tx, s.Namespace, []byte(s.Key), *s.Value)
+				}
+			default:
+				err = db.putValue(tx, s.Namespace, []byte(s.Key), *s.Value)
+			}
+			if err != nil {
+				return fmt.Errorf("error resyncing key %s: %w", s.Key, err)
+			}
+			if err := resync.Delete(resyncKey(s.KeyRef)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TxnsToResync reports whether the state of the cross-shard transactions must be copied from the leader
+func (db *KVDatabase) TxnsToResync() (bool, error) {
+	var pending bool
+	err := db.db.View(func(tx *bolt.Tx) error {
+		pending = tx.Bucket([]byte(metaBucket)).Get(resyncTxnsKey) != nil
+		return nil
+	})
+	return pending, err
+}
+
+// ResyncTxns replaces the prepared and coordinated transactions with the ones read on the leader,
+// without logging them
+func (db *KVDatabase) ResyncTxns(prepared []PreparedTxn, coordinated []CoordinatedTxn) error {
+	return db.update(func(tx *bolt.Tx) error {
+		for _, name := range []string{preparedBucket, locksBucket, txnsBucket} {
+			if err := tx.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		for _, p := range prepared {
+			b, err := json.Marshal(&p)
+			if err != nil {
+				return err
+			}
+			if err := db.putPrepared(tx, p, b); err != nil {
+				return err
+			}
+		}
+		for _, t := range coordinated {
+			b, err := json.Marshal(&t)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte(txnsBucket)).Put([]byte(t.ID), b); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte(metaBucket)).Delete(resyncTxnsKey)
+	})
+}
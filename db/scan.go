@@ -0,0 +1,54 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// Scan returns up to limit live key value pairs with start <= key < end in key order, an empty end
+// scans to the last key
+func (db *KVDatabase) Scan(start, end string, limit int) ([]KeyValue, error) {
+	var pairs []KeyValue
+	err := db.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		c := dataBucket(tx, db.ns).Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil && len(pairs) < limit; k, v = c.Next() {
+			if end != "" && bytes.Compare(k, []byte(end)) >= 0 {
+				break
+			}
+			value, err := db.decodeValue(v, dataPlace(db.ns, k))
+			if err != nil {
+				return fmt.Errorf("error reading key %s: %w", k, err)
+			}
+			if value.Expired(now) {
+				continue
+			}
+			pairs = append(pairs, KeyValue{Key: string(k), Value: value})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
+
+// Prefix returns up to limit live key value pairs whose key starts with prefix, in key order
+func (db *KVDatabase) Prefix(prefix string, limit int) ([]KeyValue, error) {
+	return db.Scan(prefix, PrefixEnd(prefix), limit)
+}
+
+// PrefixEnd returns the smallest key greater than every key starting with prefix, or "" when there
+// is none and a scan must run to the last key
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// Compare is a condition of a transaction on the state of a key before the transaction
+type Compare struct {
+	Key string
+	Condition
+	// IfValue only matches when the key exists with this data, nil matches any value
+	IfValue []byte
+}
+
+// TxnOp is a write of a transaction, the key is deleted when Delete is set and set to Value otherwise
+type TxnOp struct {
+	Key    string
+	Delete bool
+	Value  Value
+}
+
+// CompareError reports the condition of a transaction that did not hold
+type CompareError struct {
+	// Index is the position of the condition in the transaction
+	Index int
+	Key   string
+	Err   error
+}
+
+func (e *CompareError) Error() string {
+	return fmt.Sprintf("condition %d on key %q failed: %v", e.Index, e.Key, e.Err)
+}
+
+func (e *CompareError) Unwrap() error {
+	return e.Err
+}
+
+// Txn applies the operations in a single transaction if every condition holds, and returns a
+// *CompareError for the first one that does not, in which case nothing is written. The operations are
+// applied in order and are all checked against the state before the transaction. The version of each
+// set is returned, deletes have version 0.
+func (db *KVDatabase) Txn(compares []Compare, ops []TxnOp) ([]uint64, error) {
+	if db.ReadOnly() {
+		return nil, fmt.Errorf("db is read only")
+	}
+	var versions []uint64
+	err := db.update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		for i, c := range compares {
+			if err := db.checkCompare(tx, db.ns, c, now); err != nil {
+				return &CompareError{Index: i, Key: c.Key, Err: err}
+			}
+		}
+		for _, key := range txnKeys(compares, ops) {
+			if err := checkLock(tx, db.ns, key); err != nil {
+				return err
+			}
+		}
+		return withinQuota(tx, db.ns, func() error {
+			var err error
+			versions, err = db.applyOps(tx, db.ns, ops)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// applyOps applies the operations on the keys of the namespace in order and returns the version of each set
+func (s *store) applyOps(tx *bolt.Tx, ns string, ops []TxnOp) ([]uint64, error) {
+	versions := make([]uint64, len(ops))
+	for i, op := range ops {
+		if op.Delete {
+			if err := deleteValue(tx, ns, []byte(op.Key)); err != nil {
+				return nil, fmt.Errorf("error deleting from bucket %s: %s", defaultBucket, err)
+			}
+			if _, err := s.appendLog(tx, LogEntry{Op: OpDelete, Namespace: ns, Key: op.Key}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		seq, err := s.appendLog(tx, LogEntry{Op: OpSet, Namespace: ns, Key: op.Key, Value: op.Value})
+		if err != nil {
+			return nil, err
+		}
+		op.Value.Version = seq
+		if err := s.putValue(tx, ns, []byte(op.Key), op.Value); err != nil {
+			return nil, fmt.Errorf("error writing to bucket %s: %s", defaultBucket, err)
+		}
+		versions[i] = seq
+	}
+	return versions, nil
+}
+
+func (s *store) checkCompare(tx *bolt.Tx, ns string, c Compare, now time.Time) error {
+	h, exists, err := currentHeader(tx, ns, []byte(c.Key), now)
+	if err != nil {
+		return err
+	}
+	if err := c.Condition.check(h, exists); err != nil {
+		return err
+	}
+	if c.IfValue == nil {
+		return nil
+	}
+	if !exists {
+		return ErrValueMismatch
+	}
+	value, err := s.decodeValue(dataBucket(tx, ns).Get([]byte(c.Key)), dataPlace(ns, []byte(c.Key)))
+	if err != nil {
+		return fmt.Errorf("error reading key %s: %w", c.Key, err)
+	}
+	if !bytes.Equal(value.Data, c.IfValue) {
+		return ErrValueMismatch
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// valueFormat is the first byte of every value stored in the clear, so that the encoding can evolve.
+// Format 1 values have no expiry and format 2 values no version, encrypted values have encryptedFormat
+// or legacyEncryptedFormat.
+const valueFormat byte = 3
+
+// Value is a stored value and the metadata kept along with it
+type Value struct {
+	Data        []byte `json:"data"`
+	ContentType string `json:"contentType,omitempty"`
+	// ExpiresAt is the unix time in nanoseconds after which the key is treated as absent, 0 if it never expires
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// Version is the change log sequence number of the write that stored the value, it is assigned
+	// by the database and increases with every write of the shard
+	Version uint64 `json:"version,omitempty"`
+}
+
+// Expired reports whether the value has expired at the given time
+func (v Value) Expired(now time.Time) bool {
+	return v.ExpiresAt != 0 && v.ExpiresAt <= now.UnixNano()
+}
+
+// header is the metadata at the start of a stored value
+type header struct {
+	expiresAt int64
+	version   uint64
+}
+
+func (h header) expired(now time.Time) bool {
+	return h.expiresAt != 0 && h.expiresAt <= now.UnixNano()
+}
+
+// encodePlainValue encodes the value in the clear as valueFormat | uvarint(expiresAt) | uvarint(version) |
+// uvarint(len(contentType)) | contentType | data
+func encodePlainValue(v Value) []byte {
+	b := make([]byte, 1, 1+3*binary.MaxVarintLen64+len(v.ContentType)+len(v.Data))
+	b[0] = valueFormat
+	b = binary.AppendUvarint(b, uint64(v.ExpiresAt))
+	b = binary.AppendUvarint(b, v.Version)
+	b = binary.AppendUvarint(b, uint64(len(v.ContentType)))
+	b = append(b, v.ContentType...)
+	return append(b, v.Data...)
+}
+
+// decodePlainValue decodes a value stored in the clear, the data is copied out of b
+func decodePlainValue(b []byte) (Value, error) {
+	v, err := viewPlainValue(b)
+	v.Data = copySlice(v.Data)
+	return v, err
+}
+
+// viewPlainValue decodes a value stored in the clear, the data is a slice of b
+func viewPlainValue(b []byte) (Value, error) {
+	h, rest, err := decodeHeader(b)
+	if err != nil {
+		return Value{}, err
+	}
+	typeLen, n := binary.Uvarint(rest)
+	if n <= 0 || uint64(len(rest)-n) < typeLen {
+		return Value{}, fmt.Errorf("corrupt value")
+	}
+	rest = rest[n:]
+	return Value{
+		ContentType: string(rest[:typeLen]),
+		Data:        rest[typeLen:],
+		ExpiresAt:   h.expiresAt,
+		Version:     h.version,
+	}, nil
+}
+
+// decodeHeader returns the metadata of a stored value without decoding the rest of it
+func decodeHeader(b []byte) (header, []byte, error) {
+	if len(b) == 0 {
+		return header{}, nil, fmt.Errorf("corrupt value")
+	}
+	format, rest := b[0], b[1:]
+	if format < 1 || format > encryptedFormat {
+		return header{}, nil, fmt.Errorf("unknown value format %d", format)
+	}
+	var h header
+	if format >= 2 {
+		v, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return header{}, nil, fmt.Errorf("corrupt value")
+		}
+		h.expiresAt, rest = int64(v), rest[n:]
+	}
+	if format >= 3 {
+		v, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return header{}, nil, fmt.Errorf("corrupt value")
+		}
+		h.version, rest = v, rest[n:]
+	}
+	return h, rest, nil
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrCompacted is returned when the changes from a revision were already dropped from the change log
+var ErrCompacted = errors.New("revision compacted")
+
+// update runs fn in a read-write transaction and wakes up the watchers of the database once it is committed
+func (db *KVDatabase) update(fn func(tx *bolt.Tx) error) error {
+	if err := db.db.Update(fn); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	close(db.changed)
+	db.changed = make(chan struct{})
+	db.mu.Unlock()
+	return nil
+}
+
+// Changes returns a channel that is closed after the next write. Callers take the channel before reading
+// the change log so that a write committed in between is not missed.
+func (db *KVDatabase) Changes() <-chan struct{} {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.changed
+}
+
+// ReadChanges returns up to limit entries of the change log starting at the revision fromSeq, and
+// ErrCompacted when some of the entries from fromSeq were already truncated. The value of a set carries
+// its version, which is the revision of the entry.
+func (db *KVDatabase) ReadChanges(fromSeq uint64, limit int) ([]LogEntry, error) {
+	if fromSeq == 0 {
+		fromSeq = 1
+	}
+	var entries []LogEntry
+	err := db.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(logBucket))
+		if fromSeq > bucket.Sequence() {
+			return nil
+		}
+		c := bucket.Cursor()
+		if first, _ := c.First(); first == nil || binary.BigEndian.Uint64(first) > fromSeq {
+			return ErrCompacted
+		}
+		for k, v := c.Seek(seqKey(fromSeq)); k != nil && len(entries) < limit; k, v = c.Next() {
+			e, err := db.decodeLogEntry(k, v)
+			if err != nil {
+				return err
+			}
+			if e.Op == OpSet {
+				e.Value.Version = e.Seq
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"flag"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/auth"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/certs"
 	kvConf "github.com/Vignesh-Rajarajan/distributed-kv-store/config"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/consensus"
 	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/membership"
 	"github.com/Vignesh-Rajarajan/distributed-kv-store/replication"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/reshard"
 	"github.com/Vignesh-Rajarajan/distributed-kv-store/web"
 	"log"
 	"net/http"
@@ -19,6 +24,13 @@ var (
 	configFile = flag.String("config-file", "sharding.toml", "shard config file location")
 	shardID    = flag.String("shard", "", "shard id")
 	replica    = flag.Bool("replica", false, "read-only replica")
+	failover   = flag.Bool("failover", true, "elect a new shard leader when the current one fails, requires replicas in the config")
+	batchSize  = flag.Int("replication-batch-size", replication.DefaultBatchSize, "number of changes a replica fetches per round trip")
+	redirects  = flag.Bool("redirect-clients", false, "answer client requests for another shard with a 307 to its leader instead of proxying them")
+	maxValue   = flag.Int64("max-value-size", web.DefaultMaxValueSize, "largest value in bytes accepted by writes")
+	authFile   = flag.String("auth-file", "", "credentials file, requests must be authenticated when it is set")
+	keyFile    = flag.String("encryption-key-file", "", "keys encrypting the values at rest, "+db.KeysEnv+" is used when it is not set")
+	restore    = flag.String("restore", "", "backup file taken from /admin/backup to create the database at db-location from, the node exits once it is restored")
 )
 
 // parseFlags parses the command line flags
@@ -28,6 +40,9 @@ func parseFlags() {
 	if *dbLocation == "" {
 		log.Fatal("db location is missing")
 	}
+	if *restore != "" {
+		return
+	}
 	if *httpAddr == "" {
 		log.Fatal("http address is empty")
 	}
@@ -42,46 +57,195 @@ func main() {
 	done := make(chan bool, 1)
 	sig := make(chan os.Signal, 1)
 	// Notify on specific signals
-	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	// SIGHUP reloads the shard config instead of stopping the node
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
 	parseFlags()
+	if *restore != "" {
+		info, err := db.Restore(*restore, *dbLocation)
+		if err != nil {
+			log.Fatal("error restoring backup: ", err)
+		}
+		log.Printf("restored %s to %s at seq %d, a replica started from it resumes replication after it", *restore, *dbLocation, info.Seq)
+		return
+	}
 	log.Println("Starting application with flags:", "db-location:", *dbLocation, "http-addr:", *httpAddr, "config-file:", *configFile, "shard:", *shardID, "replica:", *replica)
 	c, err := kvConf.ParseShardConfig(*configFile)
 	if err != nil {
 		log.Fatal("error parsing config file: ", err)
 	}
-	shardMeta, err := kvConf.ParseShardMetadata(c.AvailableShard, *shardID)
+	shardMeta, err := kvConf.NewShardMetadata(c, *shardID)
 	if err != nil {
 		log.Fatal("error parsing shard metadata: ", err)
 	}
 
-	inMemDb, err := db.NewDatabase(*dbLocation, *replica)
+	// with failover every member of the shard starts read-only, the leader is promoted once elected
+	withFailover := *failover && len(shardMeta.ReplicasOf(shardMeta.CurrentShard())) > 0
+	keys, err := db.LoadKeyring(*keyFile)
+	if err != nil {
+		log.Fatal("error loading encryption keys: ", err)
+	}
+	var dbOpts []db.Option
+	if keys != nil {
+		log.Println("encrypting values at rest with key ", keys.Current())
+		dbOpts = append(dbOpts, db.WithEncryption(keys))
+	}
+	inMemDb, err := db.NewDatabase(*dbLocation, *replica || withFailover, dbOpts...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if !*replica {
+	opts := []web.Option{web.WithMaxValueSize(*maxValue)}
+	if *redirects {
+		opts = append(opts, web.WithClientRedirects())
+	}
+	// tlsCerts serves TLS and connects to the other nodes with mutual TLS
+	var tlsCerts *certs.Reloader
+	if c.TLS.Enabled() {
+		if tlsCerts, err = certs.NewReloader(c.TLS); err != nil {
+			log.Fatal("error loading tls config: ", err)
+		}
+		go tlsCerts.Run(done, certs.DefaultReloadInterval)
+		opts = append(opts, web.WithTLS(tlsCerts))
+	}
+	// nodeCred authenticates the calls to the other nodes, replicaCred the replication from the leader
+	var nodeCred, replicaCred *auth.Credential
+	if *authFile != "" {
+		authConf, err := auth.LoadConfig(*authFile)
+		if err != nil {
+			log.Fatal("error parsing auth file: ", err)
+		}
+		authenticator, err := auth.NewAuthenticator(authConf.Credentials)
+		if err != nil {
+			log.Fatal("error loading credentials: ", err)
+		}
+		if nodeCred, err = authConf.Credential(authConf.Node); err != nil {
+			log.Fatal("node credential: ", err)
+		}
+		replicaCred = nodeCred
+		if authConf.Replication != "" {
+			if replicaCred, err = authConf.Credential(authConf.Replication); err != nil {
+				log.Fatal("replication credential: ", err)
+			}
+		}
+		opts = append(opts, web.WithAuth(authenticator, nodeCred))
+	}
+	var client *replication.Client
+	if *replica || withFailover {
 		log.Println("starting replication")
-		leaderAddr, ok := shardMeta.Addrs[shardMeta.CurrIdx]
-		if !ok {
-			log.Fatalf("leader address not found for shard id: %v", shardMeta.CurrIdx)
+		leaderAddr := shardMeta.Leader(shardMeta.CurrentShard())
+		if leaderAddr == "" {
+			log.Fatalf("leader address not found for shard id: %v", shardMeta.CurrentShard())
 		}
 		log.Println("leader address: ", leaderAddr)
 
 		// Start replication in a separate goroutine
-		go replication.SyncMasterAndReplica(inMemDb, leaderAddr, done)
+		client = replication.NewClient(inMemDb, leaderAddr, *httpAddr, *batchSize)
+		if tlsCerts != nil {
+			client.SetTLS(tlsCerts)
+		}
+		if replicaCred != nil {
+			client.SetCredential(replicaCred)
+		}
+		go client.Run(done)
+		opts = append(opts, web.WithStaleness(client.Staleness))
 	}
+	go inMemDb.RunSweeper(done, db.DefaultSweepInterval, db.DefaultSweepBatchSize)
 	// Initialize and start the server
-	server := web.NewServer(inMemDb, shardMeta)
-	http.HandleFunc("/get", server.GetHandler)
-	http.HandleFunc("/set", server.SetHandler)
-	http.HandleFunc("/purge", server.DeleteKeysHandler)
-	http.HandleFunc("/replicate", server.ReplicateHandler)
-	http.HandleFunc("/deleteReplica", server.DeleteReplicaHandler)
+	server := web.NewServer(inMemDb, shardMeta, opts...)
+	if withFailover {
+		node, err := consensus.NewNode(*httpAddr, shardMeta.CurrentShard(), inMemDb, shardMeta)
+		if err != nil {
+			log.Fatal(err)
+		}
+		node.OnFollower = client.SetLeader
+		node.Credential = nodeCred
+		node.TLS = tlsCerts
+		http.HandleFunc("/raft/vote", server.Authorize(auth.RoleReplication, node.VoteHandler))
+		http.HandleFunc("/raft/heartbeat", server.Authorize(auth.RoleReplication, node.HeartbeatHandler))
+		go node.Run(done)
+	}
+	go server.RunTxnRecovery(done, web.DefaultTxnRecoveryInterval)
+	http.HandleFunc(web.KeysPrefix, server.AuthorizeMethod(server.KeysHandler))
+	http.HandleFunc("/scan", server.Authorize(auth.RoleRead, server.ScanHandler))
+	http.HandleFunc("/watch", server.Authorize(auth.RoleRead, server.WatchHandler))
+	http.HandleFunc("/mget", server.Authorize(auth.RoleRead, server.MGetHandler))
+	http.HandleFunc("/mset", server.Authorize(auth.RoleWrite, server.MSetHandler))
+	http.HandleFunc("/mdelete", server.Authorize(auth.RoleWrite, server.MDeleteHandler))
+	http.HandleFunc("/incr", server.Authorize(auth.RoleWrite, server.IncrHandler))
+	http.HandleFunc("/decr", server.Authorize(auth.RoleWrite, server.DecrHandler))
+	http.HandleFunc("/txn", server.Authorize(auth.RoleWrite, server.TxnHandler))
+	http.HandleFunc("/txn/prepare", server.Authorize(auth.RoleReplication, server.PrepareHandler))
+	http.HandleFunc("/txn/commit", server.Authorize(auth.RoleReplication, server.CommitHandler))
+	http.HandleFunc("/txn/abort", server.Authorize(auth.RoleReplication, server.AbortHandler))
+	http.HandleFunc("/txn/status", server.Authorize(auth.RoleReplication, server.TxnStatusHandler))
+	http.HandleFunc("/admin/namespaces", server.Authorize(auth.RoleAdmin, server.NamespacesHandler))
+	http.HandleFunc(web.NamespacesPrefix, server.Authorize(auth.RoleAdmin, server.NamespacesHandler))
+	http.HandleFunc("/admin/backup", server.Authorize(auth.RoleAdmin, server.BackupHandler))
+	// legacy endpoints, kept for existing clients
+	http.HandleFunc("/get", server.Authorize(auth.RoleRead, server.GetHandler))
+	http.HandleFunc("/set", server.Authorize(auth.RoleWrite, server.SetHandler))
+	http.HandleFunc("/delete", server.Authorize(auth.RoleWrite, server.DeleteHandler))
+	http.HandleFunc("/purge", server.Authorize(auth.RoleAdmin, server.DeleteKeysHandler))
+	http.HandleFunc("/replicate", server.Authorize(auth.RoleReplication, server.ReplicateHandler))
+	http.HandleFunc("/deleteReplica", server.Authorize(auth.RoleReplication, server.DeleteReplicaHandler))
+	http.HandleFunc("/resync", server.Authorize(auth.RoleReplication, server.ResyncHandler))
+	http.HandleFunc("/replicationStatus", server.Authorize(auth.RoleReplication, server.ReplicationStatusHandler))
+	http.HandleFunc("/raft/leader", server.Authorize(auth.RoleReplication, server.LeaderHandler))
+
+	members := membership.NewService(shardMeta, *configFile, *httpAddr)
+	if tlsCerts != nil {
+		members.SetTLS(tlsCerts)
+	}
+	if nodeCred != nil {
+		members.SetCredential(nodeCred)
+	}
+	http.HandleFunc("/cluster/shards", server.Authorize(auth.RoleAdmin, members.ShardsHandler))
+	http.HandleFunc("/cluster/gossip", server.Authorize(auth.RoleReplication, members.GossipHandler))
+	go members.Run(done)
+	go func() {
+		for range reload {
+			log.Println("reloading shard config")
+			if err := members.Reload(); err != nil {
+				log.Println("error reloading shard config: ", err)
+			}
+			if tlsCerts != nil {
+				if err := tlsCerts.Reload(); err != nil {
+					log.Println("error reloading certificates: ", err)
+				}
+			}
+		}
+	}()
+
+	migrator, err := reshard.NewMigrator(inMemDb, shardMeta)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsCerts != nil {
+		migrator.SetTLS(tlsCerts)
+	}
+	if nodeCred != nil {
+		migrator.SetCredential(nodeCred)
+	}
+	migrator.Resume(done)
+	http.HandleFunc("/reshard/start", server.Authorize(auth.RoleAdmin, migrator.StartHandler(done)))
+	http.HandleFunc("/reshard/status", server.Authorize(auth.RoleAdmin, migrator.StatusHandler))
+	http.HandleFunc("/reshard/receive", server.Authorize(auth.RoleReplication, migrator.ReceiveHandler))
 
 	// Start the server in a separate goroutine
 	go func() {
 		log.Println("server started on ", *httpAddr)
-		if err := http.ListenAndServe(*httpAddr, nil); err != nil {
+		srv := &http.Server{Addr: *httpAddr}
+		var err error
+		if tlsCerts == nil {
+			err = srv.ListenAndServe()
+		} else {
+			// the certificates come from the reloader, not from files given here
+			srv.TLSConfig = tlsCerts.ServerConfig()
+			err = srv.ListenAndServeTLS("", "")
+		}
+		if err != nil {
 			log.Fatalf("HTTP server ListenAndServe: %v", err)
 		}
 	}()
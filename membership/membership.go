@@ -0,0 +1,209 @@
+package membership
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/auth"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/certs"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/config"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// DefaultGossipInterval is how often a node exchanges its shard map with a random peer
+const DefaultGossipInterval = 5 * time.Second
+
+// Service keeps the shard map of the node up to date without restarting it. A new map is applied
+// locally by Reload or the admin API, pushed to every node of the cluster, and periodic gossip with
+// a random peer lets nodes that missed the push catch up. Between two maps the one with the higher
+// version wins, so two different maps published concurrently with the same version are not merged:
+// publish the next change from a node that already has the latest map.
+type Service struct {
+	meta       *config.ShardMetadata
+	configFile string
+	self       string
+	client     *http.Client
+	// scheme is https once SetTLS was called
+	scheme string
+
+	GossipInterval time.Duration
+}
+
+// NewService creates the membership service of the node listening on self, configFile is the shard
+// config re-read by Reload
+func NewService(meta *config.ShardMetadata, configFile, self string) *Service {
+	return &Service{
+		meta:           meta,
+		configFile:     configFile,
+		self:           self,
+		client:         &http.Client{Timeout: 5 * time.Second},
+		scheme:         "http",
+		GossipInterval: DefaultGossipInterval,
+	}
+}
+
+// SetTLS gossips and pushes the shard map over mutual TLS with the certificates of the node. It must be
+// called before SetCredential and Run.
+func (s *Service) SetTLS(certs *certs.Reloader) {
+	s.scheme = "https"
+	s.client.Transport = certs.Transport()
+}
+
+// SetCredential authenticates the gossip and the pushes of the shard map with the credential of the
+// node. It must be called before Run.
+func (s *Service) SetCredential(cred *auth.Credential) {
+	s.client.Transport = auth.NewTransport(s.client.Transport, cred)
+}
+
+// Reload re-reads the config file and publishes it as the next version of the shard map, unless the
+// file carries a higher version itself
+func (s *Service) Reload() error {
+	c, err := config.ParseShardConfig(s.configFile)
+	if err != nil {
+		return err
+	}
+	if current := s.meta.Version(); c.Version <= current {
+		c.Version = current + 1
+	}
+	return s.Publish(c)
+}
+
+// Publish applies the shard map locally and pushes it to the nodes of both the previous and the new map
+func (s *Service) Publish(c config.ShardConfig) error {
+	previous := s.meta.AllAddrs()
+	applied, err := s.meta.Update(c)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return fmt.Errorf("shard map version %d is not newer than %d", c.Version, s.meta.Version())
+	}
+	log.Printf("applied shard map version %d", c.Version)
+
+	seen := map[string]bool{s.self: true}
+	for _, addr := range append(previous, s.meta.AllAddrs()...) {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		go func(addr string) {
+			if err := s.exchange(addr); err != nil {
+				log.Printf("error pushing shard map to %s: %v", addr, err)
+			}
+		}(addr)
+	}
+	return nil
+}
+
+// Run gossips the shard map with a random peer until done is closed
+func (s *Service) Run(done chan bool) {
+	ticker := time.NewTicker(s.GossipInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		var peers []string
+		for _, addr := range s.meta.AllAddrs() {
+			if addr != s.self {
+				peers = append(peers, addr)
+			}
+		}
+		if len(peers) == 0 {
+			continue
+		}
+		peer := peers[rand.Intn(len(peers))]
+		if err := s.exchange(peer); err != nil {
+			log.Printf("error gossiping shard map with %s: %v", peer, err)
+		}
+	}
+}
+
+// exchange sends the local shard map to addr and applies the map it answers with if it is newer
+func (s *Service) exchange(addr string) error {
+	body, err := json.Marshal(s.meta.Config())
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.scheme+"://"+addr+"/cluster/gossip", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var theirs config.ShardConfig
+	if err := json.NewDecoder(resp.Body).Decode(&theirs); err != nil {
+		return fmt.Errorf("error decoding shard map: %w", err)
+	}
+	return s.merge(theirs)
+}
+
+// merge applies a shard map received from a peer if it is newer than the local one
+func (s *Service) merge(c config.ShardConfig) error {
+	applied, err := s.meta.Update(c)
+	if err != nil {
+		return fmt.Errorf("shard map version %d: %w", c.Version, err)
+	}
+	if applied {
+		log.Printf("applied shard map version %d", c.Version)
+	}
+	return nil
+}
+
+// GossipHandler merges the shard map of a peer and answers with the local one, so that whichever
+// side is behind catches up
+func (s *Service) GossipHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("shard maps must be sent with POST"))
+		return
+	}
+	var c config.ShardConfig
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := s.merge(c); err != nil {
+		// the local shard is not part of the map, keep serving with the current one
+		log.Println(err)
+	}
+	json.NewEncoder(w).Encode(s.meta.Config())
+}
+
+// ShardsHandler serves the current shard map on GET and publishes a new one on PUT or POST. A new
+// map without a version gets the next one, a map whose version is not newer is rejected.
+func (s *Service) ShardsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var c config.ShardConfig
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if c.Version == 0 {
+			c.Version = s.meta.Version() + 1
+		}
+		if c.Version <= s.meta.Version() {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(fmt.Sprintf("shard map version %d is not newer than %d", c.Version, s.meta.Version())))
+			return
+		}
+		if err := s.Publish(c); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(s.meta.Config())
+}
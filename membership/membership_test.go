@@ -0,0 +1,112 @@
+package membership_test
+
+import (
+	"encoding/json"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/config"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/membership"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	meta    *config.ShardMetadata
+	service *membership.Service
+	server  *httptest.Server
+}
+
+func startCluster(t *testing.T, names ...string) ([]*testNode, []config.Shard) {
+	nodes := make([]*testNode, len(names))
+	shards := make([]config.Shard, len(names))
+	for i, name := range names {
+		nodes[i] = &testNode{server: httptest.NewUnstartedServer(nil)}
+		shards[i] = config.Shard{ShardId: i, Name: name, Address: nodes[i].server.Listener.Addr().String()}
+	}
+	for i, n := range nodes {
+		meta, err := config.ParseShardMetadata(shards, names[i], 0)
+		assert.NoError(t, err)
+		n.meta = meta
+		n.service = membership.NewService(meta, "", shards[i].Address)
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/cluster/shards", n.service.ShardsHandler)
+		mux.HandleFunc("/cluster/gossip", n.service.GossipHandler)
+		n.server.Config.Handler = mux
+		n.server.Start()
+		t.Cleanup(n.server.Close)
+	}
+	return nodes, shards
+}
+
+func TestPublishShardMap(t *testing.T) {
+	nodes, shards := startCluster(t, "luffy", "zoro")
+
+	shards[1].Weight = 3
+	body, err := json.Marshal(config.ShardConfig{AvailableShard: shards})
+	assert.NoError(t, err)
+	req, err := http.NewRequest(http.MethodPut, nodes[0].server.URL+"/cluster/shards", strings.NewReader(string(body)))
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var published config.ShardConfig
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&published))
+	assert.Equal(t, uint64(2), published.Version)
+
+	assert.Eventually(t, func() bool {
+		return nodes[1].meta.Version() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, nodes[1].meta.Config().AvailableShard[1].Weight)
+
+	// a map that is not newer is rejected
+	stale := strings.Replace(string(body), `"version":0`, `"version":2`, 1)
+	resp, err = http.Post(nodes[1].server.URL+"/cluster/shards", "application/json", strings.NewReader(stale))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestGossipCatchesUp(t *testing.T) {
+	nodes, shards := startCluster(t, "luffy", "zoro")
+
+	// luffy applied a new map while zoro was unreachable
+	shards[0].Weight = 2
+	applied, err := nodes[0].meta.Update(config.ShardConfig{Version: 5, AvailableShard: shards})
+	assert.NoError(t, err)
+	assert.True(t, applied)
+
+	done := make(chan bool)
+	defer close(done)
+	nodes[1].service.GossipInterval = 20 * time.Millisecond
+	go nodes[1].service.Run(done)
+
+	assert.Eventually(t, func() bool {
+		return nodes[1].meta.Version() == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, nodes[1].meta.Config().AvailableShard[0].Weight)
+}
+
+func TestReload(t *testing.T) {
+	nodes, _ := startCluster(t, "luffy")
+
+	f, err := os.CreateTemp(os.TempDir(), "sharding.toml")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, os.Remove(f.Name()))
+	})
+	_, err = f.WriteString(`[[shard]]
+name = "luffy"
+address = "` + nodes[0].server.Listener.Addr().String() + `"
+shardId = 0
+weight = 4`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	service := membership.NewService(nodes[0].meta, f.Name(), nodes[0].server.Listener.Addr().String())
+	assert.NoError(t, service.Reload())
+	assert.Equal(t, uint64(2), nodes[0].meta.Version())
+	assert.Equal(t, 4, nodes[0].meta.Config().AvailableShard[0].Weight)
+}
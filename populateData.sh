@@ -1,8 +1,11 @@
 #!/bin/bash
 
-  for shard in localhost:8080 localhost:8081 localhost:8082; do
-    echo "Populating data on $shard"
-    for i in {1..1000}; do
-      curl "http://$shard/set?key=key-$i&value=value-$i" > /dev/null 2>&1
-      done
+  # /mset fans each batch out to the shard leaders, so any node can be populated
+  echo "Populating data on localhost:8080"
+  for batch in {0..9}; do
+    items=""
+    for i in $(seq $((batch * 100 + 1)) $((batch * 100 + 100))); do
+      items="$items{\"key\":\"key-$i\",\"value\":\"$(printf 'value-%d' $i | base64)\"},"
+    done
+    curl -X POST -d "{\"items\":[${items%,}]}" "http://localhost:8080/mset" > /dev/null 2>&1
   done
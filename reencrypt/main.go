@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"log"
+)
+
+var (
+	dbLocation = flag.String("db-location", "", "database location, the node must be stopped")
+	keyFile    = flag.String("encryption-key-file", "", "keys of the database, "+db.KeysEnv+" is used when it is not set")
+)
+
+// reencrypt rewrites the values of a stopped node's database with the current encryption key, to
+// encrypt a database written in the clear or to retire an old key after a rotation
+func main() {
+	flag.Parse()
+	if *dbLocation == "" {
+		log.Fatal("db location is missing")
+	}
+	keys, err := db.LoadKeyring(*keyFile)
+	if err != nil {
+		log.Fatal("error loading encryption keys: ", err)
+	}
+	if keys == nil {
+		log.Fatalf("no encryption keys, pass -encryption-key-file or set %s", db.KeysEnv)
+	}
+
+	// opened read-only like a node starting with failover, nothing is appended to the change log
+	kv, err := db.NewDatabase(*dbLocation, true, db.WithEncryption(keys))
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, err := kv.Reencrypt()
+	if err != nil {
+		kv.Close()
+		log.Fatalf("error re-encrypting after %d values: %v", n, err)
+	}
+	if err := kv.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("re-encrypted %d values with key %s", n, keys.Current())
+
+	// the pages freed by the rewrite still hold the old values, they are left out of a compacted copy
+	if err := db.CompactFile(*dbLocation); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("compacted %s", *dbLocation)
+}
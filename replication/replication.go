@@ -3,104 +3,423 @@ package replication
 import (
 	"bytes"
 	"encoding/json"
+	"expvar"
 	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/auth"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/certs"
 	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
-	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-// NextKeyValue is the struct for the key value pair
+// DefaultBatchSize is the number of changes a replica asks for in a single round trip
+const DefaultBatchSize = 500
+
+// pollInterval is how long the replica waits once it has caught up with the leader
+const pollInterval = 1 * time.Second
+
+// requestTimeout bounds a round trip to the leader, so that a leader that stopped answering does not
+// stall the replica until the connection drops
+const requestTimeout = 30 * time.Second
+
+// lag metrics, exposed on /debug/vars
+var (
+	lagEntries     = expvar.NewInt("replication_lag_entries")
+	appliedSeq     = expvar.NewInt("replication_applied_seq")
+	appliedChanges = expvar.NewInt("replication_applied_changes")
+	appliedBatches = expvar.NewInt("replication_applied_batches")
+	lastSyncUnix   = expvar.NewInt("replication_last_sync_unix")
+)
+
+// NextKeyValue is a single change of the leader's log
 type NextKeyValue struct {
-	Key       string `json:"key"`
-	Value     string `json:"value"`
-	ErrString error  `json:"err"`
+	Seq uint64 `json:"seq"`
+	// Term is the election term of the leader that wrote the change
+	Term uint64 `json:"term,omitempty"`
+	// Namespace is the namespace of the key, empty for the default one
+	Namespace   string `json:"namespace,omitempty"`
+	Key         string `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	ExpiresAt   int64  `json:"expiresAt,omitempty"`
+	Deleted     bool   `json:"deleted,omitempty"`
+	// NamespaceConfig marks the creation of the namespace named by Key, Value holds its quotas
+	NamespaceConfig bool `json:"namespaceConfig,omitempty"`
+	// Txn marks a change of the state of the cross-shard transaction whose id is Key, one of txnOps
+	Txn string `json:"txn,omitempty"`
+}
+
+// txnOps names the log entries of the cross-shard transactions in a NextKeyValue
+var txnOps = map[db.Op]string{db.OpPrepare: "prepare", db.OpRelease: "release", db.OpTxn: "txn", db.OpForgetTxn: "forgetTxn"}
+
+// Batch is a set of changes served by the leader on /replicate
+type Batch struct {
+	Entries []NextKeyValue `json:"entries"`
+	// LastSeq is the sequence number of the last change written on the leader
+	LastSeq uint64 `json:"lastSeq"`
+	// Diverged is set when the entry before the requested ones is not the one the replica has, the
+	// replica wrote it as a leader of an earlier term. No entries are sent, the replica compares an
+	// earlier entry next.
+	Diverged bool `json:"diverged,omitempty"`
+	// ConflictSeq is the last entry of the leader, up to the compared one, written in the term of the
+	// replica's entry or earlier. The logs can not agree after it.
+	ConflictSeq uint64 `json:"conflictSeq,omitempty"`
+	// ConflictTerm is the term of the leader's entry at the compared position, or of its last entry
+	// when it is shorter. The logs can not agree on an entry of a later term.
+	ConflictTerm uint64 `json:"conflictTerm,omitempty"`
+	Err          string `json:"err,omitempty"`
+}
+
+// ResyncRequest is sent by a replica on /resync for the current state of the keys of the log
+// entries it rolled back
+type ResyncRequest struct {
+	Keys []db.KeyRef `json:"keys"`
+	// Txns asks for the cross-shard transactions prepared and coordinated on the leader too
+	Txns bool `json:"txns,omitempty"`
+}
+
+// ResyncResponse is returned by the leader on /resync
+type ResyncResponse struct {
+	Keys        []db.KeyState       `json:"keys"`
+	Prepared    []db.PreparedTxn    `json:"prepared,omitempty"`
+	Coordinated []db.CoordinatedTxn `json:"coordinated,omitempty"`
+	Err         string              `json:"err,omitempty"`
+}
+
+// AckRequest is sent by the replica on /deleteReplica once every change up to Upto has been applied
+type AckRequest struct {
+	Replica string `json:"replica"`
+	Upto    uint64 `json:"upto"`
+}
+
+// AckResponse is returned by the leader on /deleteReplica
+type AckResponse struct {
+	// TruncatedUpto is the position every registered replica has acknowledged
+	TruncatedUpto uint64 `json:"truncatedUpto"`
+	Err           string `json:"err,omitempty"`
+}
+
+// Status is the replication state of a leader, served on /replicationStatus
+type Status struct {
+	FirstSeq uint64            `json:"firstSeq"`
+	LastSeq  uint64            `json:"lastSeq"`
+	Replicas map[string]uint64 `json:"replicas"`
+}
+
+// ToEntries converts the batch into log entries that can be applied on the database
+func (b *Batch) ToEntries() []db.LogEntry {
+	entries := make([]db.LogEntry, 0, len(b.Entries))
+	for _, e := range b.Entries {
+		entry := db.LogEntry{Seq: e.Seq, Term: e.Term, Op: db.OpSet, Namespace: e.Namespace, Key: e.Key, Value: db.Value{Data: e.Value, ContentType: e.ContentType, ExpiresAt: e.ExpiresAt}}
+		switch {
+		case e.Deleted:
+			entry.Op = db.OpDelete
+		case e.NamespaceConfig:
+			entry.Op = db.OpNamespace
+		case e.Txn != "":
+			// an op unknown to this release is left zero, applying it fails
+			entry.Op = 0
+			for op, name := range txnOps {
+				if name == e.Txn {
+					entry.Op = op
+				}
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// NewBatch builds a batch from the entries read from the change log
+func NewBatch(entries []db.LogEntry, lastSeq uint64) *Batch {
+	b := &Batch{Entries: make([]NextKeyValue, 0, len(entries)), LastSeq: lastSeq}
+	for _, e := range entries {
+		b.Entries = append(b.Entries, NextKeyValue{
+			Seq:             e.Seq,
+			Term:            e.Term,
+			Namespace:       e.Namespace,
+			Key:             e.Key,
+			Value:           e.Value.Data,
+			ContentType:     e.Value.ContentType,
+			ExpiresAt:       e.Value.ExpiresAt,
+			Deleted:         e.Op == db.OpDelete,
+			NamespaceConfig: e.Op == db.OpNamespace,
+			Txn:             txnOps[e.Op],
+		})
+	}
+	return b
 }
 
-type client struct {
-	db         *db.KVDatabase
-	leaderAddr string
+// Client pulls the change log of a shard leader into a replica
+type Client struct {
+	db          *db.KVDatabase
+	leaderAddr  atomic.Value
+	replicaAddr string
+	batchSize   int
+	client      *http.Client
+	// scheme is https once SetTLS was called
+	scheme string
+	// caughtUpAt is the unix nano time of the last sync that left the replica fully caught up
+	caughtUpAt atomic.Int64
+	// probe is the position of the log compared with the leader, set while looking for the last entry
+	// they agree on after the leader found them diverged
+	probe   uint64
+	probing bool
 }
 
-func SyncMasterAndReplica(db *db.KVDatabase, leaderAddr string, done chan bool) error {
-	c := &client{db: db, leaderAddr: leaderAddr}
+// NewClient creates a replication client. replicaAddr identifies this replica to the leader, it must
+// be listed in the shard's replicas.
+func NewClient(db *db.KVDatabase, leaderAddr, replicaAddr string, batchSize int) *Client {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	c := &Client{db: db, replicaAddr: replicaAddr, batchSize: batchSize, client: &http.Client{Timeout: requestTimeout}, scheme: "http"}
+	c.leaderAddr.Store(leaderAddr)
+	return c
+}
+
+// SetTLS pulls the change log over mutual TLS with the certificates of the node. It must be called
+// before SetCredential and Run.
+func (c *Client) SetTLS(certs *certs.Reloader) {
+	c.scheme = "https"
+	c.client.Transport = certs.Transport()
+}
 
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+// SetCredential authenticates the requests to the leader with the credential, it must hold the
+// replication role. It must be called before Run.
+func (c *Client) SetCredential(cred *auth.Credential) {
+	c.client.Transport = auth.NewTransport(c.client.Transport, cred)
+}
+
+// SetLeader points the client to a newly elected leader
+func (c *Client) SetLeader(leaderAddr string) {
+	c.leaderAddr.Store(leaderAddr)
+}
+
+func (c *Client) leader() string {
+	return c.leaderAddr.Load().(string)
+}
+
+// SyncMasterAndReplica pulls the leader's change log in batches until done is closed
+func SyncMasterAndReplica(db *db.KVDatabase, leaderAddr, replicaAddr string, batchSize int, done chan bool) error {
+	return NewClient(db, leaderAddr, replicaAddr, batchSize).Run(done)
+}
+
+// Staleness returns how far behind the leader the replica may be: the time elapsed since it
+// last had applied every change of the leader's log
+func (c *Client) Staleness() time.Duration {
+	at := c.caughtUpAt.Load()
+	if at == 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Since(time.Unix(0, at))
+}
 
+// Run pulls the leader's change log in batches until done is closed. Nothing is pulled while the
+// database is writable, i.e. while this node is the leader of its shard.
+func (c *Client) Run(done chan bool) error {
 	for {
+		if !c.db.ReadOnly() {
+			select {
+			case <-done:
+				return nil
+			case <-time.After(pollInterval):
+				continue
+			}
+		}
+
+		more, err := c.sync()
+		if err != nil {
+			log.Default().Println("error syncing with leader: ", err)
+		}
+
+		// keep pulling while the leader has more changes, otherwise wait before asking again
+		wait := time.Duration(0)
+		if err != nil || !more {
+			wait = pollInterval
+		}
+
 		select {
 		case <-done:
 			// Signal received, exit the function
 			log.Default().Println("done signal received, stopping sync")
 			return nil
-		case <-ticker.C:
-			log.Println("syncing with leader")
-			present, err := c.sync()
-			if err != nil {
-				log.Default().Println("error syncing with leader: ", err)
-				continue // Proceed to next iteration of the loop
-			}
-
-			if !present {
-				log.Default().Println("leader not present")
-				continue // Proceed to next iteration of the loop
-			}
+		case <-time.After(wait):
 		}
 	}
 }
 
-func (c *client) sync() (bool, error) {
-	url := "http://" + c.leaderAddr + "/replicate"
-	resp, err := http.Get(url)
+// sync fetches the next batch of the leader's log, applies it and acknowledges it. It reports whether
+// the leader has more changes to send.
+func (c *Client) sync() (bool, error) {
+	if err := c.resync(); err != nil {
+		return false, err
+	}
+	last, _, err := c.db.LastEntry()
 	if err != nil {
-		return false, fmt.Errorf("leader url %s got error %w", url, err)
+		return false, err
 	}
-
-	var res NextKeyValue
-
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+	// the leader checks that it has the entry before the requested ones with the same term, so that
+	// entries this node wrote as a leader and the new leader never received are not mixed with its own
+	prev := last
+	if c.probing {
+		prev = c.probe
+	}
+	term, ok, err := c.db.TermAt(prev)
+	if err != nil {
 		return false, err
 	}
-	defer resp.Body.Close()
+	if !ok {
+		return false, fmt.Errorf("log diverged from the leader before the oldest retained entry %d, restore this node from a backup of the leader", prev+1)
+	}
 
-	if res.ErrString != nil {
-		return false, fmt.Errorf("%w", err)
+	u := url.Values{}
+	u.Set("from", strconv.FormatUint(prev+1, 10))
+	u.Set("term", strconv.FormatUint(term, 10))
+	u.Set("limit", strconv.Itoa(c.batchSize))
+	u.Set("replica", c.replicaAddr)
+	leaderURL := c.scheme + "://" + c.leader() + "/replicate?" + u.Encode()
+	resp, err := c.client.Get(leaderURL)
+	if err != nil {
+		return false, fmt.Errorf("leader url %s got error %w", leaderURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return false, fmt.Errorf("leader url %s rejected the credential of the replica: %s", leaderURL, resp.Status)
 	}
 
-	if err := c.db.SetKeyOnReplica(res.Key, res.Value); err != nil {
+	var res Batch
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
 		return false, err
 	}
+	if res.Err != "" {
+		return false, fmt.Errorf("leader returned error: %s", res.Err)
+	}
+	lastSyncUnix.Set(time.Now().Unix())
 
-	if err := c.deleteFromReplicationBuffer(res.Key, res.Value); err != nil {
-		log.Default().Println("error deleting key from replication buffer: ", err)
+	if res.Diverged {
+		// compare the last entry both logs can still agree on
+		next, err := c.db.LastSeqOfTerm(prev-1, res.ConflictTerm)
+		if err != nil {
+			return false, err
+		}
+		if next > res.ConflictSeq {
+			next = res.ConflictSeq
+		}
+		c.probe, c.probing = next, true
+		return true, nil
+	}
+	c.probing = false
+	if last > prev {
+		removed, err := c.db.RollbackLog(prev)
+		if err != nil {
+			return false, err
+		}
+		log.Default().Printf("rolled back %d log entries after seq %d missing on the leader", removed, prev)
+		if err := c.resync(); err != nil {
+			return false, err
+		}
 	}
-	return true, nil
 
-}
+	applied := prev
+	if len(res.Entries) > 0 {
+		if err := c.db.ApplyLog(res.ToEntries()); err != nil {
+			return false, err
+		}
+		applied = res.Entries[len(res.Entries)-1].Seq
+		appliedChanges.Add(int64(len(res.Entries)))
+		appliedBatches.Add(1)
 
-func (c *client) deleteFromReplicationBuffer(key string, value string) error {
-	u := url.Values{}
-	u.Set("key", key)
-	u.Set("value", value)
+		if err := c.ack(applied); err != nil {
+			log.Default().Println("error acknowledging changes to leader: ", err)
+		}
+	}
+	appliedSeq.Set(int64(applied))
+	lagEntries.Set(int64(res.LastSeq - applied))
+	if applied >= res.LastSeq {
+		c.caughtUpAt.Store(time.Now().UnixNano())
+	}
+	return applied < res.LastSeq, nil
+}
 
-	log.Printf("Deleting key= %q, value= %q, from replication buffer %q", key, value, c.leaderAddr)
-	resp, err := http.Get("http://" + c.leaderAddr + "/deleteReplica" + "?" + u.Encode())
+// resync copies from the leader the current values of the keys written by rolled back log entries,
+// and the state of the cross-shard transactions when the entries changed it
+func (c *Client) resync() error {
+	txns, err := c.db.TxnsToResync()
 	if err != nil {
-		log.Printf("error deleting key from replication buffer: %v", err)
 		return err
 	}
+	for {
+		keys, err := c.db.ResyncKeys(c.batchSize)
+		if err != nil || (len(keys) == 0 && !txns) {
+			return err
+		}
+		res, err := c.postResync(&ResyncRequest{Keys: keys, Txns: txns})
+		if err != nil {
+			return err
+		}
+		if len(res.Keys) != len(keys) {
+			return fmt.Errorf("leader returned %d keys to resync, asked for %d", len(res.Keys), len(keys))
+		}
+		if err := c.db.Resync(res.Keys); err != nil {
+			return err
+		}
+		if txns {
+			if err := c.db.ResyncTxns(res.Prepared, res.Coordinated); err != nil {
+				return err
+			}
+			txns = false
+		}
+	}
+}
+
+func (c *Client) postResync(req *ResyncRequest) (*ResyncResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Post(c.scheme+"://"+c.leader()+"/resync", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
+	var res ResyncResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("error decoding resync response: %s: %w", resp.Status, err)
+	}
+	if res.Err != "" {
+		return nil, fmt.Errorf("leader returned error: %s", res.Err)
+	}
+	return &res, nil
+}
 
-	res, err := io.ReadAll(resp.Body)
+// ack tells the leader that every change up to the given sequence number has been applied
+func (c *Client) ack(upto uint64) error {
+	body, err := json.Marshal(&AckRequest{Replica: c.replicaAddr, Upto: upto})
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Post(c.scheme+"://"+c.leader()+"/deleteReplica", "application/json", bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
-	if !bytes.Equal(res, []byte("ok")) {
-		return fmt.Errorf("error deleting key from replication buffer: %s", res)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("leader rejected the credential of the replica: %s", resp.Status)
 	}
-	return nil
 
+	var res AckResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("error decoding ack response: %w", err)
+	}
+	if res.Err != "" {
+		return fmt.Errorf("error truncating the leader log: %s", res.Err)
+	}
+	// every replica has the entries the leader dropped, this replica's copy is no longer needed either
+	return c.db.TruncateLog(res.TruncatedUpto)
 }
@@ -0,0 +1,420 @@
+package reshard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/auth"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/certs"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/config"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultBatchSize is the number of local keys examined per step of a migration
+const DefaultBatchSize = 500
+
+// retryInterval is how long the migration waits before retrying a batch a new owner did not accept
+const retryInterval = 2 * time.Second
+
+// progressKey is where the progress is persisted in the database metadata
+const progressKey = "reshard"
+
+// Progress is the state of a migration, served on /reshard/status
+type Progress struct {
+	Running bool `json:"running"`
+	// Namespace is the namespace being migrated, the default one comes first and then the named
+	// ones in order
+	Namespace string `json:"namespace,omitempty"`
+	// Cursor is the last key examined in the namespace, a resumed migration continues after it
+	Cursor     string    `json:"cursor"`
+	Scanned    int       `json:"scanned"`
+	Moved      int       `json:"moved"`
+	LastError  string    `json:"lastError,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// Locked are the keys held by a prepared transaction, here or on their new owner, the migration
+	// stops before the first of them until the transactions are resolved
+	Locked []string `json:"locked,omitempty"`
+}
+
+// ReceiveResponse is returned by the new owner on /reshard/receive
+type ReceiveResponse struct {
+	// Stored are the keys the receiver now holds, either the migrated value or a newer one
+	Stored []string `json:"stored"`
+	// Rejected are the keys the receiver does not own
+	Rejected []string `json:"rejected,omitempty"`
+	Err      string   `json:"err,omitempty"`
+	// Locked are the keys held by a transaction prepared on the receiver, they are not stored
+	Locked []string `json:"locked,omitempty"`
+}
+
+// Migrator moves the keys of the local shard that belong to another shard under the current
+// config to their new owner. A key is deleted locally only once its new owner confirmed it holds
+// it, and the progress is persisted after every batch so that a restarted node resumes where it
+// stopped instead of losing or re-sending everything.
+type Migrator struct {
+	db        *db.KVDatabase
+	meta      *config.ShardMetadata
+	BatchSize int
+
+	mu       sync.Mutex
+	progress Progress
+	client   *http.Client
+	// scheme is https once SetTLS was called
+	scheme string
+}
+
+// NewMigrator creates the migrator of the local shard and loads the persisted progress
+func NewMigrator(kv *db.KVDatabase, meta *config.ShardMetadata) (*Migrator, error) {
+	m := &Migrator{db: kv, meta: meta, BatchSize: DefaultBatchSize, client: &http.Client{Timeout: 30 * time.Second}, scheme: "http"}
+	raw, err := kv.GetMeta(progressKey)
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		if err := json.Unmarshal(raw, &m.progress); err != nil {
+			return nil, fmt.Errorf("error loading resharding progress: %w", err)
+		}
+	}
+	return m, nil
+}
+
+// SetTLS sends the batches to the new owners over mutual TLS with the certificates of the node, it must
+// be called before SetCredential
+func (m *Migrator) SetTLS(certs *certs.Reloader) {
+	m.scheme = "https"
+	m.client.Transport = certs.Transport()
+}
+
+// SetCredential authenticates the batches sent to the new owners with the credential of the node
+func (m *Migrator) SetCredential(cred *auth.Credential) {
+	m.client.Transport = auth.NewTransport(m.client.Transport, cred)
+}
+
+// Status returns the progress of the current or last migration
+func (m *Migrator) Status() Progress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.progress
+}
+
+// Start begins a migration from the first key
+func (m *Migrator) Start(done chan bool) error {
+	if m.db.ReadOnly() {
+		return fmt.Errorf("only the shard leader migrates keys")
+	}
+	m.mu.Lock()
+	if m.progress.Running {
+		m.mu.Unlock()
+		return fmt.Errorf("a migration is already running")
+	}
+	m.progress = Progress{Running: true, StartedAt: time.Now()}
+	err := m.save()
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	go m.run(done)
+	return nil
+}
+
+// Resume continues a migration interrupted by a restart, it does nothing if none was running
+func (m *Migrator) Resume(done chan bool) {
+	if m.Status().Running {
+		log.Printf("resuming resharding after key %q", m.Status().Cursor)
+		go m.run(done)
+	}
+}
+
+// save persists the progress, the caller holds m.mu
+func (m *Migrator) save() error {
+	raw, err := json.Marshal(&m.progress)
+	if err != nil {
+		return err
+	}
+	return m.db.SetMeta(progressKey, raw)
+}
+
+func (m *Migrator) run(done chan bool) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		finished, err := m.step()
+		if err != nil {
+			log.Println("error resharding: ", err)
+			m.mu.Lock()
+			m.progress.LastError = err.Error()
+			m.mu.Unlock()
+			select {
+			case <-done:
+				return
+			case <-time.After(retryInterval):
+			}
+			continue
+		}
+		if finished {
+			log.Printf("resharding finished, moved %d keys", m.Status().Moved)
+			return
+		}
+	}
+}
+
+// step migrates the next batch of keys and reports whether the migration is finished
+func (m *Migrator) step() (bool, error) {
+	if m.db.ReadOnly() {
+		// a resumed migration waits until this node leads its shard again
+		return false, fmt.Errorf("not the leader of shard %d", m.meta.CurrentShard())
+	}
+	m.mu.Lock()
+	namespace, cursor := m.progress.Namespace, m.progress.Cursor
+	m.mu.Unlock()
+
+	kv, err := m.db.Namespace(namespace)
+	if err != nil {
+		return false, err
+	}
+	pairs, err := kv.ReadKeys(cursor, m.BatchSize)
+	if err != nil {
+		return false, err
+	}
+	if len(pairs) == 0 {
+		next, err := m.nextNamespace(namespace)
+		if err != nil {
+			return false, err
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if next != "" {
+			m.progress.Namespace, m.progress.Cursor = next, ""
+			return false, m.save()
+		}
+		m.progress.Running = false
+		m.progress.FinishedAt = time.Now()
+		return true, m.save()
+	}
+
+	byShard := make(map[int][]db.KeyValue)
+	var moving []string
+	for _, p := range pairs {
+		if shard := m.meta.GetShard(p.Key); shard != m.meta.CurrentShard() {
+			byShard[shard] = append(byShard[shard], p)
+			moving = append(moving, p.Key)
+		}
+	}
+	// a key held by a transaction prepared before the config changed is not sent, committing the
+	// transaction changes it here
+	locked, err := kv.LockedKeys(moving)
+	if err != nil {
+		return false, err
+	}
+	left := make(map[string]bool, len(locked))
+	for _, key := range locked {
+		left[key] = true
+	}
+
+	var confirmed []db.KeyValue
+	for shard, group := range byShard {
+		var free []db.KeyValue
+		for _, p := range group {
+			if !left[p.Key] {
+				free = append(free, p)
+			}
+		}
+		if len(free) == 0 {
+			continue
+		}
+		stored, held, err := m.send(m.meta.Leader(shard), namespace, free)
+		if err != nil {
+			// nothing of this batch is skipped, it is sent again on the next attempt
+			return false, fmt.Errorf("shard %d: %w", shard, err)
+		}
+		confirmed = append(confirmed, stored...)
+		for _, key := range held {
+			left[key] = true
+		}
+	}
+
+	// the cursor stops before the first key left behind, the batch is read again from there and the
+	// keys after it are only deleted then, the new owner confirms them again
+	examined := len(pairs)
+	for i, p := range pairs {
+		if left[p.Key] {
+			examined = i
+			break
+		}
+	}
+	if examined < len(pairs) {
+		var before []db.KeyValue
+		for _, p := range confirmed {
+			if p.Key < pairs[examined].Key {
+				before = append(before, p)
+			}
+		}
+		confirmed = before
+	}
+	moved, err := kv.DeleteKeysIfUnchanged(confirmed)
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if examined > 0 {
+		m.progress.Cursor = pairs[examined-1].Key
+	}
+	m.progress.Scanned += examined
+	m.progress.Moved += moved
+	m.progress.Locked = nil
+	for _, p := range pairs {
+		if left[p.Key] {
+			m.progress.Locked = append(m.progress.Locked, p.Key)
+		}
+	}
+	m.progress.LastError = ""
+	if err := m.save(); err != nil {
+		return false, err
+	}
+	if len(m.progress.Locked) > 0 {
+		return false, fmt.Errorf("%d keys are held by prepared transactions, waiting for their outcome", len(m.progress.Locked))
+	}
+	return false, nil
+}
+
+// nextNamespace returns the namespace migrated after the given one, "" once they are all migrated
+func (m *Migrator) nextNamespace(namespace string) (string, error) {
+	namespaces, err := m.db.Namespaces()
+	if err != nil {
+		return "", err
+	}
+	for _, n := range namespaces {
+		if n.Name > namespace {
+			return n.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// send hands the pairs of the namespace over to the new owner and returns the ones it confirmed, and
+// the keys it did not store because a prepared transaction holds them
+func (m *Migrator) send(addr, namespace string, pairs []db.KeyValue) ([]db.KeyValue, []string, error) {
+	body, err := json.Marshal(pairs)
+	if err != nil {
+		return nil, nil, err
+	}
+	uri := m.scheme + "://" + addr + "/reshard/receive"
+	if namespace != "" {
+		uri += "?namespace=" + url.QueryEscape(namespace)
+	}
+	resp, err := m.client.Post(uri, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	var res ReceiveResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, nil, fmt.Errorf("error decoding response of %s: %w", addr, err)
+	}
+	if res.Err != "" {
+		return nil, nil, fmt.Errorf("%s: %s", addr, res.Err)
+	}
+	if len(res.Rejected) > 0 {
+		return nil, nil, fmt.Errorf("%s does not own %d of the keys, the shard configs differ", addr, len(res.Rejected))
+	}
+
+	stored := make(map[string]bool, len(res.Stored))
+	for _, k := range res.Stored {
+		stored[k] = true
+	}
+	var confirmed []db.KeyValue
+	for _, p := range pairs {
+		if stored[p.Key] {
+			confirmed = append(confirmed, p)
+		}
+	}
+	return confirmed, res.Locked, nil
+}
+
+// ReceiveHandler stores the keys migrated by another shard, in the namespace of the namespace parameter
+func (m *Migrator) ReceiveHandler(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		enc.Encode(&ReceiveResponse{Err: "keys must be sent with POST"})
+		return
+	}
+	if m.db.ReadOnly() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		enc.Encode(&ReceiveResponse{Err: fmt.Sprintf("not the leader of shard %d", m.meta.CurrentShard())})
+		return
+	}
+
+	kv, err := m.db.Namespace(r.URL.Query().Get("namespace"))
+	if errors.Is(err, db.ErrNoNamespace) {
+		w.WriteHeader(http.StatusNotFound)
+		enc.Encode(&ReceiveResponse{Err: err.Error()})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(&ReceiveResponse{Err: err.Error()})
+		return
+	}
+
+	var pairs []db.KeyValue
+	if err := json.NewDecoder(r.Body).Decode(&pairs); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(&ReceiveResponse{Err: err.Error()})
+		return
+	}
+
+	res := &ReceiveResponse{}
+	var owned []db.KeyValue
+	for _, p := range pairs {
+		if m.meta.GetShard(p.Key) != m.meta.CurrentShard() {
+			res.Rejected = append(res.Rejected, p.Key)
+			continue
+		}
+		owned = append(owned, p)
+	}
+	// the keys not stored, held by a prepared transaction or expired, stay on the sender
+	if res.Stored, res.Locked, err = kv.ImportKeys(owned); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(&ReceiveResponse{Err: err.Error()})
+		return
+	}
+	enc.Encode(res)
+}
+
+// StatusHandler serves the progress of the migration
+func (m *Migrator) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(m.Status())
+}
+
+// StartHandler starts a migration, done stops it when the node shuts down
+func (m *Migrator) StartHandler(done chan bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("resharding must be started with POST"))
+			return
+		}
+		if err := m.Start(done); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(m.Status())
+	}
+}
@@ -0,0 +1,218 @@
+package reshard_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/config"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/reshard"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createTempDb(t *testing.T) *db.KVDatabase {
+	t.Helper()
+	f, err := os.CreateTemp(os.TempDir(), "kvdb-reshard")
+	assert.NoError(t, err)
+
+	name := f.Name()
+	assert.NoError(t, f.Close())
+	t.Cleanup(func() {
+		assert.NoError(t, os.Remove(name))
+	})
+
+	kvdb, err := db.NewDatabase(name, false)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, kvdb.Close())
+	})
+	return kvdb
+}
+
+func getKey(t *testing.T, kvdb *db.KVDatabase, key string) string {
+	t.Helper()
+	value, err := kvdb.GetKey(key)
+	if errors.Is(err, db.ErrNotFound) {
+		return ""
+	}
+	assert.NoError(t, err)
+	return string(value.Data)
+}
+
+func TestMigration(t *testing.T) {
+	var receive http.HandlerFunc
+	newOwner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receive(w, r)
+	}))
+	defer newOwner.Close()
+
+	addrs := map[int]string{0: "", 1: strings.TrimPrefix(newOwner.URL, "http://")}
+	oldMeta := &config.ShardMetadata{Count: 2, CurrIdx: 0, Addrs: addrs}
+	newMeta := &config.ShardMetadata{Count: 2, CurrIdx: 1, Addrs: addrs}
+
+	// the old owner holds every key, as it did before shard 1 was added
+	oldDb := createTempDb(t)
+	var moving []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		assert.NoError(t, oldDb.SetKey(key, db.Value{Data: []byte("old-" + key)}))
+		if oldMeta.GetShard(key) == 1 {
+			moving = append(moving, key)
+		}
+	}
+	assert.NotEmpty(t, moving)
+
+	// a client already wrote one of the moving keys on its new owner
+	newDb := createTempDb(t)
+	assert.NoError(t, newDb.SetKey(moving[0], db.Value{Data: []byte("newer")}))
+
+	// the keys of the named namespaces move too
+	var webDbs [2]*db.KVDatabase
+	for i, kvdb := range []*db.KVDatabase{oldDb, newDb} {
+		_, err := kvdb.CreateNamespace("web", 0, 0)
+		assert.NoError(t, err)
+		webDbs[i], err = kvdb.Namespace("web")
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, webDbs[0].SetKey(moving[0], db.Value{Data: []byte("web")}))
+
+	receiver, err := reshard.NewMigrator(newDb, newMeta)
+	assert.NoError(t, err)
+	receive = receiver.ReceiveHandler
+
+	migrator, err := reshard.NewMigrator(oldDb, oldMeta)
+	assert.NoError(t, err)
+	migrator.BatchSize = 7
+	done := make(chan bool)
+	defer close(done)
+	assert.NoError(t, migrator.Start(done))
+	assert.Error(t, migrator.Start(done), "a migration is already running")
+
+	assert.Eventually(t, func() bool {
+		return !migrator.Status().Running
+	}, 5*time.Second, 10*time.Millisecond)
+
+	status := migrator.Status()
+	assert.Equal(t, 51, status.Scanned)
+	assert.Equal(t, len(moving)+1, status.Moved)
+	assert.Equal(t, "", getKey(t, webDbs[0], moving[0]))
+	assert.Equal(t, "web", getKey(t, webDbs[1], moving[0]))
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		oldValue, newValue := getKey(t, oldDb, key), getKey(t, newDb, key)
+		switch {
+		case key == moving[0]:
+			assert.Equal(t, "", oldValue)
+			assert.Equal(t, "newer", newValue)
+		case oldMeta.GetShard(key) == 1:
+			assert.Equal(t, "", oldValue)
+			assert.Equal(t, "old-"+key, newValue)
+		default:
+			assert.Equal(t, "old-"+key, oldValue)
+			assert.Equal(t, "", newValue)
+		}
+	}
+
+	// the progress survives a restart
+	restarted, err := reshard.NewMigrator(oldDb, oldMeta)
+	assert.NoError(t, err)
+	assert.Equal(t, status.Moved, restarted.Status().Moved)
+	assert.False(t, restarted.Status().Running)
+}
+
+func TestMigrationRetriesUntilOwnerAccepts(t *testing.T) {
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"err":"not the leader of shard 1"}`))
+	}))
+	defer owner.Close()
+
+	meta := &config.ShardMetadata{Count: 2, CurrIdx: 0, Addrs: map[int]string{0: "", 1: strings.TrimPrefix(owner.URL, "http://")}}
+	kvdb := createTempDb(t)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, kvdb.SetKey(fmt.Sprintf("key-%d", i), db.Value{Data: []byte("value")}))
+	}
+
+	migrator, err := reshard.NewMigrator(kvdb, meta)
+	assert.NoError(t, err)
+	done := make(chan bool)
+	assert.NoError(t, migrator.Start(done))
+	assert.Eventually(t, func() bool {
+		return migrator.Status().LastError != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	close(done)
+
+	// nothing was deleted while the owner refused the keys, and the migration resumes after a restart
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "value", getKey(t, kvdb, fmt.Sprintf("key-%d", i)))
+	}
+	restarted, err := reshard.NewMigrator(kvdb, meta)
+	assert.NoError(t, err)
+	assert.True(t, restarted.Status().Running)
+}
+
+func TestMigrationWaitsForPreparedTxns(t *testing.T) {
+	newDb := createTempDb(t)
+	newOwner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer newOwner.Close()
+	addrs := map[int]string{0: "", 1: strings.TrimPrefix(newOwner.URL, "http://")}
+	oldMeta := &config.ShardMetadata{Count: 2, CurrIdx: 0, Addrs: addrs}
+	receiver, err := reshard.NewMigrator(newDb, &config.ShardMetadata{Count: 2, CurrIdx: 1, Addrs: addrs})
+	assert.NoError(t, err)
+	newOwner.Config.Handler = http.HandlerFunc(receiver.ReceiveHandler)
+
+	oldDb := createTempDb(t)
+	var moving []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		assert.NoError(t, oldDb.SetKey(key, db.Value{Data: []byte("old-" + key)}))
+		if oldMeta.GetShard(key) == 1 {
+			moving = append(moving, key)
+		}
+	}
+	assert.True(t, len(moving) > 1)
+
+	// one moving key is held by a transaction prepared here, another one by a transaction prepared on
+	// its new owner
+	set := func(key, value string) []db.TxnOp {
+		return []db.TxnOp{{Key: key, Value: db.Value{Data: []byte(value)}}}
+	}
+	assert.NoError(t, oldDb.Prepare(db.PreparedTxn{ID: "here", Ops: set(moving[0], "committed")}))
+	assert.NoError(t, newDb.Prepare(db.PreparedTxn{ID: "there", Ops: set(moving[1], "aborted")}))
+
+	migrator, err := reshard.NewMigrator(oldDb, oldMeta)
+	assert.NoError(t, err)
+	migrator.BatchSize = 5
+	done := make(chan bool)
+	defer close(done)
+	assert.NoError(t, migrator.Start(done))
+
+	assert.Eventually(t, func() bool {
+		return len(migrator.Status().Locked) > 0 && migrator.Status().LastError != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	status := migrator.Status()
+	assert.True(t, status.Running)
+	assert.Equal(t, moving[0], status.Locked[0])
+	assert.Equal(t, "old-"+moving[0], getKey(t, oldDb, moving[0]))
+
+	_, err = oldDb.CommitPrepared("here")
+	assert.NoError(t, err)
+	assert.NoError(t, newDb.AbortPrepared("there"))
+	assert.Eventually(t, func() bool {
+		return !migrator.Status().Running
+	}, 10*time.Second, 10*time.Millisecond)
+
+	status = migrator.Status()
+	assert.Empty(t, status.Locked)
+	assert.Equal(t, 20, status.Scanned)
+	assert.Equal(t, len(moving), status.Moved)
+	assert.Equal(t, "", getKey(t, oldDb, moving[0]))
+	assert.Equal(t, "committed", getKey(t, newDb, moving[0]))
+	assert.Equal(t, "old-"+moving[1], getKey(t, newDb, moving[1]))
+}
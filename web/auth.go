@@ -0,0 +1,79 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/auth"
+	"log"
+	"net/http"
+)
+
+// WithAuth requires every request wrapped with Authorize to carry a credential of the authenticator
+// granting the endpoint, and authenticates the requests this node forwards to the others with node
+func WithAuth(a *auth.Authenticator, node *auth.Credential) Option {
+	return func(s *Server) {
+		s.auth = a
+		s.credential = node
+	}
+}
+
+// Authorize only lets requests whose credential grants the role call the handler, they are answered
+// with 401 without a valid credential and 403 otherwise. Reads and writes are authorized on the
+// namespace of the request. When the server verifies client certificates, the calls between nodes must
+// also present one. Every request is let through when the server has neither.
+func (s *Server) Authorize(role auth.Role, h http.HandlerFunc) http.HandlerFunc {
+	nodeCert := role == auth.RoleReplication && s.certs != nil && s.certs.VerifiesClients()
+	if s.auth == nil && !nodeCert {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if nodeCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("calls between nodes must present a client certificate"))
+			return
+		}
+		if s.auth == nil || s.authorized(role, w, r) {
+			h(w, r)
+		}
+	}
+}
+
+// AuthorizeMethod authorizes GET and HEAD requests with the read role and the others with the write role
+func (s *Server) AuthorizeMethod(h http.HandlerFunc) http.HandlerFunc {
+	if s.auth == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		role := auth.RoleWrite
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			role = auth.RoleRead
+		}
+		if s.authorized(role, w, r) {
+			h(w, r)
+		}
+	}
+}
+
+func (s *Server) authorized(role auth.Role, w http.ResponseWriter, r *http.Request) bool {
+	cred, err := s.auth.Authenticate(r)
+	if err != nil {
+		if !errors.Is(err, auth.ErrUnauthenticated) {
+			log.Println(err)
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="kv", `+auth.HMACScheme+` realm="kv"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+	namespace := r.URL.Query().Get("namespace")
+	if namespace == "" {
+		namespace = r.Header.Get(namespaceHeader)
+	}
+	if !cred.Allowed(role, namespace) {
+		log.Printf("credential %s denied %s on %s %s", cred.ID, role, r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("%v: credential %s does not grant %s on namespace %q", auth.ErrForbidden, cred.ID, role, namespace)))
+		return false
+	}
+	return true
+}
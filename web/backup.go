@@ -0,0 +1,60 @@
+package web
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// backupSeqHeader carries the position in the change log of the snapshot sent by /admin/backup
+const backupSeqHeader = "X-Kv-Backup-Seq"
+
+// backupShardHeader carries the shard of the node the snapshot was taken on
+const backupShardHeader = "X-Kv-Backup-Shard"
+
+const (
+	// backupWriteTimeout and backupMinRate bound the time a client takes to read a backup, as the snapshot
+	// holds a read transaction that the writes growing the file wait for: it is given backupWriteTimeout
+	// plus the time to read the snapshot at backupMinRate bytes per second
+	backupWriteTimeout = 30 * time.Second
+	backupMinRate      = 1 << 20
+)
+
+// BackupHandler streams a consistent snapshot of the database of this node on GET /admin/backup, as a
+// bolt file that the -restore mode of the node turns back into a database. Every node can be backed up,
+// a replica spares the leader the copy. Writes go on while the snapshot is sent, its position in the
+// change log is sent in the X-Kv-Backup-Seq header.
+func (s *Server) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("backups are taken with GET"))
+		return
+	}
+	snapshot, err := s.db.Backup()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer snapshot.Close()
+
+	shard := s.shardMetadata.CurrentShard()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(snapshot.Info.Size, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="shard-%d-seq-%d.db"`, shard, snapshot.Info.Seq))
+	w.Header().Set(backupSeqHeader, strconv.FormatUint(snapshot.Info.Seq, 10))
+	w.Header().Set(backupShardHeader, strconv.Itoa(shard))
+	timeout := backupWriteTimeout + time.Duration(snapshot.Info.Size/backupMinRate)*time.Second
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+	n, err := snapshot.WriteTo(w)
+	if err != nil {
+		// the status is already sent, the client sees a body shorter than Content-Length
+		log.Printf("error sending backup after %d bytes: %v", n, err)
+		return
+	}
+	log.Printf("sent backup of shard %d at seq %d, %d bytes", shard, snapshot.Info.Seq, n)
+}
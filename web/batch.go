@@ -0,0 +1,305 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+const (
+	// maxBatchKeys is the maximum number of keys of a single /mget, /mset or /mdelete request
+	maxBatchKeys = 1000
+	// maxBatchBytes caps the size of a batch request body
+	maxBatchBytes = 64 << 20
+)
+
+// BatchItem is a key and the value to store for it on /mset
+type BatchItem struct {
+	Key         string `json:"key"`
+	Value       []byte `json:"value"`
+	ContentType string `json:"contentType,omitempty"`
+	// TTL is a Go duration or a number of seconds, the value never expires when it is empty
+	TTL string `json:"ttl,omitempty"`
+}
+
+// BatchRequest is the body of the batch endpoints: the keys to read or delete on /mget and /mdelete,
+// the items to write on /mset
+type BatchRequest struct {
+	Keys  []string    `json:"keys,omitempty"`
+	Items []BatchItem `json:"items,omitempty"`
+}
+
+// BatchResult is the outcome for one key of a batch, Err is set when the key could not be served
+type BatchResult struct {
+	Key string `json:"key"`
+	// Value is the value read on /mget, nil if the key does not exist
+	Value *db.Value `json:"value,omitempty"`
+	// Version is the version written on /mset
+	Version uint64 `json:"version,omitempty"`
+	Err     string `json:"err,omitempty"`
+}
+
+// BatchResponse holds the result of every key, in the order of the request
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+	Err     string        `json:"err,omitempty"`
+}
+
+// MGetHandler reads many keys at once, each shard's keys are read from a single snapshot of its leader
+func (s *Server) MGetHandler(w http.ResponseWriter, r *http.Request) {
+	req, kv, ok := s.readBatch(w, r)
+	if !ok {
+		return
+	}
+	if len(req.Keys) == 0 {
+		batchError(w, http.StatusBadRequest, "keys is empty")
+		return
+	}
+	if !validKeys(w, req.Keys) {
+		return
+	}
+
+	results := s.fanOut(req.Keys, r, func(idx []int) ([]BatchResult, error) {
+		keys := subset(req.Keys, idx)
+		values, err := kv.GetKeys(keys)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]BatchResult, len(keys))
+		for i, key := range keys {
+			res[i] = BatchResult{Key: key}
+			if value, ok := values[key]; ok {
+				res[i].Value = &value
+			}
+		}
+		return res, nil
+	}, func(idx []int) BatchRequest {
+		return BatchRequest{Keys: subset(req.Keys, idx)}
+	})
+	json.NewEncoder(w).Encode(&BatchResponse{Results: results})
+}
+
+// MSetHandler writes many keys at once, the keys of each shard are written in a single transaction of
+// its leader so that either all of them or none are stored
+func (s *Server) MSetHandler(w http.ResponseWriter, r *http.Request) {
+	req, kv, ok := s.readBatch(w, r)
+	if !ok {
+		return
+	}
+	if len(req.Items) == 0 {
+		batchError(w, http.StatusBadRequest, "items is empty")
+		return
+	}
+	keys := make([]string, len(req.Items))
+	values := make([]db.Value, len(req.Items))
+	for i, item := range req.Items {
+		keys[i] = item.Key
+		if len(item.Value) == 0 {
+			batchError(w, http.StatusBadRequest, fmt.Sprintf("value of key %q is empty", item.Key))
+			return
+		}
+		if int64(len(item.Value)) > s.maxValueSize {
+			batchError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("value of key %q larger than %d bytes", item.Key, s.maxValueSize))
+			return
+		}
+		expiresAt, err := ttlExpiry(item.TTL)
+		if err != nil {
+			batchError(w, http.StatusBadRequest, fmt.Sprintf("key %q: %v", item.Key, err))
+			return
+		}
+		values[i] = db.Value{Data: item.Value, ContentType: item.ContentType, ExpiresAt: expiresAt}
+	}
+	if !validKeys(w, keys) {
+		return
+	}
+
+	results := s.fanOut(keys, r, func(idx []int) ([]BatchResult, error) {
+		pairs := make([]db.KeyValue, len(idx))
+		for i, j := range idx {
+			pairs[i] = db.KeyValue{Key: keys[j], Value: values[j]}
+		}
+		versions, err := kv.SetKeys(pairs)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]BatchResult, len(pairs))
+		for i, p := range pairs {
+			res[i] = BatchResult{Key: p.Key, Version: versions[i]}
+		}
+		return res, nil
+	}, func(idx []int) BatchRequest {
+		items := make([]BatchItem, len(idx))
+		for i, j := range idx {
+			items[i] = req.Items[j]
+		}
+		return BatchRequest{Items: items}
+	})
+	json.NewEncoder(w).Encode(&BatchResponse{Results: results})
+}
+
+// MDeleteHandler deletes many keys at once, in a single transaction per shard
+func (s *Server) MDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	req, kv, ok := s.readBatch(w, r)
+	if !ok {
+		return
+	}
+	if len(req.Keys) == 0 {
+		batchError(w, http.StatusBadRequest, "keys is empty")
+		return
+	}
+	if !validKeys(w, req.Keys) {
+		return
+	}
+
+	results := s.fanOut(req.Keys, r, func(idx []int) ([]BatchResult, error) {
+		keys := subset(req.Keys, idx)
+		if err := kv.DeleteKeys(keys); err != nil {
+			return nil, err
+		}
+		res := make([]BatchResult, len(keys))
+		for i, key := range keys {
+			res[i] = BatchResult{Key: key}
+		}
+		return res, nil
+	}, func(idx []int) BatchRequest {
+		return BatchRequest{Keys: subset(req.Keys, idx)}
+	})
+	json.NewEncoder(w).Encode(&BatchResponse{Results: results})
+}
+
+// readBatch decodes the body of a batch request and returns the database of its namespace
+func (s *Server) readBatch(w http.ResponseWriter, r *http.Request) (BatchRequest, *db.KVDatabase, bool) {
+	var req BatchRequest
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		batchError(w, http.StatusMethodNotAllowed, "batches must be sent with POST")
+		return req, nil, false
+	}
+	if !s.checkShardMap(w, r) {
+		return req, nil, false
+	}
+	kv, status, err := s.lookupNamespace(r)
+	if err != nil {
+		batchError(w, status, err.Error())
+		return req, nil, false
+	}
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&req)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		batchError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("batch larger than %d bytes", maxBatchBytes))
+		return req, nil, false
+	}
+	if err != nil {
+		batchError(w, http.StatusBadRequest, fmt.Sprintf("invalid batch: %v", err))
+		return req, nil, false
+	}
+	if len(req.Keys)+len(req.Items) > maxBatchKeys {
+		batchError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("a batch has at most %d keys", maxBatchKeys))
+		return req, nil, false
+	}
+	return req, kv, true
+}
+
+func validKeys(w http.ResponseWriter, keys []string) bool {
+	for _, key := range keys {
+		if key == "" {
+			batchError(w, http.StatusBadRequest, "key is empty")
+			return false
+		}
+	}
+	return true
+}
+
+func batchError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&BatchResponse{Err: msg})
+}
+
+func subset(keys []string, idx []int) []string {
+	res := make([]string, len(idx))
+	for i, j := range idx {
+		res[i] = keys[j]
+	}
+	return res
+}
+
+// fanOut groups the keys by shard and runs each group on the leader of its shard, in parallel: local
+// runs the group on this node and remote builds the request sent to the other leaders. An error of a
+// shard is reported on each of its keys, and the results are returned in the order of the keys.
+func (s *Server) fanOut(keys []string, r *http.Request, local func(idx []int) ([]BatchResult, error), remote func(idx []int) BatchRequest) []BatchResult {
+	groups := make(map[int][]int)
+	for i, key := range keys {
+		shard := s.shardMetadata.GetShard(key)
+		groups[shard] = append(groups[shard], i)
+	}
+
+	results := make([]BatchResult, len(keys))
+	var wg sync.WaitGroup
+	for shard, idx := range groups {
+		wg.Add(1)
+		go func(shard int, idx []int) {
+			defer wg.Done()
+			var res []BatchResult
+			var err error
+			switch {
+			case shard == s.shardMetadata.CurrentShard() && !s.db.ReadOnly():
+				res, err = local(idx)
+			case r.Header.Get(forwardedHeader) != "":
+				// the sender grouped the keys with another shard map, it retries them itself
+				err = fmt.Errorf("not the leader of shard %d", shard)
+			default:
+				res, err = s.batchShard(shard, r, remote(idx))
+			}
+			if err == nil && len(res) != len(idx) {
+				err = fmt.Errorf("got %d results for %d keys", len(res), len(idx))
+			}
+			if err != nil {
+				log.Printf("error running batch on shard %d: %v", shard, err)
+			}
+			for j, i := range idx {
+				if err != nil {
+					results[i] = BatchResult{Key: keys[i], Err: fmt.Sprintf("shard %d: %v", shard, err)}
+					continue
+				}
+				results[i] = res[j]
+			}
+		}(shard, idx)
+	}
+	wg.Wait()
+	return results
+}
+
+// batchShard sends the part of the batch owned by the shard to its leader
+func (s *Server) batchShard(shard int, r *http.Request, batch BatchRequest) ([]BatchResult, error) {
+	body, err := json.Marshal(&batch)
+	if err != nil {
+		return nil, err
+	}
+	req := r.Clone(r.Context())
+	req.RequestURI = r.URL.Path
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	resp, err := s.forward(s.shardMetadata.Leader(shard), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res BatchResponse
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	switch {
+	case res.Err != "":
+		return nil, fmt.Errorf("%s", res.Err)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s", resp.Status)
+	case err != nil:
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+	return res.Results, nil
+}
@@ -0,0 +1,77 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// IncrHandler atomically adds delta (1 by default) to the integer value of a key, /incr?key=&delta=, and
+// answers with the new value. A missing key counts as 0, a ttl sets the expiry of a counter it creates.
+func (s *Server) IncrHandler(w http.ResponseWriter, r *http.Request) {
+	s.counter(1, w, r)
+}
+
+// DecrHandler atomically subtracts delta (1 by default) from the integer value of a key, /decr?key=&delta=
+func (s *Server) DecrHandler(w http.ResponseWriter, r *http.Request) {
+	s.counter(-1, w, r)
+}
+
+func (s *Server) counter(sign int64, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("counters are updated with POST"))
+		return
+	}
+	if !s.checkShardMap(w, r) {
+		return
+	}
+	kv, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	key := q.Get("key")
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("key is empty"))
+		return
+	}
+	delta := int64(1)
+	if raw := q.Get("delta"); raw != "" {
+		var err error
+		if delta, err = strconv.ParseInt(raw, 10, 64); err != nil || delta == math.MinInt64 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("invalid delta %q", raw)))
+			return
+		}
+	}
+	expiresAt, ok := parseTTL(q.Get("ttl"), w)
+	if !ok {
+		return
+	}
+	shard := s.shardMetadata.GetShard(key)
+	if !s.ownsWrite(shard, w, r) {
+		return
+	}
+
+	n, version, err := kv.IncrementExpiring(key, sign*delta, expiresAt)
+	if errors.Is(err, db.ErrNotNumeric) || errors.Is(err, db.ErrOverflow) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Println(fmt.Sprintf("Shard = %d, current shard = %d, addr = %q, counter %q = %d", shard, s.shardMetadata.CurrentShard(), s.shardMetadata.Leader(shard), key, n))
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("ETag", etag(version))
+	w.Write([]byte(strconv.FormatInt(n, 10)))
+}
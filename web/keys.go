@@ -0,0 +1,258 @@
+package web
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeysPrefix is the path of the key resource, /v1/keys/{key}
+const KeysPrefix = "/v1/keys/"
+
+// KeysHandler serves the /v1/keys/{key} resource: GET and HEAD read the key, PUT stores the request
+// body as its value and DELETE removes it
+func (s *Server) KeysHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, KeysPrefix)
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("key is empty"))
+		return
+	}
+	if !s.checkShardMap(w, r) {
+		return
+	}
+	kv, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.getKey(kv, key, w, r)
+	case http.MethodPut:
+		value, ok := s.readValue(w, r)
+		if !ok {
+			return
+		}
+		if value.ExpiresAt, ok = parseTTL(r.URL.Query().Get("ttl"), w); !ok {
+			return
+		}
+		cond, ok := parseCondition(w, r)
+		if !ok {
+			return
+		}
+		if s.setKey(kv, key, value, cond, w, r) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case http.MethodDelete:
+		cond, ok := parseCondition(w, r)
+		if !ok {
+			return
+		}
+		if s.deleteKey(kv, key, cond, w, r) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// readValue reads the raw request body as the value, up to the maximum value size, and keeps its
+// content type. The body is buffered so that it can be sent again if the write is forwarded.
+func (s *Server) readValue(w http.ResponseWriter, r *http.Request) (db.Value, bool) {
+	if r.ContentLength > s.maxValueSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("value larger than %d bytes", s.maxValueSize)))
+		return db.Value{}, false
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxValueSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("value larger than %d bytes", s.maxValueSize)))
+		return db.Value{}, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return db.Value{}, false
+	}
+	if len(data) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("value is empty"))
+		return db.Value{}, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	return db.Value{Data: data, ContentType: r.Header.Get("Content-Type")}, true
+}
+
+// parseTTL turns the ttl parameter, a Go duration or a number of seconds, into the expiry of the value.
+// No ttl means the value never expires.
+func parseTTL(raw string, w http.ResponseWriter) (int64, bool) {
+	expiresAt, err := ttlExpiry(raw)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return 0, false
+	}
+	return expiresAt, true
+}
+
+// ttlExpiry returns the unix time in nanoseconds at which a value written now with the ttl expires
+func ttlExpiry(raw string) (int64, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(raw)
+	if err != nil {
+		seconds, convErr := strconv.ParseInt(raw, 10, 64)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid ttl %q: %v", raw, err)
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("ttl %q must be positive", raw)
+	}
+	return time.Now().Add(ttl).UnixNano(), nil
+}
+
+// etag formats the version of a value as an entity tag
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// parseCondition reads the preconditions of a write: If-None-Match: * only writes an absent key and
+// If-Match: "<version>" only writes the key if it still has the version returned in its ETag
+func parseCondition(w http.ResponseWriter, r *http.Request) (db.Condition, bool) {
+	var cond db.Condition
+	if raw := r.Header.Get("If-None-Match"); raw != "" {
+		if raw != "*" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("only If-None-Match: * is supported on writes"))
+			return cond, false
+		}
+		cond.IfAbsent = true
+	}
+	if raw := r.Header.Get("If-Match"); raw != "" {
+		version, err := strconv.ParseUint(strings.Trim(raw, `"`), 10, 64)
+		if err != nil || version == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("invalid If-Match %q, expected the ETag of the key", raw)))
+			return cond, false
+		}
+		cond.IfVersion = version
+	}
+	return cond, true
+}
+
+// writeError answers a failed write, conflicts with the precondition are reported with 409 for a key
+// that already exists or is locked by a prepared transaction and 412 for a version mismatch, and a write
+// past the quota of its namespace with 507
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrExists), errors.Is(err, db.ErrLocked):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, db.ErrVersionMismatch):
+		w.WriteHeader(http.StatusPreconditionFailed)
+	case errors.Is(err, db.ErrQuotaExceeded):
+		w.WriteHeader(http.StatusInsufficientStorage)
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+// getKey serves the value of the key of the namespace, from this node when the requested consistency allows it
+func (s *Server) getKey(kv *db.KVDatabase, key string, w http.ResponseWriter, r *http.Request) {
+	consistency, maxStaleness, err := parseConsistency(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	shard := s.shardMetadata.GetShard(key)
+	if !s.serveLocally(shard, consistency, maxStaleness) {
+		if consistency == ConsistencyLeader || shard == s.shardMetadata.CurrentShard() {
+			s.redirect(shard, w, r)
+		} else {
+			s.readFromReplicas(shard, w, r)
+		}
+		return
+	}
+	// the value is streamed from the database without being copied, within the read transaction that a
+	// slow client must not hold open for long
+	size, sent := 0, false
+	err = kv.ReadKey(key, func(value db.Value) error {
+		if value.ContentType != "" {
+			w.Header().Set("Content-Type", value.ContentType)
+		}
+		w.Header().Set("ETag", etag(value.Version))
+		w.Header().Set("Content-Length", strconv.Itoa(len(value.Data)))
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(valueWriteTimeout))
+		size, sent = len(value.Data), true
+		_, err := w.Write(value.Data)
+		return err
+	})
+	switch {
+	case sent && err != nil:
+		log.Println(err)
+		return
+	case errors.Is(err, db.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("key %q not found", key)))
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		log.Println(err)
+		return
+	}
+	log.Println(fmt.Sprintf("Shard = %d, current shard = %d, addr = %q, %d bytes", shard, s.shardMetadata.CurrentShard(), s.shardMetadata.Leader(shard), size))
+}
+
+// valueWriteTimeout bounds the time a client takes to read a value
+const valueWriteTimeout = 30 * time.Second
+
+// setKey stores the value in the namespace on the leader of the key's shard and reports whether this
+// node applied it, otherwise the response has already been written
+func (s *Server) setKey(kv *db.KVDatabase, key string, value db.Value, cond db.Condition, w http.ResponseWriter, r *http.Request) bool {
+	shard := s.shardMetadata.GetShard(key)
+	if !s.ownsWrite(shard, w, r) {
+		return false
+	}
+
+	version, err := kv.SetKeyIf(key, value, cond)
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+	w.Header().Set("ETag", etag(version))
+	log.Println(fmt.Sprintf("Shard = %d, current shard = %d, addr = %q, %d bytes", shard, s.shardMetadata.CurrentShard(), s.shardMetadata.Leader(shard), len(value.Data)))
+	return true
+}
+
+// deleteKey removes the key of the namespace on the leader of its shard and reports whether this node
+// applied it, otherwise the response has already been written
+func (s *Server) deleteKey(kv *db.KVDatabase, key string, cond db.Condition, w http.ResponseWriter, r *http.Request) bool {
+	shard := s.shardMetadata.GetShard(key)
+	if !s.ownsWrite(shard, w, r) {
+		return false
+	}
+
+	if err := kv.DeleteKeyIf(key, cond); err != nil {
+		writeError(w, err)
+		return false
+	}
+	log.Println(fmt.Sprintf("Shard = %d, current shard = %d, addr = %q, deleted key = %q", shard, s.shardMetadata.CurrentShard(), s.shardMetadata.Leader(shard), key))
+	return true
+}
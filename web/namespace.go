@@ -0,0 +1,199 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// namespaceHeader selects the namespace of the keys of a request, as does the namespace parameter
+const namespaceHeader = "X-Kv-Namespace"
+
+// NamespacesPrefix is the path of the namespace resource, /admin/namespaces/{name}
+const NamespacesPrefix = "/admin/namespaces/"
+
+// NamespaceQuota is the body of PUT /admin/namespaces/{name}, a zero quota is no limit
+type NamespaceQuota struct {
+	MaxKeys  int64 `json:"maxKeys,omitempty"`
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+}
+
+// NamespacesResponse lists the namespaces of a shard, or the namespace created on each shard
+type NamespacesResponse struct {
+	Namespaces []db.Namespace `json:"namespaces"`
+	// Shards is the shard of each namespace when it was created on every shard
+	Shards []int  `json:"shards,omitempty"`
+	Err    string `json:"err,omitempty"`
+}
+
+// namespace returns the database of the namespace requested with the namespace parameter or the
+// X-Kv-Namespace header, the default namespace when there is none, and answers the request otherwise
+func (s *Server) namespace(w http.ResponseWriter, r *http.Request) (*db.KVDatabase, bool) {
+	kv, status, err := s.lookupNamespace(r)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return nil, false
+	}
+	return kv, true
+}
+
+// lookupNamespace returns the database of the requested namespace, or the status answering a request for
+// an invalid or unknown one. The name is set on the header so that it follows the request when it is
+// forwarded.
+func (s *Server) lookupNamespace(r *http.Request) (*db.KVDatabase, int, error) {
+	name := r.URL.Query().Get("namespace")
+	if name == "" {
+		name = r.Header.Get(namespaceHeader)
+	}
+	if name == "" {
+		return s.db, http.StatusOK, nil
+	}
+	if err := db.ValidNamespace(name); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	kv, err := s.db.Namespace(name)
+	if errors.Is(err, db.ErrNoNamespace) {
+		return nil, http.StatusNotFound, err
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, http.StatusInternalServerError, err
+	}
+	r.Header.Set(namespaceHeader, name)
+	return kv, http.StatusOK, nil
+}
+
+// NamespacesHandler lists the namespaces of this shard with their usage on GET /admin/namespaces, and
+// creates a namespace or sets its quotas on PUT /admin/namespaces/{name}. Namespaces exist on every
+// shard, so a namespace is created by the leader of each shard and its quotas apply to each shard.
+func (s *Server) NamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(NamespacesPrefix, "/")), "/")
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		namespaces, err := s.db.Namespaces()
+		if err != nil {
+			log.Println(err)
+			namespaceError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if namespaces == nil {
+			namespaces = []db.Namespace{}
+		}
+		json.NewEncoder(w).Encode(&NamespacesResponse{Namespaces: namespaces})
+	case r.Method == http.MethodPut && name != "":
+		s.createNamespace(name, w, r)
+	case name == "":
+		w.Header().Set("Allow", http.MethodGet)
+		namespaceError(w, http.StatusMethodNotAllowed, "namespaces are listed with GET")
+	default:
+		w.Header().Set("Allow", http.MethodPut)
+		namespaceError(w, http.StatusMethodNotAllowed, "namespaces are created with PUT")
+	}
+}
+
+func (s *Server) createNamespace(name string, w http.ResponseWriter, r *http.Request) {
+	if !s.checkShardMap(w, r) {
+		return
+	}
+	if err := db.ValidNamespace(name); err != nil {
+		namespaceError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	var quota NamespaceQuota
+	if err == nil && len(body) > 0 {
+		err = json.Unmarshal(body, &quota)
+	}
+	if err != nil {
+		namespaceError(w, http.StatusBadRequest, fmt.Sprintf("invalid quota: %v", err))
+		return
+	}
+	if quota.MaxKeys < 0 || quota.MaxBytes < 0 {
+		namespaceError(w, http.StatusBadRequest, "quotas can not be negative")
+		return
+	}
+
+	if r.Header.Get(forwardedHeader) != "" {
+		// the node that received the request creates the namespace on the other shards itself
+		if s.db.ReadOnly() {
+			namespaceError(w, http.StatusServiceUnavailable, fmt.Sprintf("not the leader of shard %d", s.shardMetadata.CurrentShard()))
+			return
+		}
+		n, err := s.db.CreateNamespace(name, quota.MaxKeys, quota.MaxBytes)
+		if err != nil {
+			log.Println(err)
+			namespaceError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(&NamespacesResponse{Namespaces: []db.Namespace{n}, Shards: []int{s.shardMetadata.CurrentShard()}})
+		return
+	}
+
+	shards := s.shardMetadata.Shards()
+	created := make([]db.Namespace, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i, shard int) {
+			defer wg.Done()
+			if shard == s.shardMetadata.CurrentShard() && !s.db.ReadOnly() {
+				created[i], errs[i] = s.db.CreateNamespace(name, quota.MaxKeys, quota.MaxBytes)
+				return
+			}
+			created[i], errs[i] = s.createNamespaceOn(shard, body, r)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			// creating a namespace again is harmless, the request can be retried
+			log.Printf("error creating namespace %s on shard %d: %v", name, shards[i], err)
+			namespaceError(w, http.StatusBadGateway, fmt.Sprintf("shard %d: %v", shards[i], err))
+			return
+		}
+	}
+	log.Printf("Created namespace %s on shards %v", name, shards)
+	json.NewEncoder(w).Encode(&NamespacesResponse{Namespaces: created, Shards: shards})
+}
+
+// createNamespaceOn forwards the creation of the namespace to the leader of the shard
+func (s *Server) createNamespaceOn(shard int, body []byte, r *http.Request) (db.Namespace, error) {
+	req := r.Clone(r.Context())
+	req.RequestURI = r.URL.Path
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	resp, err := s.forward(s.shardMetadata.Leader(shard), req)
+	if err != nil {
+		return db.Namespace{}, err
+	}
+	defer resp.Body.Close()
+	var res NamespacesResponse
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	switch {
+	case res.Err != "":
+		return db.Namespace{}, fmt.Errorf("%s", res.Err)
+	case resp.StatusCode != http.StatusOK:
+		return db.Namespace{}, fmt.Errorf("%s", resp.Status)
+	case err != nil:
+		return db.Namespace{}, fmt.Errorf("error decoding response: %w", err)
+	case len(res.Namespaces) != 1:
+		return db.Namespace{}, fmt.Errorf("got %d namespaces", len(res.Namespaces))
+	}
+	return res.Namespaces[0], nil
+}
+
+func namespaceError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&NamespacesResponse{Err: msg})
+}
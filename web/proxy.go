@@ -0,0 +1,172 @@
+package web
+
+import (
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/auth"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/certs"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hopsHeader counts the nodes a request was forwarded by, so that nodes disagreeing on the owner of a
+// key do not forward it between each other forever
+const hopsHeader = "X-Kv-Hops"
+
+// maxHops is the number of forwards after which a request is rejected with 508
+const maxHops = 3
+
+// hopByHopHeaders only apply to a single connection and are not proxied
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// newProxyClient returns the client forwarding requests, it keeps connections to the other nodes open.
+// There is no overall timeout so that large values can be streamed, a forwarded request is cancelled
+// when the client that sent it goes away. With certs the nodes are reached over mutual TLS, and with a
+// credential the requests are authenticated as this node.
+func newProxyClient(certs *certs.Reloader, cred *auth.Credential) *http.Client {
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+	}
+	if certs != nil {
+		transport.DialTLSContext = certs.DialTLSContext
+	}
+	client := &http.Client{
+		Transport: transport,
+		// a node answering with a redirect passes it on to the client
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if cred != nil {
+		client.Transport = auth.NewTransport(transport, cred)
+	}
+	return client
+}
+
+// hops returns the number of nodes the request was forwarded by
+func hops(r *http.Request) int {
+	n, err := strconv.Atoi(r.Header.Get(hopsHeader))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// canForward rejects requests that were already forwarded maxHops times
+func canForward(w http.ResponseWriter, r *http.Request) bool {
+	if hops(r) < maxHops {
+		return true
+	}
+	log.Printf("dropping %s %s forwarded %d times, the nodes disagree on the owner", r.Method, r.URL.Path, hops(r))
+	w.WriteHeader(http.StatusLoopDetected)
+	w.Write([]byte(fmt.Sprintf("request forwarded %d times", hops(r))))
+	return false
+}
+
+// forward sends the request to addr on behalf of this node with its method, body and end-to-end
+// headers, tagged with the local shard map version
+func (s *Server) forward(addr string, r *http.Request) (*http.Response, error) {
+	body, length := io.Reader(r.Body), r.ContentLength
+	if r.PostForm != nil && isForm(r) {
+		// ParseForm consumed the body of the form, it is sent encoded again from the parsed values
+		form := r.PostForm.Encode()
+		body, length = strings.NewReader(form), int64(len(form))
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, s.scheme+"://"+addr+r.RequestURI, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = length
+	req.Header = r.Header.Clone()
+	for _, h := range hopByHopHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set(forwardedHeader, "true")
+	req.Header.Set(hopsHeader, strconv.Itoa(hops(r)+1))
+	req.Header.Set(shardMapHeader, strconv.FormatUint(s.shardMetadata.Version(), 10))
+	return s.client.Do(req)
+}
+
+// redirect hands the request over to the leader of the shard, by proxying it or, for client requests
+// with WithClientRedirects, by redirecting the client to it
+func (s *Server) redirect(shard int, w http.ResponseWriter, r *http.Request) {
+	addr := s.shardMetadata.Leader(shard)
+	if s.clientRedirects && r.Header.Get(forwardedHeader) == "" {
+		http.Redirect(w, r, s.scheme+"://"+addr+r.RequestURI, http.StatusTemporaryRedirect)
+		return
+	}
+	if !canForward(w, r) {
+		return
+	}
+	log.Printf("forwarding %s %s to %s, leader of shard %d", r.Method, r.URL.Path, addr, shard)
+	resp, err := s.forward(addr, r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(err.Error()))
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	copyResponse(w, resp)
+}
+
+// isForm reports whether the body of the request is a form that ParseForm reads
+func isForm(r *http.Request) bool {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		return false
+	}
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && ct == "application/x-www-form-urlencoded"
+}
+
+// copyResponse streams the response of another node with its status and end-to-end headers
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	for h, values := range resp.Header {
+		w.Header()[h] = append([]string(nil), values...)
+	}
+	for _, h := range hopByHopHeaders {
+		w.Header().Del(h)
+	}
+	w.WriteHeader(resp.StatusCode)
+	var dst io.Writer = w
+	if flusher, ok := w.(http.Flusher); ok && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		// events are passed on as soon as they arrive
+		dst = flushWriter{w: w, flusher: flusher}
+	}
+	if _, err := io.Copy(dst, resp.Body); err != nil {
+		log.Println(err)
+	}
+}
+
+// flushWriter flushes every write to the client
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.flusher.Flush()
+	return n, err
+}
@@ -0,0 +1,125 @@
+package web
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Consistency is the read consistency requested on /get
+type Consistency string
+
+const (
+	// ConsistencyLeader reads from the leader of the shard owning the key
+	ConsistencyLeader Consistency = "leader"
+	// ConsistencyAny reads from any replica of the shard owning the key
+	ConsistencyAny Consistency = "any"
+	// ConsistencyBoundedStaleness reads from a replica that was caught up within max_staleness
+	ConsistencyBoundedStaleness Consistency = "bounded-staleness"
+)
+
+// defaultMaxStaleness is used for bounded-staleness reads without a max_staleness parameter
+const defaultMaxStaleness = 5 * time.Second
+
+// unhealthyCooldown is how long a replica is skipped after a failed read
+const unhealthyCooldown = 5 * time.Second
+
+func parseConsistency(r *http.Request) (Consistency, time.Duration, error) {
+	c := Consistency(r.Form.Get("consistency"))
+	switch c {
+	case "":
+		c = ConsistencyLeader
+	case ConsistencyLeader, ConsistencyAny, ConsistencyBoundedStaleness:
+	default:
+		return "", 0, fmt.Errorf("unknown consistency %q", c)
+	}
+
+	maxStaleness := defaultMaxStaleness
+	if v := r.Form.Get("max_staleness"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid max_staleness %q: %w", v, err)
+		}
+		maxStaleness = d
+	}
+	return c, maxStaleness, nil
+}
+
+// replicaHealth remembers the replicas that recently failed to serve a read
+type replicaHealth struct {
+	mu        sync.Mutex
+	downUntil map[string]time.Time
+	next      int
+}
+
+func (h *replicaHealth) markDown(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.downUntil == nil {
+		h.downUntil = make(map[string]time.Time)
+	}
+	h.downUntil[addr] = time.Now().Add(unhealthyCooldown)
+}
+
+// candidates returns the healthy replicas, rotated so that reads are spread across them
+func (h *replicaHealth) candidates(replicas []string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var healthy []string
+	for _, r := range replicas {
+		if time.Now().After(h.downUntil[r]) {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	h.next++
+	start := h.next % len(healthy)
+	return append(healthy[start:], healthy[:start]...)
+}
+
+// serveLocally reports whether this node can answer the read itself
+func (s *Server) serveLocally(shard int, c Consistency, maxStaleness time.Duration) bool {
+	if shard != s.shardMetadata.CurrentShard() {
+		return false
+	}
+	if !s.db.ReadOnly() {
+		return true
+	}
+	switch c {
+	case ConsistencyAny:
+		return true
+	case ConsistencyBoundedStaleness:
+		return s.staleness != nil && s.staleness() <= maxStaleness
+	}
+	return false
+}
+
+// readFromReplicas forwards the read to a healthy replica of the shard, falling back to the leader
+// when none of them can serve it
+func (s *Server) readFromReplicas(shard int, w http.ResponseWriter, r *http.Request) {
+	if !canForward(w, r) {
+		return
+	}
+	for _, addr := range s.health.candidates(s.shardMetadata.ReplicasOf(shard)) {
+		resp, err := s.forward(addr, r)
+		if err != nil {
+			log.Printf("replica %s of shard %d failed: %v", addr, shard, err)
+			s.health.markDown(addr)
+			continue
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			log.Printf("replica %s of shard %d returned %s", addr, shard, resp.Status)
+			resp.Body.Close()
+			s.health.markDown(addr)
+			continue
+		}
+		copyResponse(w, resp)
+		resp.Body.Close()
+		return
+	}
+	s.redirect(shard, w, r)
+}
@@ -0,0 +1,170 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// ScanResponse is a page of keys served on /scan
+type ScanResponse struct {
+	Items []db.KeyValue `json:"items"`
+	// Cursor continues the scan after the last item, it is empty on the last page
+	Cursor string `json:"cursor,omitempty"`
+	Err    string `json:"err,omitempty"`
+}
+
+// scanRange is the range of keys requested from /scan, start is inclusive and end exclusive
+type scanRange struct {
+	start, end string
+	limit      int
+}
+
+// parseScan reads either a prefix or a start and end key, the page size and the cursor of the previous page
+func parseScan(r *http.Request) (scanRange, error) {
+	q := r.URL.Query()
+	rng := scanRange{start: q.Get("start"), end: q.Get("end"), limit: defaultScanLimit}
+	if prefix := q.Get("prefix"); prefix != "" {
+		if rng.start != "" || rng.end != "" {
+			return rng, fmt.Errorf("prefix can not be combined with start or end")
+		}
+		rng.start, rng.end = prefix, db.PrefixEnd(prefix)
+	}
+	if raw := q.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return rng, fmt.Errorf("invalid limit %q", raw)
+		}
+		rng.limit = limit
+	}
+	if rng.limit > maxScanLimit {
+		rng.limit = maxScanLimit
+	}
+	if raw := q.Get("cursor"); raw != "" {
+		after, err := base64.RawURLEncoding.DecodeString(raw)
+		if err != nil {
+			return rng, fmt.Errorf("invalid cursor %q", raw)
+		}
+		// the smallest key after the last one returned
+		if next := string(after) + "\x00"; next > rng.start {
+			rng.start = next
+		}
+	}
+	return rng, nil
+}
+
+// ScanHandler lists the keys of a range or prefix in key order, a page at a time. Keys are spread over
+// the shards by hash, so every shard leader is asked for a page and the pages are merged.
+func (s *Server) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		enc.Encode(&ScanResponse{Err: "scans must be requested with GET"})
+		return
+	}
+	if !s.checkShardMap(w, r) {
+		return
+	}
+	rng, err := parseScan(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(&ScanResponse{Err: err.Error()})
+		return
+	}
+	kv, status, err := s.lookupNamespace(r)
+	if err != nil {
+		w.WriteHeader(status)
+		enc.Encode(&ScanResponse{Err: err.Error()})
+		return
+	}
+
+	if r.Header.Get(forwardedHeader) != "" {
+		// another node is fanning the scan out, only the local shard is scanned
+		pairs, err := kv.Scan(rng.start, rng.end, rng.limit)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(&ScanResponse{Err: err.Error()})
+			return
+		}
+		enc.Encode(&ScanResponse{Items: pairs})
+		return
+	}
+
+	shards := s.shardMetadata.Shards()
+	pages := make([][]db.KeyValue, len(shards))
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i, shard int) {
+			defer wg.Done()
+			pages[i], errs[i] = s.scanShard(kv, shard, rng, r)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	var merged []db.KeyValue
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("error scanning shard %d: %v", shards[i], err)
+			w.WriteHeader(http.StatusBadGateway)
+			enc.Encode(&ScanResponse{Err: fmt.Sprintf("shard %d: %v", shards[i], err)})
+			return
+		}
+		merged = append(merged, pages[i]...)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Key < merged[j].Key })
+
+	res := &ScanResponse{Items: merged}
+	if len(merged) >= rng.limit {
+		// a shard may have more keys in the range
+		res.Items = merged[:rng.limit]
+		res.Cursor = base64.RawURLEncoding.EncodeToString([]byte(res.Items[rng.limit-1].Key))
+	}
+	if res.Items == nil {
+		res.Items = []db.KeyValue{}
+	}
+	enc.Encode(res)
+}
+
+// scanShard returns a page of the range of the namespace from the leader of the shard
+func (s *Server) scanShard(kv *db.KVDatabase, shard int, rng scanRange, r *http.Request) ([]db.KeyValue, error) {
+	if shard == s.shardMetadata.CurrentShard() && !s.db.ReadOnly() {
+		return kv.Scan(rng.start, rng.end, rng.limit)
+	}
+	q := url.Values{}
+	q.Set("start", rng.start)
+	q.Set("end", rng.end)
+	q.Set("limit", strconv.Itoa(rng.limit))
+	req := r.Clone(r.Context())
+	req.RequestURI = "/scan?" + q.Encode()
+
+	resp, err := s.forward(s.shardMetadata.Leader(shard), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var page ScanResponse
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	switch {
+	case page.Err != "":
+		return nil, fmt.Errorf("%s", page.Err)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s", resp.Status)
+	case err != nil:
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+	return page.Items, nil
+}
@@ -2,147 +2,425 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/auth"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/certs"
 	"github.com/Vignesh-Rajarajan/distributed-kv-store/config"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/consensus"
 	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
 	"github.com/Vignesh-Rajarajan/distributed-kv-store/replication"
-	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type Server struct {
 	db            *db.KVDatabase
 	shardMetadata *config.ShardMetadata
+	// staleness reports how far behind its leader this node is, only set on replicas
+	staleness func() time.Duration
+	health    replicaHealth
+	// maxValueSize is the largest value accepted by writes, larger ones are rejected with 413
+	maxValueSize int64
+	// client forwards requests to the other nodes, clientRedirects sends clients there with a 307 instead
+	client          *http.Client
+	clientRedirects bool
+	// auth authenticates the requests of the endpoints wrapped with Authorize, nil when auth is disabled,
+	// and credential authenticates the requests forwarded to the other nodes
+	auth       *auth.Authenticator
+	credential *auth.Credential
+	// certs connects to the other nodes with mutual TLS, scheme is https when it is set
+	certs  *certs.Reloader
+	scheme string
+	// coordinating holds the ids of the cross-shard transactions this node is running
+	coordinating sync.Map
 }
 
-func NewServer(db *db.KVDatabase, s *config.ShardMetadata) *Server {
-	return &Server{
+// DefaultMaxValueSize is the largest value accepted by default
+const DefaultMaxValueSize = 4 << 20
+
+// Option configures optional behaviour of the Server
+type Option func(*Server)
+
+// WithStaleness lets a replica serve bounded-staleness reads while it is close enough to its leader
+func WithStaleness(staleness func() time.Duration) Option {
+	return func(s *Server) {
+		s.staleness = staleness
+	}
+}
+
+// WithMaxValueSize sets the largest value, in bytes, accepted by writes
+func WithMaxValueSize(size int64) Option {
+	return func(s *Server) {
+		s.maxValueSize = size
+	}
+}
+
+// WithTLS forwards requests to the other nodes, and redirects clients to them, over TLS. The node
+// presents its certificate to the other nodes.
+func WithTLS(certs *certs.Reloader) Option {
+	return func(s *Server) {
+		s.certs = certs
+		s.scheme = "https"
+	}
+}
+
+// WithClientRedirects answers client requests for another shard with a 307 to its leader instead of
+// proxying them, requests forwarded by other nodes are still proxied
+func WithClientRedirects() Option {
+	return func(s *Server) {
+		s.clientRedirects = true
+	}
+}
+
+func NewServer(db *db.KVDatabase, s *config.ShardMetadata, opts ...Option) *Server {
+	server := &Server{
 		db:            db,
 		shardMetadata: s,
+		maxValueSize:  DefaultMaxValueSize,
+		scheme:        "http",
+	}
+	for _, opt := range opts {
+		opt(server)
 	}
+	server.client = newProxyClient(server.certs, server.credential)
+	return server
 }
 
-func (s *Server) redirect(shard int, w http.ResponseWriter, r *http.Request) {
-	log.Printf("Redirecting request to shard %d", shard)
-	for k, v := range s.shardMetadata.Addrs {
-		log.Printf("Key %d, val %s", k, v)
+// forwardedHeader marks requests forwarded by another node
+const forwardedHeader = "X-Kv-Forwarded"
+
+// shardMapHeader carries the version of the shard map a request was routed with, responses carry
+// the version of the node that served them
+const shardMapHeader = "X-Kv-Shard-Map-Version"
+
+// checkShardMap rejects requests routed with an older shard map than the local one, the sender
+// may have picked the wrong shard for the key
+func (s *Server) checkShardMap(w http.ResponseWriter, r *http.Request) bool {
+	current := s.shardMetadata.Version()
+	w.Header().Set(shardMapHeader, strconv.FormatUint(current, 10))
+	raw := r.Header.Get(shardMapHeader)
+	if raw == "" {
+		return true
 	}
-	url := "http://" + s.shardMetadata.Addrs[shard] + r.RequestURI
-	log.Println("Redirecting to ", url)
-	resp, err := http.Get(url)
+	version, err := strconv.ParseUint(raw, 10, 64)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		log.Println(err)
-		return
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("invalid %s: %v", shardMapHeader, err)))
+		return false
 	}
-	defer resp.Body.Close()
-	_, err = io.Copy(w, resp.Body)
-	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+	if version < current {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("stale shard map version %d, current version is %d", version, current)))
+		return false
 	}
+	return true
 }
 
+// ownsWrite reports whether this node is the leader of the shard and can apply the write itself,
+// otherwise the write is forwarded to the leader
+func (s *Server) ownsWrite(shard int, w http.ResponseWriter, r *http.Request) bool {
+	if shard == s.shardMetadata.CurrentShard() && !s.db.ReadOnly() {
+		return true
+	}
+	if shard == s.shardMetadata.CurrentShard() && r.Header.Get(forwardedHeader) != "" {
+		// the sender believes this node leads the shard, but it is a replica or an election is in progress
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(fmt.Sprintf("not the leader of shard %d", shard)))
+		return false
+	}
+	log.Println(fmt.Sprintf("Redirecting to shard %d", shard))
+	s.redirect(shard, w, r)
+	return false
+}
+
+// SetHandler is the legacy write endpoint, /set?key=&value= or /set?key= with the value as body, and
+// an optional ttl
 func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("SET request received")
+	if !s.checkShardMap(w, r) {
+		return
+	}
+	kv, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
 	_ = r.ParseForm()
 
 	key := r.Form.Get("key")
-	value := r.Form.Get("value")
-	if key == "" || value == "" {
-		log.Println("key or value is empty")
+	if key == "" {
+		log.Println("key is empty")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("key is empty"))
 		return
 	}
-
-	shard := s.shardMetadata.GetShard(key)
-	if shard != s.shardMetadata.CurrIdx {
-		log.Println(fmt.Sprintf("Redirecting to shard %d", shard))
-		s.redirect(shard, w, r)
+	value := db.Value{Data: []byte(r.Form.Get("value"))}
+	if len(value.Data) == 0 {
+		// without a value parameter the raw body is the value
+		if value, ok = s.readValue(w, r); !ok {
+			return
+		}
+	} else if int64(len(value.Data)) > s.maxValueSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("value larger than %d bytes", s.maxValueSize)))
 		return
 	}
-
-	err := s.db.SetKey(key, value)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		log.Println(err)
+	if value.ExpiresAt, ok = parseTTL(r.Form.Get("ttl"), w); !ok {
 		return
 	}
-	log.Println(fmt.Sprintf("Shard = %d, current shard = %d, addr = %q, Value = %q, error = %v", shard, s.shardMetadata.CurrIdx, s.shardMetadata.Addrs[shard], value, err))
+	s.setKey(kv, key, value, db.Condition{}, w, r)
 }
 
+// GetHandler is the legacy read endpoint, /get?key=
 func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("GET request received")
+	if !s.checkShardMap(w, r) {
+		return
+	}
+	kv, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
 	_ = r.ParseForm()
 
 	key := r.Form.Get("key")
 	if key == "" {
 		log.Println("key is empty")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("key is empty"))
 		return
 	}
-	shard := s.shardMetadata.GetShard(key)
-	if shard != s.shardMetadata.CurrIdx {
-		s.redirect(shard, w, r)
+	s.getKey(kv, key, w, r)
+}
+
+// DeleteHandler is the legacy delete endpoint, /delete?key=
+func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("DELETE request received")
+	if !s.checkShardMap(w, r) {
 		return
 	}
-	value, err := s.db.GetKey(key)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		log.Println(err)
+	kv, ok := s.namespace(w, r)
+	if !ok {
 		return
 	}
+	_ = r.ParseForm()
 
-	_, err = w.Write([]byte(value))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+	key := r.Form.Get("key")
+	if key == "" {
+		log.Println("key is empty")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("key is empty"))
 		return
 	}
-	log.Println(fmt.Sprintf("Shard = %d, current shard = %d, addr = %q, Value = %q, error = %v", shard, s.shardMetadata.CurrIdx, s.shardMetadata.Addrs[shard], value, err))
+	s.deleteKey(kv, key, db.Condition{}, w, r)
 }
 
 func (s *Server) DeleteKeysHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("DELETE request received")
 
-	fmt.Fprintf(w, "Error = %v", s.db.DeleteUnwantedKeys(func(key string) bool {
-		shard := s.shardMetadata.GetShard(key)
-		return shard != s.shardMetadata.CurrIdx
-	}))
+	fmt.Fprintf(w, "Error = %v", s.deleteUnwantedKeys())
+}
+
+// deleteUnwantedKeys deletes the keys of every namespace that are not present in the current shard
+func (s *Server) deleteUnwantedKeys() error {
+	namespaces, err := s.db.Namespaces()
+	if err != nil {
+		return err
+	}
+	names := []string{""}
+	for _, n := range namespaces {
+		names = append(names, n.Name)
+	}
+	for _, name := range names {
+		kv, err := s.db.Namespace(name)
+		if err != nil {
+			return err
+		}
+		err = kv.DeleteUnwantedKeys(func(key string) bool {
+			shard := s.shardMetadata.GetShard(key)
+			return shard != s.shardMetadata.CurrentShard()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *Server) ReplicateHandler(writer http.ResponseWriter, request *http.Request) {
+	_ = request.ParseForm()
 	enc := json.NewEncoder(writer)
-	k, v, err := s.db.GetKeysForReplication()
-	kv := &replication.NextKeyValue{
-		Key:   string(k),
-		Value: string(v),
+
+	from, err := strconv.ParseUint(request.Form.Get("from"), 10, 64)
+	if err != nil || from == 0 {
+		from = 1
+	}
+	limit, err := strconv.Atoi(request.Form.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = replication.DefaultBatchSize
+	}
+
+	first, last, err := s.db.LogPosition()
+	if err != nil {
+		enc.Encode(&replication.Batch{Err: fmt.Sprintf("error reading log position: %v", err)})
+		return
+	}
+	// entries before first have been truncated, a replica asking for them can no longer catch up from the log
+	if first > from || (first == 0 && from <= last) {
+		enc.Encode(&replication.Batch{Err: fmt.Sprintf("log truncated past seq %d, replica needs a full resync, restore it from a backup", from)})
+		return
+	}
+	// the replica sends the term of its entry before from, a different one was written by an earlier
+	// leader and never made it to this log
+	if request.Form.Has("term") {
+		term, err := strconv.ParseUint(request.Form.Get("term"), 10, 64)
+		if err != nil {
+			enc.Encode(&replication.Batch{Err: fmt.Sprintf("invalid term %q", request.Form.Get("term"))})
+			return
+		}
+		if res, err := s.compareLog(from-1, term, last); err != nil {
+			enc.Encode(&replication.Batch{Err: fmt.Sprintf("error reading log term: %v", err)})
+			return
+		} else if res != nil {
+			enc.Encode(res)
+			return
+		}
+	}
+	entries, err := s.db.ReadLog(from, limit)
+	if err != nil {
+		enc.Encode(&replication.Batch{Err: fmt.Sprintf("error reading log for replication: %v", err)})
+		return
+	}
+	enc.Encode(replication.NewBatch(entries, last))
+}
+
+// compareLog checks that the log has the entry at seq with the term of the replica's one, and returns
+// a diverged batch pointing the replica to an earlier entry otherwise
+func (s *Server) compareLog(seq, term, last uint64) (*replication.Batch, error) {
+	at := seq
+	if at > last {
+		at = last
 	}
+	atTerm, ok, err := s.db.TermAt(at)
+	if err != nil || (ok && at == seq && atTerm == term) {
+		return nil, err
+	}
+	conflictSeq, err := s.db.LastSeqOfTerm(at, term)
 	if err != nil {
-		kv.ErrString = fmt.Errorf("error getting key value pair for replication: %w", err)
+		return nil, err
 	}
-	enc.Encode(kv)
+	return &replication.Batch{LastSeq: last, Diverged: true, ConflictSeq: conflictSeq, ConflictTerm: atTerm}, nil
+}
 
+// ResyncHandler serves on POST /resync the current values of the keys a replica asks for, the keys
+// of the log entries it wrote as a leader and rolled back since, and the state of the cross-shard
+// transactions when the entries changed it
+func (s *Server) ResyncHandler(writer http.ResponseWriter, request *http.Request) {
+	enc := json.NewEncoder(writer)
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		enc.Encode(&replication.ResyncResponse{Err: "resyncs must be sent with POST"})
+		return
+	}
+
+	var req replication.ResyncRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		enc.Encode(&replication.ResyncResponse{Err: err.Error()})
+		return
+	}
+	res := replication.ResyncResponse{Keys: make([]db.KeyState, 0, len(req.Keys))}
+	for _, ref := range req.Keys {
+		state := db.KeyState{KeyRef: ref}
+		kv, err := s.db.Namespace(ref.Namespace)
+		if err == nil {
+			var value db.Value
+			value, err = kv.GetKey(ref.Key)
+			if err == nil {
+				state.Value = &value
+			}
+		}
+		if err != nil && !errors.Is(err, db.ErrNoNamespace) && !errors.Is(err, db.ErrNotFound) {
+			writer.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(&replication.ResyncResponse{Err: err.Error()})
+			return
+		}
+		res.Keys = append(res.Keys, state)
+	}
+	if req.Txns {
+		var err error
+		if res.Prepared, err = s.db.PreparedTxns(); err == nil {
+			res.Coordinated, err = s.db.CoordinatedTxns()
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			enc.Encode(&replication.ResyncResponse{Err: err.Error()})
+			return
+		}
+	}
+	enc.Encode(&res)
 }
 
 func (s *Server) DeleteReplicaHandler(writer http.ResponseWriter, request *http.Request) {
-	_ = request.ParseForm()
-	key := request.Form.Get("key")
-	value := request.Form.Get("value")
-	if key == "" || value == "" {
-		log.Println("key or value is empty")
+	enc := json.NewEncoder(writer)
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		enc.Encode(&replication.AckResponse{Err: "acknowledgements must be sent with POST"})
+		return
+	}
+
+	var ack replication.AckRequest
+	if err := json.NewDecoder(request.Body).Decode(&ack); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		enc.Encode(&replication.AckResponse{Err: err.Error()})
 		return
 	}
-	err := s.db.DeleteReplicaKey(key, value)
+	if !s.shardMetadata.IsReplica(s.shardMetadata.CurrentShard(), ack.Replica) {
+		writer.WriteHeader(http.StatusForbidden)
+		enc.Encode(&replication.AckResponse{Err: fmt.Sprintf("replica %q is not registered for shard %d", ack.Replica, s.shardMetadata.CurrentShard())})
+		return
+	}
+	upto, err := s.db.AckReplica(ack.Replica, ack.Upto, s.shardMetadata.ReplicasOf(s.shardMetadata.CurrentShard()))
+	if err != nil {
+		log.Println("error truncating log: ", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		enc.Encode(&replication.AckResponse{Err: err.Error()})
+		return
+	}
+	enc.Encode(&replication.AckResponse{TruncatedUpto: upto})
+}
+
+func (s *Server) ReplicationStatusHandler(writer http.ResponseWriter, request *http.Request) {
+	first, last, err := s.db.LogPosition()
 	if err != nil {
-		log.Println("error deleting key from replica: ", err)
 		writer.WriteHeader(http.StatusInternalServerError)
 		writer.Write([]byte(err.Error()))
-		log.Println(err)
 		return
 	}
-	fmt.Fprintf(writer, "ok")
+	acks, err := s.db.ReplicaAcks()
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	json.NewEncoder(writer).Encode(&replication.Status{FirstSeq: first, LastSeq: last, Replicas: acks})
+}
+
+func (s *Server) LeaderHandler(writer http.ResponseWriter, request *http.Request) {
+	var a consensus.Announcement
+	if err := json.NewDecoder(request.Body).Decode(&a); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	if a.Shard == s.shardMetadata.CurrentShard() {
+		// the election node of this shard keeps the routing of its own shard up to date
+		return
+	}
+	if s.shardMetadata.SetLeader(a.Shard, a.Leader, a.Term) {
+		log.Printf("shard %d is now led by %s (term %d)", a.Shard, a.Leader, a.Term)
+	}
 }
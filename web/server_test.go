@@ -1,21 +1,49 @@
 package web_test
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/auth"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/certs"
 	"github.com/Vignesh-Rajarajan/distributed-kv-store/config"
 	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/replication"
 	"github.com/Vignesh-Rajarajan/distributed-kv-store/web"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func createShardDb(t *testing.T, id int) *db.KVDatabase {
+	return createDb(t, id, false)
+}
+
+func createReplicaDb(t *testing.T, id int) *db.KVDatabase {
+	return createDb(t, id, true)
+}
+
+func createDb(t *testing.T, id int, readOnly bool) *db.KVDatabase {
 	f, err := os.CreateTemp(os.TempDir(), fmt.Sprintf("kvdb-%d", id))
 	assert.NoError(t, err)
 
@@ -26,7 +54,7 @@ func createShardDb(t *testing.T, id int) *db.KVDatabase {
 		assert.NoError(t, err)
 	}(name)
 
-	kvdb, err := db.NewDatabase(name, false)
+	kvdb, err := db.NewDatabase(name, readOnly)
 	assert.NoError(t, err)
 	t.Cleanup(func() {
 		assert.NoError(t, kvdb.Close())
@@ -47,8 +75,8 @@ func createShardServer(t *testing.T, id int, addrs map[int]string) (*db.KVDataba
 }
 
 func TestWebServer(t *testing.T) {
-	var test1GetHandler, test1SetHandler func(w http.ResponseWriter, r *http.Request)
-	var test2GetHandler, test2SetHandler func(w http.ResponseWriter, r *http.Request)
+	var test1GetHandler, test1SetHandler, test1DeleteHandler func(w http.ResponseWriter, r *http.Request)
+	var test2GetHandler, test2SetHandler, test2DeleteHandler func(w http.ResponseWriter, r *http.Request)
 
 	testServer1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
@@ -56,6 +84,8 @@ func TestWebServer(t *testing.T) {
 			test1GetHandler(w, r)
 		case "/set":
 			test1SetHandler(w, r)
+		case "/delete":
+			test1DeleteHandler(w, r)
 		default:
 			w.WriteHeader(http.StatusNotFound)
 		}
@@ -68,6 +98,8 @@ func TestWebServer(t *testing.T) {
 			test2GetHandler(w, r)
 		case "/set":
 			test2SetHandler(w, r)
+		case "/delete":
+			test2DeleteHandler(w, r)
 		default:
 			w.WriteHeader(http.StatusNotFound)
 		}
@@ -83,14 +115,16 @@ func TestWebServer(t *testing.T) {
 	kvdb2, server2 := createShardServer(t, 1, addrs)
 
 	keys := map[string]int{
-		"INDIAfsdfsfs": 1,
-		"USA":          0,
+		"INDIAfsdfsfs": 0,
+		"USA":          1,
 	}
 
 	test1GetHandler = server1.GetHandler
 	test1SetHandler = server1.SetHandler
 	test2GetHandler = server2.GetHandler
 	test2SetHandler = server2.SetHandler
+	test1DeleteHandler = server1.DeleteHandler
+	test2DeleteHandler = server2.DeleteHandler
 
 	for key := range keys {
 		_, err := http.Get(fmt.Sprintf(testServer1.URL+"/set?key=%s&value=value-%s", key, key))
@@ -108,11 +142,1319 @@ func TestWebServer(t *testing.T) {
 		log.Default().Println(string(contents))
 	}
 
-	value1, err := kvdb1.GetKey("USA")
+	assert.Equal(t, "value-INDIAfsdfsfs", getKey(t, kvdb1, "INDIAfsdfsfs"))
+	assert.Equal(t, "value-USA", getKey(t, kvdb2, "USA"))
+
+	// a posted form is forwarded with its fields
+	resp, err := http.PostForm(testServer1.URL+"/set", url.Values{"key": {"USA"}, "value": {"posted"}})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "posted", getKey(t, kvdb2, "USA"))
+
+	for key := range keys {
+		_, err := http.Get(fmt.Sprintf(testServer1.URL+"/delete?key=%s", key))
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, "", getKey(t, kvdb1, "INDIAfsdfsfs"))
+	assert.Equal(t, "", getKey(t, kvdb2, "USA"))
+}
+
+func TestReplication(t *testing.T) {
+	replicas := []string{"127.0.0.22:8080", "127.0.0.23:8080"}
+	leaderDb := createShardDb(t, 0)
+	leader := web.NewServer(leaderDb, &config.ShardMetadata{
+		Count:    1,
+		CurrIdx:  0,
+		Addrs:    map[int]string{0: ""},
+		Replicas: map[int][]string{0: replicas},
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replicate", leader.ReplicateHandler)
+	mux.HandleFunc("/deleteReplica", leader.DeleteReplicaHandler)
+	leaderServer := httptest.NewServer(mux)
+	defer leaderServer.Close()
+	leaderAddr := strings.TrimPrefix(leaderServer.URL, "http://")
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, leaderDb.SetKey(fmt.Sprintf("key-%d", i), db.Value{Data: []byte(fmt.Sprintf("value-%d", i))}))
+	}
+	assert.NoError(t, leaderDb.DeleteKey("key-3"))
+
+	done := make(chan bool)
+	defer close(done)
+	replicaDb := createReplicaDb(t, 1)
+	go replication.SyncMasterAndReplica(replicaDb, leaderAddr, replicas[0], 3, done)
+
+	assert.Eventually(t, func() bool {
+		applied, err := replicaDb.AppliedSeq()
+		return err == nil && applied == 11
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "value-9", getKey(t, replicaDb, "key-9"))
+	assert.Equal(t, "", getKey(t, replicaDb, "key-3"))
+
+	// the second replica has not caught up yet, so the log must be kept for it
+	first, _, err := leaderDb.LogPosition()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), first)
+
+	secondDb := createReplicaDb(t, 2)
+	go replication.SyncMasterAndReplica(secondDb, leaderAddr, replicas[1], 3, done)
+
+	assert.Eventually(t, func() bool {
+		first, _, err := leaderDb.LogPosition()
+		return err == nil && first == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "value-9", getKey(t, secondDb, "key-9"))
+
+	// an unregistered replica can not truncate the log
+	resp, err := http.Post(leaderServer.URL+"/deleteReplica", "application/json", strings.NewReader(`{"replica":"127.0.0.99:8080","upto":11}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestReplicationAfterFailover(t *testing.T) {
+	replicas := []string{"127.0.0.22:8080"}
+	oldDb := createShardDb(t, 0)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, oldDb.SetKey(fmt.Sprintf("key-%d", i), db.Value{Data: []byte(fmt.Sprintf("value-%d", i))}))
+	}
+	newDb := createReplicaDb(t, 1)
+	entries, err := oldDb.ReadLog(1, 10)
+	assert.NoError(t, err)
+	assert.NoError(t, newDb.ApplyLog(entries))
+
+	// the old leader keeps writing after the new one got elected, none of it reaches the new leader
+	assert.NoError(t, oldDb.SetKey("key-1", db.Value{Data: []byte("lost")}))
+	assert.NoError(t, oldDb.SetKey("only-old", db.Value{Data: []byte("lost")}))
+	assert.NoError(t, oldDb.DeleteKey("key-2"))
+	assert.NoError(t, newDb.Promote(1))
+	assert.NoError(t, newDb.SetKey("key-4", db.Value{Data: []byte("new")}))
+	assert.NoError(t, newDb.SetKey("only-new", db.Value{Data: []byte("new")}))
+	assert.NoError(t, oldDb.SetReadOnly(true))
+
+	leader := web.NewServer(newDb, &config.ShardMetadata{
+		Count:    1,
+		CurrIdx:  0,
+		Addrs:    map[int]string{0: ""},
+		Replicas: map[int][]string{0: replicas},
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replicate", leader.ReplicateHandler)
+	mux.HandleFunc("/deleteReplica", leader.DeleteReplicaHandler)
+	mux.HandleFunc("/resync", leader.ResyncHandler)
+	leaderServer := httptest.NewServer(mux)
+	t.Cleanup(leaderServer.Close)
+
+	done := make(chan bool)
+	defer close(done)
+	go replication.SyncMasterAndReplica(oldDb, strings.TrimPrefix(leaderServer.URL, "http://"), replicas[0], 2, done)
+
+	// the entries of the old leader are rolled back and the log of the new one applied in their place
+	assert.Eventually(t, func() bool {
+		seq, term, err := oldDb.LastEntry()
+		return err == nil && seq == 7 && term == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	for key, value := range map[string]string{"key-1": "value-1", "key-2": "value-2", "key-4": "new", "only-new": "new", "only-old": ""} {
+		assert.Equal(t, value, getKey(t, oldDb, key), key)
+	}
+	entries, err = oldDb.ReadLog(1, 10)
+	assert.NoError(t, err)
+	expected, err := newDb.ReadLog(1, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, entries)
+}
+
+func getKey(t *testing.T, kvdb *db.KVDatabase, key string) string {
+	t.Helper()
+	value, err := kvdb.GetKey(key)
+	if errors.Is(err, db.ErrNotFound) {
+		return ""
+	}
+	assert.NoError(t, err)
+	return string(value.Data)
+}
+
+func keyForShard(t *testing.T, meta *config.ShardMetadata, shard int) string {
+	t.Helper()
+	for i := 0; ; i++ {
+		if key := fmt.Sprintf("key-%d", i); meta.GetShard(key) == shard {
+			return key
+		}
+	}
+}
+
+func TestReadConsistency(t *testing.T) {
+	var handlers [3]http.HandlerFunc
+	var servers [3]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i](w, r)
+		}))
+		defer servers[i].Close()
+	}
+	addr := func(i int) string { return strings.TrimPrefix(servers[i].URL, "http://") }
+
+	meta := func(curr int) *config.ShardMetadata {
+		return &config.ShardMetadata{
+			Count:    2,
+			CurrIdx:  curr,
+			Addrs:    map[int]string{0: addr(0), 1: addr(1)},
+			Replicas: map[int][]string{1: {addr(2)}},
+		}
+	}
+	key := keyForShard(t, meta(0), 1)
+
+	handlers[0] = web.NewServer(createShardDb(t, 0), meta(0)).GetHandler
+	leaderDb := createShardDb(t, 1)
+	assert.NoError(t, leaderDb.SetKey(key, db.Value{Data: []byte("leader-value")}))
+	handlers[1] = web.NewServer(leaderDb, meta(1)).GetHandler
+
+	// the replica is behind its leader and still has an older value
+	replicaDb := createReplicaDb(t, 2)
+	assert.NoError(t, replicaDb.ApplyLog([]db.LogEntry{{Seq: 1, Op: db.OpSet, Key: key, Value: db.Value{Data: []byte("replica-value")}}}))
+	var staleness atomic.Int64
+	staleness.Store(int64(time.Minute))
+	handlers[2] = web.NewServer(replicaDb, meta(1), web.WithStaleness(func() time.Duration {
+		return time.Duration(staleness.Load())
+	})).GetHandler
+
+	get := func(node int, query string) string {
+		resp, err := http.Get(servers[node].URL + "/get?key=" + key + query)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		contents, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(contents)
+	}
+
+	assert.Equal(t, "leader-value", get(0, ""))
+	assert.Equal(t, "leader-value", get(0, "&consistency=leader"))
+	assert.Equal(t, "replica-value", get(0, "&consistency=any"))
+	assert.Equal(t, "leader-value", get(2, "&consistency=leader"))
+
+	assert.Equal(t, "leader-value", get(0, "&consistency=bounded-staleness&max_staleness=10s"))
+	assert.Equal(t, "replica-value", get(0, "&consistency=bounded-staleness&max_staleness=2m"))
+	staleness.Store(int64(time.Second))
+	assert.Equal(t, "replica-value", get(0, "&consistency=bounded-staleness"))
+
+	// reads fall back to the leader once the replica is gone
+	servers[2].Close()
+	assert.Equal(t, "leader-value", get(0, "&consistency=any"))
+
+	resp, err := http.Get(servers[0].URL + "/get?key=" + key + "&consistency=strong")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestStaleShardMap(t *testing.T) {
+	meta, err := config.NewShardMetadata(config.ShardConfig{
+		Version:        3,
+		AvailableShard: []config.Shard{{ShardId: 0, Name: "luffy", Address: "127.0.0.1:8080"}},
+	}, "luffy")
+	assert.NoError(t, err)
+	kvdb := createShardDb(t, 0)
+	assert.NoError(t, kvdb.SetKey("key", db.Value{Data: []byte("value")}))
+	server := web.NewServer(kvdb, meta)
+
+	get := func(version string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/get?key=key", nil)
+		if version != "" {
+			r.Header.Set("X-Kv-Shard-Map-Version", version)
+		}
+		w := httptest.NewRecorder()
+		server.GetHandler(w, r)
+		return w
+	}
+
+	w := get("2")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "3", w.Header().Get("X-Kv-Shard-Map-Version"))
+
+	for _, version := range []string{"", "3"} {
+		w = get(version)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "value", w.Body.String())
+	}
+	assert.Equal(t, http.StatusBadRequest, get("latest").Code)
+}
+
+func TestKeysAPI(t *testing.T) {
+	var handlers [2]http.HandlerFunc
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		mux := http.NewServeMux()
+		mux.HandleFunc(web.KeysPrefix, func(w http.ResponseWriter, r *http.Request) { handlers[i](w, r) })
+		servers[i] = httptest.NewServer(mux)
+		defer servers[i].Close()
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}
+	kvdb0, server0 := createShardServer(t, 0, addrs)
+	kvdb1, server1 := createShardServer(t, 1, addrs)
+	handlers[0], handlers[1] = server0.KeysHandler, server1.KeysHandler
+	key := keyForShard(t, &config.ShardMetadata{Count: 2, Addrs: addrs}, 1)
+
+	do := func(method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, servers[0].URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		contents, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, string(contents)
+	}
+
+	// the key belongs to the other shard, every request is forwarded to it
+	code, _ := do(http.MethodGet, "/v1/keys/"+key, "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = do(http.MethodPut, "/v1/keys/"+key, "some value")
+	assert.Equal(t, http.StatusNoContent, code)
+	assert.Equal(t, "some value", getKey(t, kvdb1, key))
+	assert.Equal(t, "", getKey(t, kvdb0, key))
+
+	code, body := do(http.MethodGet, "/v1/keys/"+key, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "some value", body)
+	code, body = do(http.MethodHead, "/v1/keys/"+key, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "", body)
+
+	code, _ = do(http.MethodDelete, "/v1/keys/"+key, "")
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = do(http.MethodHead, "/v1/keys/"+key, "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = do(http.MethodGet, "/v1/keys/", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(http.MethodPut, "/v1/keys/"+key, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(http.MethodPost, "/v1/keys/"+key, "value")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// the legacy endpoints report missing and empty keys the same way
+	w := httptest.NewRecorder()
+	server1.GetHandler(w, httptest.NewRequest(http.MethodGet, "/get?key="+key, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	server1.SetHandler(w, httptest.NewRequest(http.MethodGet, "/set?key=", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestBinaryValues(t *testing.T) {
+	var handlers [2]http.HandlerFunc
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlers[i](w, r) }))
+		defer servers[i].Close()
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}
+	for i := range handlers {
+		meta := &config.ShardMetadata{Count: 2, CurrIdx: i, Addrs: addrs}
+		handlers[i] = web.NewServer(createShardDb(t, i), meta, web.WithMaxValueSize(16)).KeysHandler
+	}
+	key := keyForShard(t, &config.ShardMetadata{Count: 2, Addrs: addrs}, 1)
+
+	blob := []byte{0, 0xff, '&', '=', '\n', 0}
+	resp, err := http.Post(servers[0].URL+"/v1/keys/"+key, "image/png", bytes.NewReader(blob))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodPut, servers[0].URL+"/v1/keys/"+key, bytes.NewReader(blob))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "image/png")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = http.Get(servers[0].URL + "/v1/keys/" + key)
+	assert.NoError(t, err)
+	contents, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, blob, contents)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+
+	req, err = http.NewRequest(http.MethodPut, servers[0].URL+"/v1/keys/"+key, strings.NewReader(strings.Repeat("x", 17)))
+	assert.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestForwarding(t *testing.T) {
+	var handlers [2]http.HandlerFunc
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlers[i](w, r) }))
+		defer servers[i].Close()
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}
+	key := keyForShard(t, &config.ShardMetadata{Count: 2, Addrs: addrs}, 1)
+	put := func(url string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, url, strings.NewReader("value"))
+		assert.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	// both nodes believe the other one owns the key
+	swapped := map[int]string{0: addrs[1], 1: addrs[0]}
+	handlers[0] = web.NewServer(createShardDb(t, 0), &config.ShardMetadata{Count: 2, CurrIdx: 0, Addrs: addrs}).KeysHandler
+	handlers[1] = web.NewServer(createShardDb(t, 1), &config.ShardMetadata{Count: 2, CurrIdx: 0, Addrs: swapped}).KeysHandler
+	assert.Equal(t, http.StatusLoopDetected, put(servers[0].URL+"/v1/keys/"+key).StatusCode)
+
+	// clients are sent to the owner, which then serves the request
+	ownerDb := createShardDb(t, 1)
+	handlers[0] = web.NewServer(createShardDb(t, 0), &config.ShardMetadata{Count: 2, CurrIdx: 0, Addrs: addrs}, web.WithClientRedirects()).KeysHandler
+	handlers[1] = web.NewServer(ownerDb, &config.ShardMetadata{Count: 2, CurrIdx: 1, Addrs: addrs}).KeysHandler
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noFollow.Get(servers[0].URL + "/v1/keys/" + key)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, servers[1].URL+"/v1/keys/"+key, resp.Header.Get("Location"))
+
+	assert.Equal(t, http.StatusNoContent, put(servers[0].URL+"/v1/keys/"+key).StatusCode)
+	assert.Equal(t, "value", getKey(t, ownerDb, key))
+}
+
+func TestTTL(t *testing.T) {
+	kvdb, server := createShardServer(t, 0, map[int]string{0: ""})
+	do := func(method, url string) int {
+		w := httptest.NewRecorder()
+		server.KeysHandler(w, httptest.NewRequest(method, url, strings.NewReader("token")))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, "/v1/keys/session?ttl=100ms"))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/v1/keys/session"))
+	assert.Eventually(t, func() bool {
+		return do(http.MethodGet, "/v1/keys/session") == http.StatusNotFound
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/v1/keys/session?ttl=soon"))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/v1/keys/session?ttl=-5"))
+
+	w := httptest.NewRecorder()
+	server.SetHandler(w, httptest.NewRequest(http.MethodGet, "/set?key=legacy&value=token&ttl=3600", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	value, err := kvdb.GetKey("legacy")
 	assert.NoError(t, err)
-	assert.Equal(t, "value-USA", value1)
+	assert.InDelta(t, time.Now().Add(time.Hour).UnixNano(), value.ExpiresAt, float64(time.Minute))
+}
 
-	value2, err := kvdb2.GetKey("INDIAfsdfsfs")
+func TestConditionalWrites(t *testing.T) {
+	_, server := createShardServer(t, 0, map[int]string{0: ""})
+	do := func(method, body string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/v1/keys/counter", strings.NewReader(body))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		server.KeysHandler(w, r)
+		return w
+	}
+
+	created := do(http.MethodPut, "1", map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusNoContent, created.Code)
+	assert.Equal(t, http.StatusConflict, do(http.MethodPut, "1", map[string]string{"If-None-Match": "*"}).Code)
+
+	read := do(http.MethodGet, "", nil)
+	tag := read.Header().Get("ETag")
+	assert.Equal(t, created.Header().Get("ETag"), tag)
+
+	// two clients read the same version, only the first write based on it wins
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, "2", map[string]string{"If-Match": tag}).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, do(http.MethodPut, "3", map[string]string{"If-Match": tag}).Code)
+	assert.Equal(t, "2", do(http.MethodGet, "", nil).Body.String())
+
+	assert.Equal(t, http.StatusPreconditionFailed, do(http.MethodDelete, "", map[string]string{"If-Match": tag}).Code)
+	tag = do(http.MethodGet, "", nil).Header().Get("ETag")
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "", map[string]string{"If-Match": tag}).Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "", nil).Code)
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "1", map[string]string{"If-Match": "latest"}).Code)
+}
+
+func TestScan(t *testing.T) {
+	var handlers [2]http.HandlerFunc
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlers[i](w, r) }))
+		defer servers[i].Close()
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}
+	var dbs [2]*db.KVDatabase
+	for i := range handlers {
+		var server *web.Server
+		dbs[i], server = createShardServer(t, i, addrs)
+		handlers[i] = server.ScanHandler
+	}
+	meta := &config.ShardMetadata{Count: 2, Addrs: addrs}
+
+	var want []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("user:%02d", i)
+		want = append(want, key)
+		assert.NoError(t, dbs[meta.GetShard(key)].SetKey(key, db.Value{Data: []byte("value")}))
+	}
+	assert.NoError(t, dbs[0].SetKey("video:1", db.Value{Data: []byte("value")}))
+	assert.NoError(t, dbs[1].SetKey("video:2", db.Value{Data: []byte("value")}))
+
+	scan := func(query string) web.ScanResponse {
+		resp, err := http.Get(servers[0].URL + "/scan?" + query)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var page web.ScanResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+		return page
+	}
+
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		assert.Less(t, pages, 5)
+		page := scan("prefix=user:&limit=10&cursor=" + cursor)
+		for _, item := range page.Items {
+			got = append(got, item.Key)
+		}
+		if page.Cursor == "" {
+			break
+		}
+		cursor = page.Cursor
+	}
+	assert.Equal(t, want, got)
+
+	page := scan("start=user:24&end=video:2")
+	assert.Len(t, page.Items, 2)
+	assert.Equal(t, "video:1", page.Items[1].Key)
+	assert.Equal(t, "value", string(page.Items[1].Value.Data))
+
+	resp, err := http.Get(servers[0].URL + "/scan?prefix=user:&start=a")
 	assert.NoError(t, err)
-	assert.Equal(t, "value-INDIAfsdfsfs", value2)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestBatch(t *testing.T) {
+	var muxes [2]*http.ServeMux
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { muxes[i].ServeHTTP(w, r) }))
+		defer servers[i].Close()
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}
+	var dbs [2]*db.KVDatabase
+	for i := range muxes {
+		var server *web.Server
+		dbs[i], server = createShardServer(t, i, addrs)
+		muxes[i] = http.NewServeMux()
+		muxes[i].HandleFunc("/mget", server.MGetHandler)
+		muxes[i].HandleFunc("/mset", server.MSetHandler)
+		muxes[i].HandleFunc("/mdelete", server.MDeleteHandler)
+	}
+	meta := &config.ShardMetadata{Count: 2, Addrs: addrs}
+
+	batch := func(path string, req web.BatchRequest) (int, web.BatchResponse) {
+		body, err := json.Marshal(&req)
+		assert.NoError(t, err)
+		resp, err := http.Post(servers[0].URL+path, "application/json", bytes.NewReader(body))
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var res web.BatchResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res
+	}
+
+	var items []web.BatchItem
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		items = append(items, web.BatchItem{Key: key, Value: []byte("value-" + key), ContentType: "text/plain"})
+	}
+	status, res := batch("/mset", web.BatchRequest{Items: items})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, res.Results, len(items))
+	for i, r := range res.Results {
+		assert.Equal(t, keys[i], r.Key)
+		assert.Empty(t, r.Err)
+		assert.NotZero(t, r.Version)
+		assert.Equal(t, "value-"+keys[i], getKey(t, dbs[meta.GetShard(keys[i])], keys[i]))
+	}
+
+	status, res = batch("/mget", web.BatchRequest{Keys: append([]string{"missing"}, keys...)})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, res.Results, len(keys)+1)
+	assert.Equal(t, "missing", res.Results[0].Key)
+	assert.Nil(t, res.Results[0].Value)
+	for i, r := range res.Results[1:] {
+		assert.Equal(t, keys[i], r.Key)
+		if assert.NotNil(t, r.Value) {
+			assert.Equal(t, "value-"+keys[i], string(r.Value.Data))
+			assert.Equal(t, "text/plain", r.Value.ContentType)
+		}
+	}
+
+	status, res = batch("/mdelete", web.BatchRequest{Keys: keys[:10]})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, res.Results, 10)
+	for _, key := range keys[:10] {
+		assert.Equal(t, "", getKey(t, dbs[meta.GetShard(key)], key))
+	}
+	assert.Equal(t, "value-key-10", getKey(t, dbs[meta.GetShard("key-10")], "key-10"))
+
+	// a shard that can not be reached fails its own keys only
+	muxes[1] = http.NewServeMux()
+	status, res = batch("/mget", web.BatchRequest{Keys: keys[10:]})
+	assert.Equal(t, http.StatusOK, status)
+	for i, r := range res.Results {
+		if meta.GetShard(keys[10+i]) == 1 {
+			assert.NotEmpty(t, r.Err)
+		} else {
+			assert.Empty(t, r.Err)
+			assert.NotNil(t, r.Value)
+		}
+	}
+
+	status, res = batch("/mset", web.BatchRequest{Items: []web.BatchItem{{Key: "", Value: []byte("value")}}})
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.NotEmpty(t, res.Err)
+	status, _ = batch("/mset", web.BatchRequest{Items: []web.BatchItem{{Key: "key", Value: []byte("value"), TTL: "-1s"}}})
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestTxn(t *testing.T) {
+	servers, dbs, _, _ := startTxnCluster(t)
+	meta := &config.ShardMetadata{Count: 2, Addrs: map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}}
+
+	txn := func(req web.TxnRequest) (int, web.TxnResponse) {
+		body, err := json.Marshal(&req)
+		assert.NoError(t, err)
+		resp, err := http.Post(servers[0].URL+"/txn", "application/json", bytes.NewReader(body))
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var res web.TxnResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res
+	}
+
+	// two keys of shard 1, the transaction is forwarded to its leader
+	var keys []string
+	for i := 0; len(keys) < 2; i++ {
+		if key := fmt.Sprintf("key-%d", i); meta.GetShard(key) == 1 {
+			keys = append(keys, key)
+		}
+	}
+	status, res := txn(web.TxnRequest{
+		Compares: []web.TxnCompare{{Key: keys[0], Absent: true}},
+		Ops: []web.TxnOperation{
+			{Op: "set", Key: keys[0], Value: []byte("record")},
+			{Op: "set", Key: keys[1], Value: []byte("index")},
+		},
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, res.Succeeded)
+	assert.Equal(t, []uint64{1, 2}, res.Versions)
+	assert.Equal(t, "record", getKey(t, dbs[1], keys[0]))
+	assert.Equal(t, "index", getKey(t, dbs[1], keys[1]))
+
+	status, res = txn(web.TxnRequest{
+		Compares: []web.TxnCompare{{Key: keys[0], Version: 2}},
+		Ops:      []web.TxnOperation{{Op: "delete", Key: keys[0]}, {Op: "delete", Key: keys[1]}},
+	})
+	assert.Equal(t, http.StatusPreconditionFailed, status)
+	assert.False(t, res.Succeeded)
+	if assert.NotNil(t, res.Failed) {
+		assert.Equal(t, 0, *res.Failed)
+	}
+	assert.Equal(t, "record", getKey(t, dbs[1], keys[0]))
+
+	key0 := keyForShard(t, meta, 0)
+	status, _ = txn(web.TxnRequest{Ops: []web.TxnOperation{{Op: "incr", Key: key0}}})
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = txn(web.TxnRequest{Compares: []web.TxnCompare{{Key: key0, Absent: true}}})
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func startTxnCluster(t *testing.T) ([2]*httptest.Server, [2]*db.KVDatabase, [2]*web.Server, [2]*config.ShardMetadata) {
+	var muxes [2]*http.ServeMux
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { muxes[i].ServeHTTP(w, r) }))
+		t.Cleanup(servers[i].Close)
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}
+	var dbs [2]*db.KVDatabase
+	var webServers [2]*web.Server
+	var metas [2]*config.ShardMetadata
+	for i := range muxes {
+		dbs[i] = createShardDb(t, i)
+		metas[i] = &config.ShardMetadata{Count: len(addrs), CurrIdx: i, Addrs: addrs, Replicas: map[int][]string{}}
+		webServers[i] = web.NewServer(dbs[i], metas[i])
+		muxes[i] = http.NewServeMux()
+		muxes[i].HandleFunc("/txn", webServers[i].TxnHandler)
+		muxes[i].HandleFunc("/txn/prepare", webServers[i].PrepareHandler)
+		muxes[i].HandleFunc("/txn/commit", webServers[i].CommitHandler)
+		muxes[i].HandleFunc("/txn/abort", webServers[i].AbortHandler)
+		muxes[i].HandleFunc("/txn/status", webServers[i].TxnStatusHandler)
+	}
+	return servers, dbs, webServers, metas
+}
+
+func TestTwoPhaseCommit(t *testing.T) {
+	servers, dbs, webServers, metas := startTxnCluster(t)
+	meta := &config.ShardMetadata{Count: 2, Addrs: map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}}
+	key0, key1 := keyForShard(t, meta, 0), keyForShard(t, meta, 1)
+
+	txn := func(req web.TxnRequest) (int, web.TxnResponse) {
+		body, err := json.Marshal(&req)
+		assert.NoError(t, err)
+		resp, err := http.Post(servers[0].URL+"/txn", "application/json", bytes.NewReader(body))
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var res web.TxnResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res
+	}
+
+	status, res := txn(web.TxnRequest{
+		Compares: []web.TxnCompare{{Key: key0, Absent: true}, {Key: key1, Absent: true}},
+		Ops: []web.TxnOperation{
+			{Op: "set", Key: key1, Value: []byte("index")},
+			{Op: "set", Key: key0, Value: []byte("record")},
+		},
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, res.Succeeded)
+	assert.Equal(t, []int{0, 1}, res.Shards)
+	// the coordinator logs the pending state, every shard logs its prepare, and the coordinator the outcome
+	assert.Equal(t, []uint64{2, 4}, res.Versions)
+	assert.Equal(t, "record", getKey(t, dbs[0], key0))
+	assert.Equal(t, "index", getKey(t, dbs[1], key1))
+
+	// a condition that does not hold on one shard aborts the whole transaction
+	status, res = txn(web.TxnRequest{
+		Compares: []web.TxnCompare{{Key: key0, Value: []byte("record")}, {Key: key1, Version: 7}},
+		Ops:      []web.TxnOperation{{Op: "delete", Key: key0}, {Op: "delete", Key: key1}},
+	})
+	assert.Equal(t, http.StatusPreconditionFailed, status)
+	assert.False(t, res.Succeeded)
+	if assert.NotNil(t, res.Failed) {
+		assert.Equal(t, 1, *res.Failed)
+	}
+	assert.Equal(t, "record", getKey(t, dbs[0], key0))
+	assert.Equal(t, "index", getKey(t, dbs[1], key1))
+	// the keys prepared on shard 0 were released
+	assert.NoError(t, dbs[0].SetKey(key0, db.Value{Data: []byte("record2")}))
+
+	// shard 1 prepared a transaction that its coordinator committed, then crashed before hearing about it
+	assert.NoError(t, dbs[1].Prepare(db.PreparedTxn{
+		ID:               "in-doubt",
+		CoordinatorShard: 0,
+		Ops:              []db.TxnOp{{Key: key1, Value: db.Value{Data: []byte("committed")}}},
+	}))
+	assert.True(t, errors.Is(dbs[1].SetKey(key1, db.Value{Data: []byte("other")}), db.ErrLocked))
+	assert.NoError(t, dbs[0].SaveTxn(db.CoordinatedTxn{ID: "in-doubt", State: db.TxnCommitted}))
+	// and one the coordinator never decided on
+	assert.NoError(t, dbs[1].Prepare(db.PreparedTxn{
+		ID:               "forgotten",
+		CoordinatorShard: 0,
+		Ops:              []db.TxnOp{{Key: "other", Value: db.Value{Data: []byte("aborted")}}},
+	}))
+
+	assert.NoError(t, webServers[1].RecoverTxns())
+	assert.Equal(t, "committed", getKey(t, dbs[1], key1))
+	assert.Equal(t, "", getKey(t, dbs[1], "other"))
+	prepared, err := dbs[1].PreparedTxns()
+	assert.NoError(t, err)
+	assert.Empty(t, prepared)
+
+	// a commit the shard never prepared is refused, a repeated one is answered again
+	resolve := func(path string) int {
+		resp, err := http.Post(servers[1].URL+path, "application/json", nil)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusNotFound, resolve("/txn/commit?id=unknown"))
+	assert.Equal(t, http.StatusOK, resolve("/txn/commit?id=in-doubt"))
+	assert.Equal(t, http.StatusConflict, resolve("/txn/abort?id=in-doubt"))
+	assert.Equal(t, http.StatusConflict, resolve("/txn/commit?id=forgotten"))
+	assert.Equal(t, http.StatusOK, resolve("/txn/abort?id=unknown"))
+
+	// a transaction left pending by a crash of its coordinator is aborted on every shard, then forgotten
+	assert.NoError(t, dbs[0].SaveTxn(db.CoordinatedTxn{ID: "pending", State: db.TxnPending, Shards: []int{0, 1}}))
+	assert.NoError(t, dbs[1].Prepare(db.PreparedTxn{
+		ID:               "pending",
+		CoordinatorShard: 0,
+		Ops:              []db.TxnOp{{Key: key1, Delete: true}},
+	}))
+	assert.NoError(t, webServers[0].RecoverTxns())
+	txns, err := dbs[0].CoordinatedTxns()
+	assert.NoError(t, err)
+	assert.Empty(t, txns)
+	prepared, err = dbs[1].PreparedTxns()
+	assert.NoError(t, err)
+	assert.Empty(t, prepared)
+	assert.Equal(t, "committed", getKey(t, dbs[1], key1))
+
+	// the outcome is asked to the current leader of the coordinating shard, after a failover as well
+	assert.NoError(t, dbs[1].Prepare(db.PreparedTxn{
+		ID:               "failover",
+		CoordinatorShard: 0,
+		Ops:              []db.TxnOp{{Key: key1, Value: db.Value{Data: []byte("after failover")}}},
+	}))
+	assert.NoError(t, dbs[0].SaveTxn(db.CoordinatedTxn{ID: "failover", State: db.TxnCommitted, Shards: []int{1}}))
+	servers[0].Close()
+	promoted := httptest.NewServer(http.HandlerFunc(webServers[0].TxnStatusHandler))
+	t.Cleanup(promoted.Close)
+	metas[1].SetLeader(0, strings.TrimPrefix(promoted.URL, "http://"), 1)
+	assert.NoError(t, webServers[1].RecoverTxns())
+	assert.Equal(t, "after failover", getKey(t, dbs[1], key1))
+}
+
+func TestWatch(t *testing.T) {
+	var handlers [2]http.HandlerFunc
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handlers[i](w, r) }))
+		// closed after the watches, which are closed by their own cleanup
+		t.Cleanup(servers[i].Close)
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}
+	var dbs [2]*db.KVDatabase
+	for i := range handlers {
+		var server *web.Server
+		dbs[i], server = createShardServer(t, i, addrs)
+		handlers[i] = server.WatchHandler
+	}
+	meta := &config.ShardMetadata{Count: 2, Addrs: addrs}
+	key := keyForShard(t, meta, 1)
+
+	watch := func(query, lastEventID string) (*http.Response, *bufio.Reader) {
+		req, err := http.NewRequest(http.MethodGet, servers[0].URL+"/watch?"+query, nil)
+		assert.NoError(t, err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp, bufio.NewReader(resp.Body)
+	}
+	next := func(r *bufio.Reader) (id string, event web.WatchEvent) {
+		for {
+			line, err := r.ReadString('\n')
+			assert.NoError(t, err)
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimSpace(strings.TrimPrefix(line, "id: "))
+			case strings.HasPrefix(line, "data: "):
+				assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+			case line == "\n" && id != "":
+				return id, event
+			}
+		}
+	}
+
+	assert.NoError(t, dbs[1].SetKey(key, db.Value{Data: []byte("v1")}))
+
+	// the watch of a key of shard 1 is proxied to its leader and starts from the given revision
+	resp, events := watch("key="+key+"&from=1", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	id, event := next(events)
+	assert.Equal(t, "1", id)
+	assert.Equal(t, web.WatchEvent{Revision: 1, Type: "set", Key: key, Value: &db.Value{Data: []byte("v1"), Version: 1}}, event)
+
+	// later changes are pushed as they happen, other keys are filtered out
+	assert.NoError(t, dbs[1].SetKey(key+"-other", db.Value{Data: []byte("other")}))
+	assert.NoError(t, dbs[1].DeleteKey(key))
+	id, event = next(events)
+	assert.Equal(t, "3", id)
+	assert.Equal(t, "delete", event.Type)
+	assert.Nil(t, event.Value)
+	resp.Body.Close()
+
+	// a client that reconnects resumes after the last event it got
+	assert.NoError(t, dbs[1].SetKey(key, db.Value{Data: []byte("v2")}))
+	_, events = watch("key="+key, "1")
+	id, _ = next(events)
+	assert.Equal(t, "3", id)
+	id, event = next(events)
+	assert.Equal(t, "4", id)
+	assert.Equal(t, "v2", string(event.Value.Data))
+
+	// prefix watches follow a single shard, which must be given
+	_, events = watch("prefix="+key[:2]+"&shard=1&from=2", "")
+	id, _ = next(events)
+	assert.Equal(t, "2", id)
+	resp, _ = watch("prefix="+key[:2], "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	assert.NoError(t, dbs[1].TruncateLog(2))
+	resp, _ = watch("key="+key+"&from=1", "")
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+	resp, _ = watch("key="+key+"&prefix=a", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestCounters(t *testing.T) {
+	var muxes [2]*http.ServeMux
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { muxes[i].ServeHTTP(w, r) }))
+		defer servers[i].Close()
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}
+	var dbs [2]*db.KVDatabase
+	for i := range muxes {
+		var server *web.Server
+		dbs[i], server = createShardServer(t, i, addrs)
+		muxes[i] = http.NewServeMux()
+		muxes[i].HandleFunc("/incr", server.IncrHandler)
+		muxes[i].HandleFunc("/decr", server.DecrHandler)
+	}
+	meta := &config.ShardMetadata{Count: 2, Addrs: addrs}
+	key := keyForShard(t, meta, 1)
+
+	post := func(path string) (int, string) {
+		resp, err := http.Post(servers[0].URL+path, "", nil)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	// concurrent increments through another node are not lost
+	done := make(chan bool)
+	for i := 0; i < 20; i++ {
+		go func() {
+			status, _ := post("/incr?key=" + key)
+			assert.Equal(t, http.StatusOK, status)
+			done <- true
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		<-done
+	}
+	assert.Equal(t, "20", getKey(t, dbs[1], key))
+
+	status, body := post("/decr?key=" + key + "&delta=5")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "15", body)
+
+	assert.NoError(t, dbs[1].SetKey(key, db.Value{Data: []byte("not a number")}))
+	status, _ = post("/incr?key=" + key)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	status, _ = post("/incr?key=" + key + "&delta=one")
+	assert.Equal(t, http.StatusBadRequest, status)
+	resp, err := http.Get(servers[0].URL + "/incr?key=" + key)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestNamespaces(t *testing.T) {
+	var muxes [2]*http.ServeMux
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { muxes[i].ServeHTTP(w, r) }))
+		t.Cleanup(servers[i].Close)
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}
+	var dbs [2]*db.KVDatabase
+	for i := range muxes {
+		var server *web.Server
+		dbs[i], server = createShardServer(t, i, addrs)
+		muxes[i] = http.NewServeMux()
+		muxes[i].HandleFunc("/admin/namespaces", server.NamespacesHandler)
+		muxes[i].HandleFunc(web.NamespacesPrefix, server.NamespacesHandler)
+		muxes[i].HandleFunc(web.KeysPrefix, server.KeysHandler)
+		muxes[i].HandleFunc("/mset", server.MSetHandler)
+		muxes[i].HandleFunc("/txn", server.TxnHandler)
+		muxes[i].HandleFunc("/txn/prepare", server.PrepareHandler)
+		muxes[i].HandleFunc("/txn/commit", server.CommitHandler)
+		muxes[i].HandleFunc("/txn/abort", server.AbortHandler)
+	}
+	meta := &config.ShardMetadata{Count: 2, Addrs: addrs}
+	keys := [2]string{keyForShard(t, meta, 0), keyForShard(t, meta, 1)}
+
+	do := func(method, path string, header http.Header, body string) (int, string) {
+		req, err := http.NewRequest(method, servers[0].URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, string(b)
+	}
+	nsHeader := http.Header{"X-Kv-Namespace": {"web"}}
+
+	status, _ := do(http.MethodPut, web.KeysPrefix+keys[1]+"?namespace=web", nil, "value")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// the namespace is created on the leader of every shard
+	status, body := do(http.MethodPut, web.NamespacesPrefix+"web", nil, `{"maxKeys": 1}`)
+	assert.Equal(t, http.StatusOK, status, body)
+	var created web.NamespacesResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &created))
+	assert.Equal(t, []int{0, 1}, created.Shards)
+	var webDbs [2]*db.KVDatabase
+	for i := range dbs {
+		var err error
+		webDbs[i], err = dbs[i].Namespace("web")
+		assert.NoError(t, err)
+	}
+
+	// a forwarded write keeps its namespace
+	status, _ = do(http.MethodPut, web.KeysPrefix+keys[1], nsHeader, "web value")
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Equal(t, "web value", getKey(t, webDbs[1], keys[1]))
+	assert.Equal(t, "", getKey(t, dbs[1], keys[1]))
+	status, body = do(http.MethodGet, web.KeysPrefix+keys[1]+"?namespace=web", nil, "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "web value", body)
+	status, _ = do(http.MethodGet, web.KeysPrefix+keys[1], nil, "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// the quota of each shard is enforced by its leader
+	status, _ = do(http.MethodPut, web.KeysPrefix+keys[1]+"-other", nsHeader, "value")
+	assert.Equal(t, http.StatusInsufficientStorage, status)
+	status, body = do(http.MethodPost, "/mset", nsHeader, `{"items": [{"key": "`+keys[0]+`", "value": "dmFsdWU="}]}`)
+	assert.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, "value", getKey(t, webDbs[0], keys[0]))
+
+	// lifting the quota lets a cross-shard transaction write both shards of the namespace
+	status, body = do(http.MethodPut, web.NamespacesPrefix+"web", nil, "")
+	assert.Equal(t, http.StatusOK, status, body)
+	status, body = do(http.MethodPost, "/txn?namespace=web", nil, `{"ops": [
+		{"op": "set", "key": "`+keys[0]+`", "value": "dHhuMA=="},
+		{"op": "set", "key": "`+keys[1]+`", "value": "dHhuMQ=="}]}`)
+	assert.Equal(t, http.StatusOK, status, body)
+	assert.Equal(t, "txn0", getKey(t, webDbs[0], keys[0]))
+	assert.Equal(t, "txn1", getKey(t, webDbs[1], keys[1]))
+	assert.Equal(t, "", getKey(t, dbs[0], keys[0]))
+
+	status, body = do(http.MethodGet, "/admin/namespaces", nil, "")
+	assert.Equal(t, http.StatusOK, status)
+	var list web.NamespacesResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &list))
+	assert.Len(t, list.Namespaces, 1)
+	assert.Equal(t, "web", list.Namespaces[0].Name)
+	assert.Equal(t, int64(1), list.Namespaces[0].Keys)
+	assert.Equal(t, int64(0), list.Namespaces[0].MaxKeys)
+
+	status, _ = do(http.MethodPut, web.NamespacesPrefix+"no/slash", nil, "")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestAuth(t *testing.T) {
+	creds := []auth.Credential{
+		{ID: "node", Secret: "node-secret", Roles: []auth.Role{auth.RoleAdmin, auth.RoleReplication}},
+		{ID: "replicator", Secret: "replicator-secret", Roles: []auth.Role{auth.RoleReplication}},
+		{ID: "app", Token: "app-token", Roles: []auth.Role{auth.RoleWrite}, Namespaces: []string{""}},
+		{ID: "reader", Token: "reader-token", Roles: []auth.Role{auth.RoleRead}},
+		{ID: "admin", Token: "admin-token", Roles: []auth.Role{auth.RoleAdmin}},
+	}
+	authenticator, err := auth.NewAuthenticator(creds)
+	assert.NoError(t, err)
+
+	var muxes [2]*http.ServeMux
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { muxes[i].ServeHTTP(w, r) }))
+		t.Cleanup(servers[i].Close)
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "http://"),
+		1: strings.TrimPrefix(servers[1].URL, "http://"),
+	}
+	replicas := []string{"127.0.0.22:8080"}
+	var dbs [2]*db.KVDatabase
+	for i := range muxes {
+		dbs[i] = createShardDb(t, i)
+		meta := &config.ShardMetadata{Count: 2, CurrIdx: i, Addrs: addrs, Replicas: map[int][]string{0: replicas}}
+		server := web.NewServer(dbs[i], meta, web.WithAuth(authenticator, &creds[0]))
+		muxes[i] = http.NewServeMux()
+		muxes[i].HandleFunc(web.KeysPrefix, server.AuthorizeMethod(server.KeysHandler))
+		muxes[i].HandleFunc("/purge", server.Authorize(auth.RoleAdmin, server.DeleteKeysHandler))
+		muxes[i].HandleFunc("/replicate", server.Authorize(auth.RoleReplication, server.ReplicateHandler))
+		muxes[i].HandleFunc("/deleteReplica", server.Authorize(auth.RoleReplication, server.DeleteReplicaHandler))
+	}
+	meta := &config.ShardMetadata{Count: 2, Addrs: addrs}
+	keys := [2]string{keyForShard(t, meta, 0), keyForShard(t, meta, 1)}
+
+	do := func(method, path, token, body string) int {
+		req, err := http.NewRequest(method, servers[0].URL+path, strings.NewReader(body))
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/purge", "", ""))
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/purge", "wrong", ""))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/purge", "app-token", ""))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/deleteReplica", "admin-token", `{"replica":"127.0.0.22:8080","upto":1}`))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/replicate?from=1", "app-token", ""))
+
+	// the write is forwarded to the other shard with the credential of the node
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, web.KeysPrefix+keys[1], "app-token", "value"))
+	assert.Equal(t, "value", getKey(t, dbs[1], keys[1]))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, web.KeysPrefix+keys[1], "reader-token", ""))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, web.KeysPrefix+keys[1], "reader-token", "value"))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPut, web.KeysPrefix+keys[1]+"?namespace=web", "app-token", "value"))
+	assert.Equal(t, http.StatusNoContent, do(http.MethodPut, web.KeysPrefix+keys[0], "app-token", "value"))
+
+	// replicas pull the log with their own credential
+	done := make(chan bool)
+	defer close(done)
+	replicaDb := createReplicaDb(t, 2)
+	client := replication.NewClient(replicaDb, addrs[0], replicas[0], 10)
+	client.SetCredential(&creds[1])
+	go client.Run(done)
+	assert.Eventually(t, func() bool {
+		first, _, err := dbs[0].LogPosition()
+		return err == nil && first == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "value", getKey(t, replicaDb, keys[0]))
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/purge", "admin-token", ""))
+}
+
+// writeTestCerts writes a CA and a certificate for 127.0.0.1 signed by it, shared by the test nodes
+func writeTestCerts(t *testing.T) (config.TLSConfig, *x509.CertPool) {
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kv test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDer)
+	assert.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, ca, &key.PublicKey, caKey)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	conf := config.TLSConfig{
+		Cert:       filepath.Join(dir, "node.pem"),
+		Key:        filepath.Join(dir, "node-key.pem"),
+		CA:         filepath.Join(dir, "ca.pem"),
+		ClientAuth: config.ClientAuthVerifyIfGiven,
+	}
+	for file, block := range map[string]*pem.Block{
+		conf.Cert: {Type: "CERTIFICATE", Bytes: der},
+		conf.Key:  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+		conf.CA:   {Type: "CERTIFICATE", Bytes: caDer},
+	} {
+		assert.NoError(t, os.WriteFile(file, pem.EncodeToMemory(block), 0600))
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return conf, pool
+}
+
+func TestTLS(t *testing.T) {
+	conf, pool := writeTestCerts(t)
+	tlsCerts, err := certs.NewReloader(conf)
+	assert.NoError(t, err)
+
+	var muxes [2]*http.ServeMux
+	var servers [2]*httptest.Server
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { muxes[i].ServeHTTP(w, r) }))
+		servers[i].TLS = tlsCerts.ServerConfig()
+		servers[i].StartTLS()
+		t.Cleanup(servers[i].Close)
+	}
+	addrs := map[int]string{
+		0: strings.TrimPrefix(servers[0].URL, "https://"),
+		1: strings.TrimPrefix(servers[1].URL, "https://"),
+	}
+	replicas := []string{"127.0.0.22:8080"}
+	var dbs [2]*db.KVDatabase
+	for i := range muxes {
+		dbs[i] = createShardDb(t, i)
+		meta := &config.ShardMetadata{Count: 2, CurrIdx: i, Addrs: addrs, Replicas: map[int][]string{0: replicas}}
+		server := web.NewServer(dbs[i], meta, web.WithTLS(tlsCerts))
+		muxes[i] = http.NewServeMux()
+		muxes[i].HandleFunc(web.KeysPrefix, server.AuthorizeMethod(server.KeysHandler))
+		muxes[i].HandleFunc("/replicate", server.Authorize(auth.RoleReplication, server.ReplicateHandler))
+		muxes[i].HandleFunc("/deleteReplica", server.Authorize(auth.RoleReplication, server.DeleteReplicaHandler))
+	}
+	meta := &config.ShardMetadata{Count: 2, Addrs: addrs}
+	keys := [2]string{keyForShard(t, meta, 0), keyForShard(t, meta, 1)}
+
+	// clients verify the nodes but need no certificate of their own
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	put := func(key string) int {
+		req, err := http.NewRequest(http.MethodPut, servers[0].URL+web.KeysPrefix+key, strings.NewReader("value"))
+		assert.NoError(t, err)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusNoContent, put(keys[1]), "forwarded over mutual TLS")
+	assert.Equal(t, "value", getKey(t, dbs[1], keys[1]))
+	assert.Equal(t, http.StatusNoContent, put(keys[0]))
+
+	// only the nodes can replicate
+	resp, err := client.Get(servers[0].URL + "/replicate?from=1")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	done := make(chan bool)
+	defer close(done)
+	replicaDb := createReplicaDb(t, 2)
+	replica := replication.NewClient(replicaDb, addrs[0], replicas[0], 10)
+	replica.SetTLS(tlsCerts)
+	go replica.Run(done)
+	assert.Eventually(t, func() bool {
+		first, _, err := dbs[0].LogPosition()
+		return err == nil && first == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "value", getKey(t, replicaDb, keys[0]))
+}
+
+func TestBackup(t *testing.T) {
+	replicas := []string{"127.0.0.22:8080"}
+	dir := t.TempDir()
+	// the snapshot is copied from the file, which createDb removes
+	leaderDb, err := db.NewDatabase(filepath.Join(dir, "leader.db"), false)
+	assert.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, leaderDb.Close()) })
+	leader := web.NewServer(leaderDb, &config.ShardMetadata{
+		Count:    1,
+		CurrIdx:  0,
+		Addrs:    map[int]string{0: ""},
+		Replicas: map[int][]string{0: replicas},
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/backup", leader.BackupHandler)
+	mux.HandleFunc("/replicate", leader.ReplicateHandler)
+	mux.HandleFunc("/deleteReplica", leader.DeleteReplicaHandler)
+	leaderServer := httptest.NewServer(mux)
+	t.Cleanup(leaderServer.Close)
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, leaderDb.SetKey(fmt.Sprintf("key-%d", i), db.Value{Data: []byte(fmt.Sprintf("value-%d", i))}))
+	}
+	resp, err := http.Get(leaderServer.URL + "/admin/backup")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("X-Kv-Backup-Seq"))
+	assert.Equal(t, "0", resp.Header.Get("X-Kv-Backup-Shard"))
+	backup := filepath.Join(dir, "backup.db")
+	f, err := os.Create(backup)
+	assert.NoError(t, err)
+	n, err := io.Copy(f, resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.ContentLength, n)
+	assert.NoError(t, f.Close())
+
+	resp, err = http.Post(leaderServer.URL+"/admin/backup", "", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// the replica restored from the backup only pulls the changes made since
+	assert.NoError(t, leaderDb.SetKey("key-5", db.Value{Data: []byte("value-5")}))
+	assert.NoError(t, leaderDb.DeleteKey("key-0"))
+	info, err := db.Restore(backup, filepath.Join(dir, "replica.db"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), info.Seq)
+	replicaDb, err := db.NewDatabase(filepath.Join(dir, "replica.db"), true)
+	assert.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, replicaDb.Close()) })
+	assert.NoError(t, leaderDb.TruncateLog(info.Seq))
+
+	done := make(chan bool)
+	defer close(done)
+	go replication.SyncMasterAndReplica(replicaDb, strings.TrimPrefix(leaderServer.URL, "http://"), replicas[0], 10, done)
+	assert.Eventually(t, func() bool {
+		applied, err := replicaDb.AppliedSeq()
+		return err == nil && applied == 7
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "value-4", getKey(t, replicaDb, "key-4"))
+	assert.Equal(t, "value-5", getKey(t, replicaDb, "key-5"))
+	assert.Equal(t, "", getKey(t, replicaDb, "key-0"))
 }
@@ -0,0 +1,510 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTxnRecoveryInterval is how often in-doubt cross-shard transactions are resolved
+const DefaultTxnRecoveryInterval = 5 * time.Second
+
+// resolvedTxnRetention is how long a shard remembers the outcome of the transactions it resolved, so
+// that a coordinator retrying after losing the answer is told the transaction is committed
+const resolvedTxnRetention = 24 * time.Hour
+
+// PrepareRequest is the part of a cross-shard transaction sent to a participating shard on /txn/prepare
+type PrepareRequest struct {
+	ID string `json:"id"`
+	// CoordinatorShard is the shard whose leader is asked for the outcome of the transaction, it is asked
+	// wherever the leadership moved since
+	CoordinatorShard int `json:"coordinatorShard"`
+	// Namespace is the namespace of the keys of the transaction, empty for the default one
+	Namespace string `json:"namespace,omitempty"`
+	TxnRequest
+}
+
+// TxnStatus is the outcome of a cross-shard transaction served by its coordinator on /txn/status
+type TxnStatus struct {
+	ID    string      `json:"id"`
+	State db.TxnState `json:"state"`
+}
+
+// txnPart is the part of a transaction owned by one shard, with the index in the transaction of each of
+// its conditions and operations
+type txnPart struct {
+	shard    int
+	req      TxnRequest
+	compares []int
+	ops      []int
+}
+
+// splitTxn groups the conditions and operations of the transaction by shard
+func (s *Server) splitTxn(req TxnRequest) []*txnPart {
+	parts := make(map[int]*txnPart)
+	part := func(key string) *txnPart {
+		shard := s.shardMetadata.GetShard(key)
+		if parts[shard] == nil {
+			parts[shard] = &txnPart{shard: shard}
+		}
+		return parts[shard]
+	}
+	for i, c := range req.Compares {
+		p := part(c.Key)
+		p.req.Compares = append(p.req.Compares, c)
+		p.compares = append(p.compares, i)
+	}
+	for i, op := range req.Ops {
+		p := part(op.Key)
+		p.req.Ops = append(p.req.Ops, op)
+		p.ops = append(p.ops, i)
+	}
+	res := make([]*txnPart, 0, len(parts))
+	for _, p := range parts {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].shard < res[j].shard })
+	return res
+}
+
+func newTxnID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// twoPhaseCommit coordinates a transaction over the keys of several shards. The transaction is recorded
+// as pending, every shard leader prepares its part, then the outcome is recorded and sent to the shards.
+// A shard that does not hear about the outcome asks this node for it, and a transaction left pending by
+// a crash of this node is aborted by RecoverTxns.
+func (s *Server) twoPhaseCommit(kv *db.KVDatabase, req TxnRequest, w http.ResponseWriter, r *http.Request) {
+	parts := s.splitTxn(req)
+	shards := make([]int, len(parts))
+	for i, p := range parts {
+		shards[i] = p.shard
+	}
+	id := newTxnID()
+	s.coordinating.Store(id, true)
+	defer s.coordinating.Delete(id)
+
+	txn := db.CoordinatedTxn{ID: id, State: db.TxnPending, Shards: shards, StartedAt: time.Now().UnixNano()}
+	if err := s.db.SaveTxn(txn); err != nil {
+		log.Println(err)
+		txnError(w, http.StatusInternalServerError, &TxnResponse{Shards: shards, Err: err.Error()})
+		return
+	}
+
+	// phase one: every shard votes
+	votes := make([]txnVote, len(parts))
+	var wg sync.WaitGroup
+	for i, p := range parts {
+		wg.Add(1)
+		go func(i int, p *txnPart) {
+			defer wg.Done()
+			prepare := PrepareRequest{ID: id, CoordinatorShard: s.shardMetadata.CurrentShard(), Namespace: kv.Name(), TxnRequest: p.req}
+			if p.shard == s.shardMetadata.CurrentShard() {
+				votes[i].status, votes[i].res = s.prepare(prepare)
+				return
+			}
+			votes[i] = s.callShard(r.Context(), p.shard, "/txn/prepare", prepare)
+		}(i, p)
+	}
+	wg.Wait()
+
+	var failed *txnVote
+	var failedPart *txnPart
+	for i := range votes {
+		if votes[i].status != http.StatusOK {
+			failed, failedPart = &votes[i], parts[i]
+			break
+		}
+	}
+
+	// phase two: the outcome is persisted before any shard is told
+	txn.State = db.TxnCommitted
+	if failed != nil {
+		txn.State = db.TxnAborted
+	}
+	if err := s.db.SaveTxn(txn); err != nil {
+		// the transaction is still pending, it is aborted by the recovery
+		log.Printf("error recording the outcome of transaction %s: %v", id, err)
+		txnError(w, http.StatusInternalServerError, &TxnResponse{Shards: shards, Err: err.Error()})
+		return
+	}
+	results := s.resolveTxn(r.Context(), txn, parts)
+
+	if failed != nil {
+		res := &TxnResponse{Shards: shards, Err: fmt.Sprintf("shard %d: %s", failedPart.shard, failed.res.Err)}
+		if failed.res.Failed != nil && *failed.res.Failed < len(failedPart.compares) {
+			// report the index of the condition in the whole transaction
+			index := failedPart.compares[*failed.res.Failed]
+			res.Failed = &index
+		}
+		txnError(w, failed.status, res)
+		return
+	}
+	versions := make([]uint64, len(req.Ops))
+	for i, p := range parts {
+		for j, v := range results[i].res.Versions {
+			if j < len(p.ops) {
+				versions[p.ops[j]] = v
+			}
+		}
+	}
+	log.Printf("Committed transaction %s on shards %v", id, shards)
+	json.NewEncoder(w).Encode(&TxnResponse{Succeeded: true, Versions: versions, Shards: shards})
+}
+
+// txnVote is the answer of a shard to a step of a cross-shard transaction
+type txnVote struct {
+	status int
+	res    TxnResponse
+}
+
+// resolveTxn sends the outcome of the transaction to the shards that have not acknowledged it yet, and
+// forgets the transaction once they all have
+func (s *Server) resolveTxn(ctx context.Context, txn db.CoordinatedTxn, parts []*txnPart) []txnVote {
+	path := "/txn/commit"
+	if txn.State == db.TxnAborted {
+		path = "/txn/abort"
+	}
+	results := make([]txnVote, len(parts))
+	var wg sync.WaitGroup
+	for i, p := range parts {
+		wg.Add(1)
+		go func(i int, shard int) {
+			defer wg.Done()
+			if shard == s.shardMetadata.CurrentShard() {
+				results[i].status, results[i].res = s.resolvePrepared(txn.ID, txn.State)
+				return
+			}
+			results[i] = s.callShard(ctx, shard, path+"?id="+url.QueryEscape(txn.ID), nil)
+		}(i, p.shard)
+	}
+	wg.Wait()
+
+	var remaining []int
+	for i, p := range parts {
+		if results[i].status != http.StatusOK {
+			log.Printf("error sending outcome %s of transaction %s to shard %d: %s", txn.State, txn.ID, p.shard, results[i].res.Err)
+			remaining = append(remaining, p.shard)
+		}
+	}
+	var err error
+	if len(remaining) == 0 {
+		err = s.db.ForgetTxn(txn.ID)
+	} else {
+		txn.Shards = remaining
+		err = s.db.SaveTxn(txn)
+	}
+	if err != nil {
+		log.Printf("error recording the progress of transaction %s: %v", txn.ID, err)
+	}
+	return results
+}
+
+// callShard sends a step of a transaction to the leader of the shard
+func (s *Server) callShard(ctx context.Context, shard int, uri string, body interface{}) txnVote {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return txnVote{status: http.StatusInternalServerError, res: TxnResponse{Err: err.Error()}}
+		}
+	}
+	return s.callNode(ctx, s.shardMetadata.Leader(shard), uri, b)
+}
+
+func (s *Server) callNode(ctx context.Context, addr, uri string, body []byte) txnVote {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.scheme+"://"+addr+uri, bytes.NewReader(body))
+	if err != nil {
+		return txnVote{status: http.StatusInternalServerError, res: TxnResponse{Err: err.Error()}}
+	}
+	req.RequestURI = uri
+	resp, err := s.forward(addr, req)
+	if err != nil {
+		return txnVote{status: http.StatusBadGateway, res: TxnResponse{Err: err.Error()}}
+	}
+	defer resp.Body.Close()
+	vote := txnVote{status: resp.StatusCode}
+	if err := json.NewDecoder(resp.Body).Decode(&vote.res); err != nil && vote.status == http.StatusOK {
+		return txnVote{status: http.StatusBadGateway, res: TxnResponse{Err: fmt.Sprintf("error decoding response: %v", err)}}
+	}
+	if vote.status != http.StatusOK && vote.res.Err == "" {
+		vote.res.Err = resp.Status
+	}
+	return vote
+}
+
+// PrepareHandler prepares the part of a cross-shard transaction owned by this shard, the keys stay
+// locked until the coordinator sends the outcome on /txn/commit or /txn/abort
+func (s *Server) PrepareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		txnError(w, http.StatusMethodNotAllowed, &TxnResponse{Err: "transactions must be sent with POST"})
+		return
+	}
+	if !s.checkShardMap(w, r) {
+		return
+	}
+	var req PrepareRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&req); err != nil {
+		txnError(w, http.StatusBadRequest, &TxnResponse{Err: fmt.Sprintf("invalid transaction: %v", err)})
+		return
+	}
+	status, res := s.prepare(req)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&res)
+}
+
+// prepare votes on the part of a transaction owned by this shard
+func (s *Server) prepare(req PrepareRequest) (int, TxnResponse) {
+	if req.ID == "" {
+		return http.StatusBadRequest, TxnResponse{Err: "id is required"}
+	}
+	if req.CoordinatorShard < 0 || req.CoordinatorShard >= s.shardMetadata.ShardCount() {
+		return http.StatusBadRequest, TxnResponse{Err: fmt.Sprintf("unknown coordinator shard %d", req.CoordinatorShard)}
+	}
+	compares, ops, err := s.parseTxn(req.TxnRequest)
+	if err != nil {
+		return http.StatusBadRequest, TxnResponse{Err: err.Error()}
+	}
+	for _, c := range compares {
+		if shard := s.shardMetadata.GetShard(c.Key); shard != s.shardMetadata.CurrentShard() {
+			return http.StatusConflict, TxnResponse{Err: fmt.Sprintf("key %q belongs to shard %d", c.Key, shard)}
+		}
+	}
+	for _, op := range ops {
+		if shard := s.shardMetadata.GetShard(op.Key); shard != s.shardMetadata.CurrentShard() {
+			return http.StatusConflict, TxnResponse{Err: fmt.Sprintf("key %q belongs to shard %d", op.Key, shard)}
+		}
+	}
+	if s.db.ReadOnly() {
+		return http.StatusServiceUnavailable, TxnResponse{Err: fmt.Sprintf("not the leader of shard %d", s.shardMetadata.CurrentShard())}
+	}
+	kv, err := s.db.Namespace(req.Namespace)
+	if errors.Is(err, db.ErrNoNamespace) {
+		return http.StatusNotFound, TxnResponse{Err: err.Error()}
+	}
+	if err != nil {
+		log.Println(err)
+		return http.StatusInternalServerError, TxnResponse{Err: err.Error()}
+	}
+
+	err = kv.Prepare(db.PreparedTxn{ID: req.ID, CoordinatorShard: req.CoordinatorShard, Compares: compares, Ops: ops})
+	var failed *db.CompareError
+	switch {
+	case errors.As(err, &failed):
+		return http.StatusPreconditionFailed, TxnResponse{Failed: &failed.Index, Err: failed.Error()}
+	case errors.Is(err, db.ErrLocked), errors.Is(err, db.ErrTxnOutcome):
+		return http.StatusConflict, TxnResponse{Err: err.Error()}
+	case errors.Is(err, db.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage, TxnResponse{Err: err.Error()}
+	case err != nil:
+		log.Println(err)
+		return http.StatusInternalServerError, TxnResponse{Err: err.Error()}
+	}
+	return http.StatusOK, TxnResponse{Succeeded: true}
+}
+
+// CommitHandler applies a prepared transaction, ?id= is the id of the transaction
+func (s *Server) CommitHandler(w http.ResponseWriter, r *http.Request) {
+	s.resolveHandler(db.TxnCommitted, w, r)
+}
+
+// AbortHandler drops a prepared transaction and releases its keys, ?id= is the id of the transaction
+func (s *Server) AbortHandler(w http.ResponseWriter, r *http.Request) {
+	s.resolveHandler(db.TxnAborted, w, r)
+}
+
+func (s *Server) resolveHandler(state db.TxnState, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		txnError(w, http.StatusMethodNotAllowed, &TxnResponse{Err: "transactions must be sent with POST"})
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		txnError(w, http.StatusBadRequest, &TxnResponse{Err: "id is empty"})
+		return
+	}
+	status, res := s.resolvePrepared(id, state)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&res)
+}
+
+// resolvePrepared applies the outcome of a transaction prepared on this shard. Committing a transaction
+// this shard does not know is answered with 404, and resolving it with the other outcome with 409: the
+// coordinator keeps the shard in the ones to resolve and the failure is logged on both sides.
+func (s *Server) resolvePrepared(id string, state db.TxnState) (int, TxnResponse) {
+	if s.db.ReadOnly() {
+		return http.StatusServiceUnavailable, TxnResponse{Err: fmt.Sprintf("not the leader of shard %d", s.shardMetadata.CurrentShard())}
+	}
+	var versions []uint64
+	var err error
+	if state == db.TxnAborted {
+		err = s.db.AbortPrepared(id)
+	} else {
+		versions, err = s.db.CommitPrepared(id)
+	}
+	switch {
+	case errors.Is(err, db.ErrUnknownTxn):
+		log.Println(err)
+		return http.StatusNotFound, TxnResponse{Err: err.Error()}
+	case errors.Is(err, db.ErrTxnOutcome):
+		log.Println(err)
+		return http.StatusConflict, TxnResponse{Err: err.Error()}
+	case err != nil:
+		log.Println(err)
+		return http.StatusInternalServerError, TxnResponse{Err: err.Error()}
+	}
+	return http.StatusOK, TxnResponse{Succeeded: state == db.TxnCommitted, Versions: versions}
+}
+
+// TxnStatusHandler serves the outcome of a transaction coordinated by this node, ?id= is the id of the
+// transaction. A transaction that is not known has been aborted.
+func (s *Server) TxnStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("id is empty"))
+		return
+	}
+	state, err := s.txnState(id)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	json.NewEncoder(w).Encode(&TxnStatus{ID: id, State: state})
+}
+
+func (s *Server) txnState(id string) (db.TxnState, error) {
+	txn, ok, err := s.db.LookupTxn(id)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		// the pending state is recorded before any shard prepares, and a transaction is only forgotten
+		// once every shard applied its outcome
+		return db.TxnAborted, nil
+	}
+	return txn.State, nil
+}
+
+// RunTxnRecovery resolves the in-doubt transactions left by a crash, once at start and then at every
+// interval, while this node leads its shard. Every node forgets the outcomes older than resolvedTxnRetention.
+func (s *Server) RunTxnRecovery(done <-chan bool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.db.PruneResolvedTxns(time.Now().Add(-resolvedTxnRetention)); err != nil {
+			log.Printf("error pruning resolved transactions: %v", err)
+		}
+		if !s.db.ReadOnly() {
+			if err := s.RecoverTxns(); err != nil {
+				log.Printf("error recovering transactions: %v", err)
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RecoverTxns resolves the transactions that this node coordinated and did not finish, aborting the
+// pending ones, and asks the coordinator of every transaction prepared on this shard for its outcome
+func (s *Server) RecoverTxns() error {
+	txns, err := s.db.CoordinatedTxns()
+	if err != nil {
+		return err
+	}
+	for _, txn := range txns {
+		if _, running := s.coordinating.Load(txn.ID); running {
+			continue
+		}
+		if txn.State == db.TxnPending {
+			// the node stopped before every shard voted
+			txn.State = db.TxnAborted
+			if err := s.db.SaveTxn(txn); err != nil {
+				return err
+			}
+		}
+		parts := make([]*txnPart, len(txn.Shards))
+		for i, shard := range txn.Shards {
+			parts[i] = &txnPart{shard: shard}
+		}
+		s.resolveTxn(context.Background(), txn, parts)
+	}
+
+	prepared, err := s.db.PreparedTxns()
+	if err != nil {
+		return err
+	}
+	for _, p := range prepared {
+		state, err := s.coordinatorState(p)
+		if err != nil {
+			log.Printf("error asking the coordinator of transaction %s for its outcome: %v", p.ID, err)
+			continue
+		}
+		if state == db.TxnPending {
+			continue
+		}
+		if status, res := s.resolvePrepared(p.ID, state); status != http.StatusOK {
+			log.Printf("error resolving transaction %s: %s", p.ID, res.Err)
+			continue
+		}
+		log.Printf("Resolved in-doubt transaction %s: %s", p.ID, state)
+	}
+	return nil
+}
+
+// coordinatorState asks the coordinator of a prepared transaction for its outcome: the current leader
+// of the coordinating shard, which knows the transaction as it is replicated along with the shard
+func (s *Server) coordinatorState(p db.PreparedTxn) (db.TxnState, error) {
+	addr := p.Coordinator
+	if addr == "" {
+		addr = s.shardMetadata.Leader(p.CoordinatorShard)
+	}
+	if addr == s.shardMetadata.Leader(s.shardMetadata.CurrentShard()) {
+		if _, running := s.coordinating.Load(p.ID); running {
+			return db.TxnPending, nil
+		}
+		return s.txnState(p.ID)
+	}
+	uri := "/txn/status?id=" + url.QueryEscape(p.ID)
+	req, err := http.NewRequest(http.MethodGet, s.scheme+"://"+addr+uri, nil)
+	if err != nil {
+		return "", err
+	}
+	req.RequestURI = uri
+	resp, err := s.forward(addr, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s", resp.Status)
+	}
+	var status TxnStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return "", fmt.Errorf("error decoding response: %w", err)
+	}
+	return status.State, nil
+}
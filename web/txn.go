@@ -0,0 +1,192 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"io"
+	"log"
+	"net/http"
+)
+
+// TxnCompare is a condition of a transaction, on the value, the version or the absence of a key
+type TxnCompare struct {
+	Key string `json:"key"`
+	// Value only holds when the key exists with this value
+	Value []byte `json:"value,omitempty"`
+	// Version only holds when the key exists with this version, as returned in its ETag
+	Version uint64 `json:"version,omitempty"`
+	// Absent only holds when the key does not exist
+	Absent bool `json:"absent,omitempty"`
+}
+
+// TxnOperation is a write of a transaction, Op is either set or delete
+type TxnOperation struct {
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	TTL         string `json:"ttl,omitempty"`
+}
+
+// TxnRequest is the body of /txn: the operations are applied atomically if every condition holds
+type TxnRequest struct {
+	Compares []TxnCompare   `json:"compares,omitempty"`
+	Ops      []TxnOperation `json:"ops"`
+}
+
+// TxnResponse reports whether the transaction was applied, with the version written by each operation
+type TxnResponse struct {
+	Succeeded bool     `json:"succeeded"`
+	Versions  []uint64 `json:"versions,omitempty"`
+	// Failed is the index of the condition that did not hold
+	Failed *int `json:"failed,omitempty"`
+	// Shards lists the shards of a transaction over the keys of several shards
+	Shards []int  `json:"shards,omitempty"`
+	Err    string `json:"err,omitempty"`
+}
+
+// TxnHandler applies a transaction: the conditions are checked and the operations applied in one
+// transaction of the shard leader, and nothing is written if a condition does not hold. Transactions
+// over the keys of several shards are coordinated by this node with a two-phase commit.
+func (s *Server) TxnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		txnError(w, http.StatusMethodNotAllowed, &TxnResponse{Err: "transactions must be sent with POST"})
+		return
+	}
+	if !s.checkShardMap(w, r) {
+		return
+	}
+	kv, status, err := s.lookupNamespace(r)
+	if err != nil {
+		txnError(w, status, &TxnResponse{Err: err.Error()})
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		txnError(w, http.StatusRequestEntityTooLarge, &TxnResponse{Err: fmt.Sprintf("transaction larger than %d bytes", maxBatchBytes)})
+		return
+	}
+	var req TxnRequest
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		txnError(w, http.StatusBadRequest, &TxnResponse{Err: fmt.Sprintf("invalid transaction: %v", err)})
+		return
+	}
+	// the body is sent again if the transaction is forwarded to the shard leader
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	compares, ops, err := s.parseTxn(req)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errValueTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		txnError(w, status, &TxnResponse{Err: err.Error()})
+		return
+	}
+
+	if len(ops) == 0 {
+		txnError(w, http.StatusBadRequest, &TxnResponse{Err: "a transaction needs at least one operation"})
+		return
+	}
+	shards := make(map[int]bool)
+	for _, c := range compares {
+		shards[s.shardMetadata.GetShard(c.Key)] = true
+	}
+	for _, op := range ops {
+		shards[s.shardMetadata.GetShard(op.Key)] = true
+	}
+	if len(shards) > 1 {
+		// this node coordinates the transaction, so it has to be able to record its outcome
+		if s.ownsWrite(s.shardMetadata.CurrentShard(), w, r) {
+			s.twoPhaseCommit(kv, req, w, r)
+		}
+		return
+	}
+
+	shard := s.shardMetadata.GetShard(ops[0].Key)
+	if !s.ownsWrite(shard, w, r) {
+		return
+	}
+	versions, err := kv.Txn(compares, ops)
+	var failed *db.CompareError
+	if errors.As(err, &failed) {
+		txnError(w, http.StatusPreconditionFailed, &TxnResponse{Failed: &failed.Index, Err: failed.Error()})
+		return
+	}
+	if errors.Is(err, db.ErrLocked) {
+		txnError(w, http.StatusConflict, &TxnResponse{Err: err.Error()})
+		return
+	}
+	if errors.Is(err, db.ErrQuotaExceeded) {
+		txnError(w, http.StatusInsufficientStorage, &TxnResponse{Err: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		txnError(w, http.StatusInternalServerError, &TxnResponse{Err: err.Error()})
+		return
+	}
+	log.Println(fmt.Sprintf("Shard = %d, current shard = %d, applied transaction of %d operations", shard, s.shardMetadata.CurrentShard(), len(ops)))
+	json.NewEncoder(w).Encode(&TxnResponse{Succeeded: true, Versions: versions})
+}
+
+var errValueTooLarge = errors.New("value too large")
+
+// parseTxn validates the transaction and turns it into the conditions and operations of the database
+func (s *Server) parseTxn(req TxnRequest) ([]db.Compare, []db.TxnOp, error) {
+	if len(req.Compares)+len(req.Ops) > maxBatchKeys {
+		return nil, nil, fmt.Errorf("a transaction has at most %d conditions and operations", maxBatchKeys)
+	}
+	compares := make([]db.Compare, len(req.Compares))
+	for i, c := range req.Compares {
+		if c.Key == "" {
+			return nil, nil, fmt.Errorf("key of condition %d is empty", i)
+		}
+		if c.Absent && (c.Version != 0 || c.Value != nil) {
+			return nil, nil, fmt.Errorf("condition %d on key %q can not require the key to be absent and to have a value or version", i, c.Key)
+		}
+		compares[i] = db.Compare{
+			Key:       c.Key,
+			Condition: db.Condition{IfAbsent: c.Absent, IfVersion: c.Version},
+			IfValue:   c.Value,
+		}
+	}
+	ops := make([]db.TxnOp, len(req.Ops))
+	for i, op := range req.Ops {
+		if op.Key == "" {
+			return nil, nil, fmt.Errorf("key of operation %d is empty", i)
+		}
+		switch op.Op {
+		case "delete":
+			ops[i] = db.TxnOp{Key: op.Key, Delete: true}
+		case "set":
+			if len(op.Value) == 0 {
+				return nil, nil, fmt.Errorf("value of key %q is empty", op.Key)
+			}
+			if int64(len(op.Value)) > s.maxValueSize {
+				return nil, nil, fmt.Errorf("%w: value of key %q larger than %d bytes", errValueTooLarge, op.Key, s.maxValueSize)
+			}
+			expiresAt, err := ttlExpiry(op.TTL)
+			if err != nil {
+				return nil, nil, fmt.Errorf("key %q: %v", op.Key, err)
+			}
+			ops[i] = db.TxnOp{Key: op.Key, Value: db.Value{Data: op.Value, ContentType: op.ContentType, ExpiresAt: expiresAt}}
+		default:
+			return nil, nil, fmt.Errorf("unknown op %q of operation %d, expected set or delete", op.Op, i)
+		}
+	}
+	return compares, ops, nil
+}
+
+func txnError(w http.ResponseWriter, status int, res *TxnResponse) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,217 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Vignesh-Rajarajan/distributed-kv-store/db"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// watchBatchSize is the number of change log entries read at a time by a watch
+	watchBatchSize = 100
+	// watchKeepAlive is how often an idle watch sends a comment, so that the connection is not dropped
+	watchKeepAlive = 15 * time.Second
+)
+
+// WatchEvent is a change of a watched key, sent as the data of a server-sent event
+type WatchEvent struct {
+	// Revision is the position of the change in the change log of the shard, also sent as the event id
+	Revision uint64 `json:"revision"`
+	// Type is either set or delete
+	Type  string    `json:"type"`
+	Key   string    `json:"key"`
+	Value *db.Value `json:"value,omitempty"`
+}
+
+// watchRequest is a parsed /watch request
+type watchRequest struct {
+	// namespace is the namespace of the watched keys
+	namespace   string
+	key, prefix string
+	shard       int
+	// from is the first revision to send, 0 to only send the changes made after the watch started
+	from uint64
+}
+
+func (s *Server) parseWatch(r *http.Request) (watchRequest, error) {
+	q := r.URL.Query()
+	req := watchRequest{key: q.Get("key"), prefix: q.Get("prefix"), shard: s.shardMetadata.CurrentShard()}
+	switch {
+	case req.key != "" && req.prefix != "":
+		return req, fmt.Errorf("key can not be combined with prefix")
+	case req.key == "" && req.prefix == "":
+		return req, fmt.Errorf("key or prefix is required")
+	case req.key != "":
+		req.shard = s.shardMetadata.GetShard(req.key)
+	}
+	if raw := q.Get("shard"); raw != "" {
+		shard, err := strconv.Atoi(raw)
+		if err != nil || s.shardMetadata.Leader(shard) == "" {
+			return req, fmt.Errorf("unknown shard %q", raw)
+		}
+		if req.key != "" && shard != req.shard {
+			return req, fmt.Errorf("key %q belongs to shard %d", req.key, req.shard)
+		}
+		req.shard = shard
+	} else if req.prefix != "" && s.shardMetadata.ShardCount() > 1 {
+		// the keys of a prefix are spread over every shard, each numbering its own revisions
+		return req, fmt.Errorf("a prefix watch follows a single shard, shard is required")
+	}
+	if raw := q.Get("from"); raw != "" {
+		from, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil || from == 0 {
+			return req, fmt.Errorf("invalid from %q", raw)
+		}
+		req.from = from
+	}
+	// a reconnecting event source resumes after the last event it received
+	if raw := r.Header.Get("Last-Event-ID"); raw != "" {
+		last, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return req, fmt.Errorf("invalid Last-Event-ID %q", raw)
+		}
+		req.from = last + 1
+	}
+	return req, nil
+}
+
+func (req watchRequest) matches(e db.LogEntry) bool {
+	if (e.Op != db.OpSet && e.Op != db.OpDelete) || e.Namespace != req.namespace {
+		return false
+	}
+	if req.key != "" {
+		return e.Key == req.key
+	}
+	return strings.HasPrefix(e.Key, req.prefix)
+}
+
+// WatchHandler streams the sets and deletes of a key, or of the keys of a prefix, as server-sent events.
+// The events are read from the change log of the shard, so a watch started from a revision gets every
+// change since then, and a client that reconnects with the Last-Event-ID header resumes where it stopped.
+// Revisions are numbered per shard: a prefix watch follows the shard of ?shard=, which is required when
+// there are several shards.
+// A watch only sees the keys of its namespace, but the revisions are shared by all the namespaces.
+func (s *Server) WatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.checkShardMap(w, r) {
+		return
+	}
+	req, err := s.parseWatch(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	kv, ok := s.namespace(w, r)
+	if !ok {
+		return
+	}
+	req.namespace = kv.Name()
+	if req.shard != s.shardMetadata.CurrentShard() {
+		// replicas number their change log like their leader, so this node serves watches of its own shard
+		s.redirect(req.shard, w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("streaming is not supported"))
+		return
+	}
+
+	next := req.from
+	if next == 0 {
+		_, last, err := s.db.LogPosition()
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		next = last + 1
+	}
+	// the revision is checked before the stream starts, so that a compacted one gets a proper status
+	if _, err := s.db.ReadChanges(next, 1); err != nil {
+		if errors.Is(err, db.ErrCompacted) {
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(fmt.Sprintf("revision %d is compacted, watch from a later revision", next)))
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		changed := s.db.Changes()
+		entries, err := s.db.ReadChanges(next, watchBatchSize)
+		if err != nil {
+			// the watch fell behind the truncation of the log, the client has to start over
+			log.Printf("error watching from revision %d: %v", next, err)
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+			flusher.Flush()
+			return
+		}
+		for _, e := range entries {
+			next = e.Seq + 1
+			if !req.matches(e) {
+				continue
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		}
+		if len(entries) > 0 {
+			flusher.Flush()
+		}
+		if len(entries) == watchBatchSize {
+			continue
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e db.LogEntry) error {
+	event := WatchEvent{Revision: e.Seq, Key: e.Key}
+	switch e.Op {
+	case db.OpSet:
+		event.Type = "set"
+		event.Value = &e.Value
+	case db.OpDelete:
+		event.Type = "delete"
+	}
+	data, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, event.Type, data)
+	return err
+}